@@ -0,0 +1,36 @@
+//go:build go1.23
+
+package zeroconf
+
+import (
+	"context"
+	"iter"
+)
+
+// BrowseSeq browses for the services of a given type like Browse, but returns
+// the entries as an iterator instead of sending them to a channel. Browsing
+// stops when ctx expires or the loop over the iterator is left. An error is
+// yielded if browsing failed to start, or stopped before ctx expired.
+func (r *Resolver) BrowseSeq(ctx context.Context, service, domain string) iter.Seq2[*ServiceEntry, error] {
+	return func(yield func(*ServiceEntry, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		entries := make(chan *ServiceEntry)
+		if err := r.Browse(ctx, service, domain, entries); err != nil {
+			yield(nil, err)
+			return
+		}
+		for e := range entries {
+			if !yield(e, nil) {
+				// Wait for the browse to stop, which closes entries.
+				cancel()
+				for range entries {
+				}
+				return
+			}
+		}
+		if ctx.Err() == nil {
+			yield(nil, errReceiveFailed)
+		}
+	}
+}
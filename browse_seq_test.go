@@ -0,0 +1,66 @@
+//go:build go1.23
+
+package zeroconf
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBrowseSeq(t *testing.T) {
+	network := new(memNetwork)
+	resolver, err := NewResolver(WithConnIPv4(network.conn("198.51.100.1")))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	announcer := network.conn("198.51.100.2")
+	announce := func() {
+		buf, err := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1")).Pack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		announcer.WriteTo(buf, defaultGroups.ipv4Addr())
+	}
+
+	// Leaving the loop stops browsing.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, announce)
+	var found *ServiceEntry
+	for e, err := range resolver.BrowseSeq(ctx, mdnsService, mdnsDomain) {
+		if err != nil {
+			t.Fatalf("Expected browse success, but got %v", err)
+		}
+		found = e
+		break
+	}
+	if found == nil || found.Instance != mdnsName {
+		t.Fatalf("Expected to find the instance, but got %v", found)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Expected the loop to be left before the context expired")
+	}
+
+	// The loop ends when the context expires. As with Browse, the sockets
+	// of the resolver are closed once browsing stopped.
+	resolver, err = NewResolver(WithConnIPv4(network.conn("198.51.100.3")))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, announce)
+	var n int
+	for _, err := range resolver.BrowseSeq(ctx, mdnsService, mdnsDomain) {
+		if err != nil {
+			t.Fatalf("Expected browse success, but got %v", err)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("Expected one entry, but got %d", n)
+	}
+}
@@ -2,9 +2,15 @@ package zeroconf
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -27,8 +33,38 @@ const (
 )
 
 type clientOpts struct {
-	listenOn IPType
-	ifaces   []net.Interface
+	listenOn        IPType
+	ifaces          []net.Interface
+	ifaceNames      []string
+	reportRemovals  bool
+	addrGracePeriod time.Duration
+	logger          Logger
+	perIfaceEntries bool
+	anyDomain       bool
+	errors          chan<- error
+	groups          multicastGroups
+	hopLimit        int
+	maxPacketSize   int
+	queryInterval   time.Duration
+	maxInterval     time.Duration
+	retries         int           // queries repeated by lookups, < 0 for no limit
+	retryInterval   time.Duration // 0 for the query interval
+	packetHook      PacketHook
+	unicastResolver string
+	maxAddrs        int
+	maxEntries      int
+	excludeSelf     bool
+	acceptFrom      []*net.IPNet
+	requireTTL      bool
+	exclusive       bool
+	conn4, conn6    net.PacketConn
+	suppressWindow  time.Duration
+	entryFilter     func(*ServiceEntry) bool
+	instanceFilter  *regexp.Regexp
+	entryMapper     func(*ServiceEntry) *ServiceEntry
+	entryBuffer     int
+	dropPolicy      DropPolicy
+	maxRecordTTL    time.Duration
 }
 
 // ClientOption fills the option struct to configure intefaces, etc.
@@ -38,7 +74,8 @@ type ClientOption func(*clientOpts)
 // instance listens for.
 // This does not guarantee that only mDNS entries of this sepcific
 // type passes. E.g. typical mDNS packets distributed via IPv4, may contain
-// both DNS A and AAAA entries.
+// both DNS A and AAAA entries. If one of both types is not available, e.g.
+// because IPv6 is disabled, the resolver falls back to the other.
 func SelectIPTraffic(t IPType) ClientOption {
 	return func(o *clientOpts) {
 		o.listenOn = t
@@ -52,6 +89,340 @@ func SelectIfaces(ifaces []net.Interface) ClientOption {
 	}
 }
 
+// WithRemovals enables reporting of services that went away. Once a service
+// sent a goodbye packet or its records expired without being refreshed, the
+// previously delivered entry is sent once more with a TTL of 0.
+func WithRemovals() ClientOption {
+	return func(o *clientOpts) {
+		o.reportRemovals = true
+	}
+}
+
+// WithAddressGracePeriod sets how long the resolver waits for the address
+// records of a service after its SRV record arrived. Entries still lacking
+// addresses afterwards are delivered with empty address lists.
+func WithAddressGracePeriod(d time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.addrGracePeriod = d
+	}
+}
+
+// SelectIfacesByName selects the interfaces to query for mDNS records by their
+// names, e.g. "eth1". Interfaces that don't exist, are down or are not
+// multicast capable are skipped with a warning.
+func SelectIfacesByName(names ...string) ClientOption {
+	return func(o *clientOpts) {
+		o.ifaceNames = names
+	}
+}
+
+// WithoutDeduplication delivers the entries received on each interface
+// separately. By default, an entry received on several interfaces is only
+// delivered once, with the addresses of all interfaces merged. It is delivered
+// again whenever the merged addresses change.
+func WithoutDeduplication() ClientOption {
+	return func(o *clientOpts) {
+		o.perIfaceEntries = true
+	}
+}
+
+// WithCrossDomainDeduplication identifies the entries by instance name and
+// service type only, ignoring their domain. An instance announced in several
+// domains, e.g. by BrowseDomains in "local." and in the domain of a
+// split-horizon setup, is delivered once, with the Domain it was seen in first.
+// Its records in the other domains are ignored until that entry is removed.
+func WithCrossDomainDeduplication() ClientOption {
+	return func(o *clientOpts) {
+		o.anyDomain = true
+	}
+}
+
+// WithErrors sets a channel receiving the errors occurring while browsing or
+// looking up services, such as malformed packets. Errors are dropped if the
+// channel is not ready, so it should be buffered. If an error stops receiving
+// altogether, the entries channel is closed after the error was sent.
+func WithErrors(errs chan<- error) ClientOption {
+	return func(o *clientOpts) {
+		o.errors = errs
+	}
+}
+
+// WithPort sets the port to use instead of the mDNS port 5353. Along with
+// WithMulticastGroups, this allows running isolated instances, e.g. for
+// testing. Only services registered with the same port are found.
+func WithPort(port int) ClientOption {
+	return func(o *clientOpts) {
+		o.groups.port = port
+	}
+}
+
+// WithMulticastGroups sets the multicast groups to use instead of the mDNS
+// groups 224.0.0.251 and ff02::fb.
+func WithMulticastGroups(v4, v6 net.IP) ClientOption {
+	return func(o *clientOpts) {
+		o.groups.ipv4 = v4
+		o.groups.ipv6 = v6
+	}
+}
+
+// WithIPv6MulticastGroup sets the IPv6 multicast group to use instead of the
+// link-local mDNS group ff02::fb, e.g. ff05::fb to reach the site. The scope
+// of the group determines how far routers forward the queries.
+func WithIPv6MulticastGroup(group net.IP) ClientOption {
+	return func(o *clientOpts) {
+		o.groups.ipv6 = group
+	}
+}
+
+// WithMulticastHopLimit sets the IP TTL, or IPv6 hop limit, of the multicast
+// queries sent. It defaults to 255, as recommended by RFC6762. A limit of 1
+// confines the queries to the local link even if they are relayed.
+func WithMulticastHopLimit(n int) ClientOption {
+	return func(o *clientOpts) {
+		o.hopLimit = n
+	}
+}
+
+// WithMaxPacketSize sets the size in bytes up to which queries are sent in a
+// single packet. The known answers of larger ones are spread across several
+// packets, see RFC6762 section 7.2. It defaults to 9000 bytes, the upper limit
+// of RFC6762 section 17, and must be at least 512 bytes.
+func WithMaxPacketSize(size int) ClientOption {
+	return func(o *clientOpts) {
+		o.maxPacketSize = size
+	}
+}
+
+// WithQueryInterval sets the interval between the first two queries and the
+// maximum interval between queries. The interval doubles with every query, as
+// recommended by RFC6762, and starts over once a service went away. It
+// defaults to one second, up to one hour.
+func WithQueryInterval(initial, max time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.queryInterval = initial
+		o.maxInterval = max
+	}
+}
+
+// WithRetries limits how often lookups of a service instance repeat their
+// query, e.g. WithRetries(2) sends three queries in total. Lookup then stops
+// querying, but keeps listening for announcements until its context expires.
+// For LookupOnce, LookupTXT and LookupAddr, it replaces the default of 2
+// retries. A negative n, the default, doesn't limit Lookup. Browsing and Watch
+// are never limited.
+func WithRetries(n int) ClientOption {
+	return func(o *clientOpts) {
+		o.retries = n
+	}
+}
+
+// WithRetryInterval sets the fixed interval between the queries repeated by
+// lookups of a service instance, e.g. 250ms for quick resolves on a reliable
+// network. It applies with or without WithRetries. By default, Lookup follows
+// the query interval, see WithQueryInterval, and LookupOnce, LookupTXT and
+// LookupAddr retry every second.
+func WithRetryInterval(d time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.retryInterval = d
+	}
+}
+
+// WithEntryFilter drops the entries for which keep returns false before they
+// are sent to the entries channel, e.g. to find services with a certain TXT
+// record only. Removals are filtered the same way.
+func WithEntryFilter(keep func(*ServiceEntry) bool) ClientOption {
+	return func(o *clientOpts) {
+		o.entryFilter = keep
+	}
+}
+
+// WithInstanceFilter makes the resolver consider only the service instances
+// whose names match the glob pattern, in which "*" matches any sequence of
+// characters and "?" a single one, e.g. "Kitchen-*". The names are compared
+// case-insensitively, as in DNS. Other instances are dropped as soon as their
+// records arrive, so that they are neither assembled nor delivered.
+func WithInstanceFilter(pattern string) ClientOption {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	return WithInstanceRegexp(regexp.MustCompile("(?is)^" + expr + "$"))
+}
+
+// WithInstanceRegexp is like WithInstanceFilter, but matches the instance
+// names against re.
+func WithInstanceRegexp(re *regexp.Regexp) ClientOption {
+	return func(o *clientOpts) {
+		o.instanceFilter = re
+	}
+}
+
+// WithEntryMapper replaces the entries by the ones returned by mapper before
+// they are sent to the entries channel, after WithEntryFilter. The mapper gets
+// a copy of each entry, which it may modify. Returning nil drops the entry.
+func WithEntryMapper(mapper func(*ServiceEntry) *ServiceEntry) ClientOption {
+	return func(o *clientOpts) {
+		o.entryMapper = mapper
+	}
+}
+
+// WithMaxRecordTTL caps the TTL of the records received, so that the entries
+// of responders advertising huge TTLs expire in time when they disappear
+// without a goodbye. There is no cap by default.
+func WithMaxRecordTTL(d time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.maxRecordTTL = d
+	}
+}
+
+// DropPolicy selects the entries dropped when the entry buffer is full, see
+// WithEntryBuffer.
+type DropPolicy uint8
+
+// Options for DropPolicy.
+const (
+	DropNewest DropPolicy = iota // keep the entries buffered, drop new ones
+	DropOldest                   // drop the longest buffered entry
+)
+
+// WithEntryBuffer buffers up to size entries for a subscriber lagging behind,
+// so that the resolver keeps processing packets. Once the buffer is full,
+// entries are dropped according to policy and counted in the resolver's
+// Stats. Without it, the resolver waits for the subscriber to receive each
+// entry.
+func WithEntryBuffer(size int, policy DropPolicy) ClientOption {
+	return func(o *clientOpts) {
+		o.entryBuffer = size
+		o.dropPolicy = policy
+	}
+}
+
+// WithDuplicateQuestionSuppression suppresses the questions of a query that
+// were asked within the given window already, by another host or by another
+// resolver of this process, as described in RFC6762 section 7.3. This avoids
+// flooding the network when browsing is restarted often. Responses to the
+// earlier query are only seen if the resolver was listening already, so
+// restarted browses might find services only on the next query. Only the
+// initial query of a lookup is suppressed, never its retransmissions. There is
+// no suppression by default.
+func WithDuplicateQuestionSuppression(window time.Duration) ClientOption {
+	return func(o *clientOpts) {
+		o.suppressWindow = window
+	}
+}
+
+// WithPacketHook sets a hook inspecting every packet received or sent by the
+// resolver, including the ones ignored otherwise.
+func WithPacketHook(hook PacketHook) ClientOption {
+	return func(o *clientOpts) {
+		o.packetHook = hook
+	}
+}
+
+// defaultMaxAddrs limits the addresses accumulated for a host by default.
+const defaultMaxAddrs = 32
+
+// defaultMaxEntries limits the entries a single browse or lookup keeps track
+// of by default, protecting the resolver from responders flooding it with
+// instances.
+const defaultMaxEntries = 1000
+
+// WithMaxAddresses limits the IPv4 and IPv6 addresses accumulated for a host,
+// and thereby for each entry, to n. Further addresses are dropped and counted
+// in the resolver's Stats. It defaults to 32; n <= 0 removes the limit.
+func WithMaxAddresses(n int) ClientOption {
+	return func(o *clientOpts) {
+		o.maxAddrs = n
+	}
+}
+
+// WithMaxEntries limits the service instances a single browse or lookup keeps
+// track of to n. Instances beyond are dropped and counted in the resolver's
+// Stats until others went away. It defaults to 1000; n <= 0 removes the limit.
+func WithMaxEntries(n int) ClientOption {
+	return func(o *clientOpts) {
+		o.maxEntries = n
+	}
+}
+
+// WithExcludeSelf makes the resolver drop the packets sent from an address of
+// this host, so that only services of other hosts are found. The addresses are
+// determined once, when creating the resolver.
+func WithExcludeSelf(exclude bool) ClientOption {
+	return func(o *clientOpts) {
+		o.excludeSelf = exclude
+	}
+}
+
+// WithAcceptFrom makes the resolver drop the packets whose source address is
+// not within one of the given networks. They are dropped before being parsed
+// and counted in the resolver's Stats.
+func WithAcceptFrom(nets []*net.IPNet) ClientOption {
+	return func(o *clientOpts) {
+		o.acceptFrom = nets
+	}
+}
+
+// WithRequireLinkLocalTTL makes the resolver drop the packets which weren't
+// sent with an IP TTL, or hop limit, of 255, i.e. packets that were routed and
+// might have been spoofed from outside the local link. They are counted in the
+// resolver's Stats. Packets whose TTL is unknown, e.g. received through
+// connections passed by WithConnIPv4, are accepted. It is off by default, as
+// relays forwarding mDNS packets between links lower their TTL.
+func WithRequireLinkLocalTTL(require bool) ClientOption {
+	return func(o *clientOpts) {
+		o.requireTTL = require
+	}
+}
+
+// WithAddressReuse sets whether other sockets may bind the mDNS port along
+// with the resolver's, which is needed to run alongside the mDNS daemon of the
+// operating system, e.g. Avahi or mDNSResponder. It is on by default, setting
+// SO_REUSEADDR and, except on Windows, SO_REUSEPORT. Turning it off binds the
+// port exclusively, so that the resolver fails to start if it is in use.
+func WithAddressReuse(reuse bool) ClientOption {
+	return func(o *clientOpts) {
+		o.exclusive = !reuse
+	}
+}
+
+// WithUnicastResolver sets the DNS server, e.g. "8.8.8.8:53", that is queried
+// by unicast DNS when browsing or looking up services in a domain other than
+// "local.", see RFC6763 section 11. Without it, such domains are queried by
+// multicast like "local.".
+func WithUnicastResolver(addr string) ClientOption {
+	return func(o *clientOpts) {
+		o.unicastResolver = addr
+	}
+}
+
+// WithConnIPv4 makes the resolver send and receive IPv4 mDNS messages through
+// c instead of opening a socket itself, e.g. to run over another transport or
+// in tests. Joining the multicast group is up to the caller, and received
+// entries carry no interface index. Once a connection is passed with
+// WithConnIPv4 or WithConnIPv6, the resolver opens no sockets at all. It
+// closes c when done.
+func WithConnIPv4(c net.PacketConn) ClientOption {
+	return func(o *clientOpts) {
+		o.conn4 = c
+	}
+}
+
+// WithConnIPv6 makes the resolver use c for IPv6 mDNS messages, like
+// WithConnIPv4.
+func WithConnIPv6(c net.PacketConn) ClientOption {
+	return func(o *clientOpts) {
+		o.conn6 = c
+	}
+}
+
+// WithLogger sets the logger receiving warnings and errors of the resolver. By
+// default, they are discarded.
+func WithLogger(l Logger) ClientOption {
+	return func(o *clientOpts) {
+		o.logger = l
+	}
+}
+
 // Resolver acts as entry point for service lookups and to browse the DNS-SD.
 type Resolver struct {
 	c *client
@@ -62,13 +433,38 @@ type Resolver struct {
 func NewResolver(options ...ClientOption) (*Resolver, error) {
 	// Apply default configuration and load supplied options.
 	var conf = clientOpts{
-		listenOn: IPv4AndIPv6,
+		listenOn:        IPv4AndIPv6,
+		addrGracePeriod: 500 * time.Millisecond,
+		logger:          nopLogger{},
+		groups:          defaultGroups,
+		hopLimit:        defaultHopLimit,
+		queryInterval:   time.Second,
+		maxInterval:     time.Hour,
+		maxAddrs:        defaultMaxAddrs,
+		maxEntries:      defaultMaxEntries,
+		maxPacketSize:   maxResponseSize,
+		retries:         -1,
 	}
 	for _, o := range options {
 		if o != nil {
 			o(&conf)
 		}
 	}
+	if conf.logger == nil {
+		conf.logger = nopLogger{}
+	}
+	if conf.hopLimit < 1 || conf.hopLimit > 255 {
+		return nil, fmt.Errorf("multicast hop limit must be between 1 and 255")
+	}
+	if conf.retryInterval < 0 {
+		return nil, fmt.Errorf("retry interval must not be negative")
+	}
+	if conf.maxPacketSize < minPacketSize || conf.maxPacketSize > maxResponseSize {
+		return nil, fmt.Errorf("maximum packet size must be between %d and %d bytes", minPacketSize, maxResponseSize)
+	}
+	if err := conf.groups.validate(); err != nil {
+		return nil, err
+	}
 
 	c, err := newClient(conf)
 	if err != nil {
@@ -79,18 +475,41 @@ func NewResolver(options ...ClientOption) (*Resolver, error) {
 	}, nil
 }
 
+// Stats returns a snapshot of the resolver's counters.
+func (r *Resolver) Stats() Stats {
+	return r.c.stats.snapshot()
+}
+
+// Interfaces returns the interfaces the resolver queries on, i.e. the selected
+// ones, or all multicast interfaces, that joined the mDNS group. They are fixed
+// for the lifetime of the resolver.
+func (r *Resolver) Interfaces() []net.Interface {
+	return append([]net.Interface(nil), r.c.ifaces...)
+}
+
 // Browse for all services of a given type in a given domain.
+//
+// The entries are sent to the given channel until ctx expires. The resolver
+// then closes the channel and its connections, so the caller must not close
+// the channel and can range over it until it is done.
 func (r *Resolver) Browse(ctx context.Context, service, domain string, entries chan<- *ServiceEntry) error {
+	ctx, cancel, err := r.c.lookupContext(ctx)
+	if err != nil {
+		return err
+	}
+	if r.c.isUnicast(domain) {
+		go r.c.unicastLoop(ctx, newLookupParams("", service, domain, true, entries))
+		return nil
+	}
 	params := defaultParams(service)
 	if domain != "" {
 		params.Domain = domain
 	}
 	params.Entries = entries
 	params.isBrowsing = true
-	ctx, cancel := context.WithCancel(ctx)
 	go r.c.mainloop(ctx, params)
 
-	err := r.c.query(params)
+	err = r.c.query(params)
 	if err != nil {
 		cancel()
 		return err
@@ -99,6 +518,9 @@ func (r *Resolver) Browse(ctx context.Context, service, domain string, entries c
 	// the entries' queue is closed.
 	go func() {
 		if err := r.c.periodicQuery(ctx, params); err != nil {
+			if ctx.Err() == nil {
+				r.c.reportError(err)
+			}
 			cancel()
 		}
 	}()
@@ -106,26 +528,133 @@ func (r *Resolver) Browse(ctx context.Context, service, domain string, entries c
 	return nil
 }
 
-// Lookup a specific service by its name and type in a given domain.
-func (r *Resolver) Lookup(ctx context.Context, instance, service, domain string, entries chan<- *ServiceEntry) error {
-	params := defaultParams(service)
-	params.Instance = instance
-	if domain != "" {
-		params.Domain = domain
+// errReceiveFailed is returned if receiving stopped before the context expired.
+var errReceiveFailed = errors.New("failed to receive responses")
+
+// ErrResolverClosed is returned by the browses and lookups of a resolver that
+// has been closed.
+var ErrResolverClosed = errors.New("resolver closed")
+
+// Close stops the browses and lookups of the resolver in progress, closing
+// their entries channels, and closes its connections. Further browses and
+// lookups fail with ErrResolverClosed.
+func (r *Resolver) Close() error {
+	r.c.closeOnce.Do(func() { close(r.c.closed) })
+	r.c.shutdown()
+	return nil
+}
+
+// lookupContext returns the context of a browse or lookup, which is canceled
+// once ctx expires or the resolver is closed.
+func (c *client) lookupContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	select {
+	case <-c.closed:
+		return nil, nil, ErrResolverClosed
+	default:
 	}
-	params.Entries = entries
 	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel, nil
+}
+
+// List browses for the services of a given type until ctx expires and returns
+// the entries found, sorted by instance name. Each instance is listed once,
+// with the most recent information received.
+func (r *Resolver) List(ctx context.Context, service, domain string) ([]*ServiceEntry, error) {
+	entries := make(chan *ServiceEntry)
+	if err := r.Browse(ctx, service, domain, entries); err != nil {
+		return nil, err
+	}
+	found := make(map[string]*ServiceEntry)
+	for e := range entries {
+		if e.TTL == 0 {
+			delete(found, e.ServiceInstanceName())
+			continue
+		}
+		found[e.ServiceInstanceName()] = e
+	}
+	list := make([]*ServiceEntry, 0, len(found))
+	for _, e := range found {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Instance < list[j].Instance
+	})
+	if ctx.Err() == nil {
+		return list, errReceiveFailed
+	}
+	return list, nil
+}
+
+// metaQueryService is the service type enumerating all service types, see
+// RFC6763 section 9.
+const metaQueryService = "_services._dns-sd._udp"
+
+// BrowseTypes enumerates the service types in a given domain, such as
+// "_http._tcp.local". Each type is sent once to types, which is closed when
+// ctx expires.
+func (r *Resolver) BrowseTypes(ctx context.Context, domain string, types chan<- string) error {
+	entries := make(chan *ServiceEntry)
+	if err := r.Browse(ctx, metaQueryService, domain, entries); err != nil {
+		return err
+	}
+	go func() {
+		defer close(types)
+		for e := range entries {
+			if e.TTL == 0 {
+				// Removed service type
+				continue
+			}
+			select {
+			case types <- e.Instance:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return nil
+}
+
+// BrowseMany browses for the services of several types in a given domain at
+// once. The entries of all types are sent to the same channel and can be told
+// apart by their Service. Like in Browse, the channel is closed once ctx
+// expires.
+func (r *Resolver) BrowseMany(ctx context.Context, services []string, domain string, entries chan<- *ServiceEntry) error {
+	if len(services) == 0 {
+		return errors.New("no service types given")
+	}
+	if domain == "" {
+		domain = "local"
+	}
+	params := newLookupParams("", services[0], domain, true, entries)
+	for _, service := range services[1:] {
+		params.others = append(params.others, NewServiceRecord("", service, domain))
+	}
+	ctx, cancel, err := r.c.lookupContext(ctx)
+	if err != nil {
+		return err
+	}
+	if r.c.isUnicast(domain) {
+		go r.c.unicastLoop(ctx, params)
+		return nil
+	}
 	go r.c.mainloop(ctx, params)
-	err := r.c.query(params)
+
+	err = r.c.query(params)
 	if err != nil {
-		// cancel mainloop
 		cancel()
 		return err
 	}
-	// If previous probe was ok, it should be fine now. In case of an error later on,
-	// the entries' queue is closed.
 	go func() {
 		if err := r.c.periodicQuery(ctx, params); err != nil {
+			if ctx.Err() == nil {
+				r.c.reportError(err)
+			}
 			cancel()
 		}
 	}()
@@ -133,173 +662,1114 @@ func (r *Resolver) Lookup(ctx context.Context, instance, service, domain string,
 	return nil
 }
 
-// defaultParams returns a default set of QueryParams.
-func defaultParams(service string) *lookupParams {
-	return newLookupParams("", service, "local", false, make(chan *ServiceEntry))
-}
-
-// Client structure encapsulates both IPv4/IPv6 UDP connections.
-type client struct {
-	ipv4conn *ipv4.PacketConn
-	ipv6conn *ipv6.PacketConn
-	ifaces   []net.Interface
-}
-
-// Client structure constructor
-func newClient(opts clientOpts) (*client, error) {
-	ifaces := opts.ifaces
-	if len(ifaces) == 0 {
-		ifaces = listMulticastInterfaces()
+// BrowseDomains browses for the services of a type in several domains at
+// once, e.g. in "local." and in the domain of a split-horizon setup. The
+// entries of all domains are sent to the same channel, see
+// WithCrossDomainDeduplication to deliver an instance found in several
+// domains only once. The domains must be browsed by mDNS rather than unicast
+// DNS. Like in Browse, the channel is closed once ctx expires.
+func (r *Resolver) BrowseDomains(ctx context.Context, service string, domains []string, entries chan<- *ServiceEntry) error {
+	if len(domains) == 0 {
+		return errors.New("no domains given")
 	}
-	// IPv4 interfaces
-	var ipv4conn *ipv4.PacketConn
-	if (opts.listenOn & IPv4) > 0 {
-		var err error
-		ipv4conn, err = joinUdp4Multicast(ifaces)
-		if err != nil {
-			return nil, err
+	var params *lookupParams
+	for _, domain := range domains {
+		if domain == "" {
+			domain = "local"
 		}
-	}
-	// IPv6 interfaces
-	var ipv6conn *ipv6.PacketConn
-	if (opts.listenOn & IPv6) > 0 {
-		var err error
-		ipv6conn, err = joinUdp6Multicast(ifaces)
-		if err != nil {
-			return nil, err
+		if r.c.isUnicast(domain) {
+			return fmt.Errorf("domain %s is browsed by unicast DNS", domain)
+		}
+		if params == nil {
+			params = newLookupParams("", service, domain, true, entries)
+		} else {
+			params.others = append(params.others, NewServiceRecord("", service, domain))
 		}
 	}
+	ctx, cancel, err := r.c.lookupContext(ctx)
+	if err != nil {
+		return err
+	}
+	go r.c.mainloop(ctx, params)
 
-	return &client{
-		ipv4conn: ipv4conn,
-		ipv6conn: ipv6conn,
-		ifaces:   ifaces,
-	}, nil
+	err = r.c.query(params)
+	if err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		if err := r.c.periodicQuery(ctx, params); err != nil {
+			if ctx.Err() == nil {
+				r.c.reportError(err)
+			}
+			cancel()
+		}
+	}()
+
+	return nil
 }
 
-// Start listeners and waits for the shutdown signal from exit channel
-func (c *client) mainloop(ctx context.Context, params *lookupParams) {
-	// start listening for responses
-	msgCh := make(chan *dns.Msg, 32)
-	if c.ipv4conn != nil {
-		go c.recv(ctx, c.ipv4conn, msgCh)
+// Lookup a specific service by its name and type in a given domain. Like in
+// Browse, the entries channel is closed once ctx expires.
+func (r *Resolver) Lookup(ctx context.Context, instance, service, domain string, entries chan<- *ServiceEntry) error {
+	ctx, cancel, err := r.c.lookupContext(ctx)
+	if err != nil {
+		return err
 	}
-	if c.ipv6conn != nil {
-		go c.recv(ctx, c.ipv6conn, msgCh)
+	if r.c.isUnicast(domain) {
+		go r.c.unicastLoop(ctx, newLookupParams(instance, service, domain, false, entries))
+		return nil
 	}
-
-	// Iterate through channels from listeners goroutines
-	var entries, sentEntries map[string]*ServiceEntry
-	sentEntries = make(map[string]*ServiceEntry)
-	for {
+	params := defaultParams(service)
+	params.Instance = instance
+	if domain != "" {
+		params.Domain = domain
+	}
+	params.Entries = entries
+	go r.c.mainloop(ctx, params)
+	err = r.c.query(params)
+	if err != nil {
+		// cancel mainloop
+		cancel()
+		return err
+	}
+	// If previous probe was ok, it should be fine now. In case of an error later on,
+	// the entries' queue is closed.
+	go func() {
+		if err := r.c.periodicQuery(ctx, params); err != nil {
+			if ctx.Err() == nil {
+				r.c.reportError(err)
+			}
+			cancel()
+		}
+	}()
+
+	return nil
+}
+
+// Watch looks up a specific service instance like Lookup, and keeps sending
+// an updated entry each time its host, port or addresses change, e.g. when
+// DHCP assigned the host a new address. Changes are noticed from the
+// announcements of the responder and from queries repeated at the query
+// interval, see WithQueryInterval. The entries channel is closed once ctx
+// expires.
+func (r *Resolver) Watch(ctx context.Context, instance, service, domain string, entries chan<- *ServiceEntry) error {
+	if domain == "" {
+		domain = "local"
+	}
+	params := newLookupParams(instance, service, domain, true, entries)
+	params.watch = true
+	ctx, cancel, err := r.c.lookupContext(ctx)
+	if err != nil {
+		return err
+	}
+	if r.c.isUnicast(domain) {
+		go r.c.unicastLoop(ctx, params)
+		return nil
+	}
+	go r.c.mainloop(ctx, params)
+	if err := r.c.query(params); err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		if err := r.c.periodicQuery(ctx, params); err != nil {
+			if ctx.Err() == nil {
+				r.c.reportError(err)
+			}
+			cancel()
+		}
+	}()
+	return nil
+}
+
+// LookupTXT queries the TXT record of a specific service instance and returns
+// its strings as soon as an answer arrives, without resolving the host of the
+// instance. Like in LookupOnce, the query is repeated a few times until ctx
+// expires.
+func (r *Resolver) LookupTXT(ctx context.Context, instance, service, domain string) ([]string, error) {
+	if domain == "" {
+		domain = "local"
+	}
+	name := NewServiceRecord(instance, service, domain).ServiceInstanceName()
+	rrs, err := r.c.lookupRecords(ctx, dns.Question{Name: name, Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	return rrs[0].(*dns.TXT).Txt, nil
+}
+
+// LookupAddr performs a reverse lookup of the given address, i.e. it queries
+// the PTR records of its in-addr.arpa. or ip6.arpa. name by multicast, and
+// returns the host names of the first response. Like in LookupOnce, the query
+// is repeated a few times until ctx expires.
+func (r *Resolver) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	rrs, err := r.c.lookupRecords(ctx, dns.Question{Name: name, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		hosts = append(hosts, rr.(*dns.PTR).Ptr)
+	}
+	return hosts, nil
+}
+
+// Number of queries repeated by LookupOnce and the interval between them.
+const (
+	lookupOnceRetries       = 2
+	lookupOnceRetryInterval = time.Second
+)
+
+// lookupOnceRetries returns how often LookupOnce repeats its query and the
+// interval between the queries, see WithRetries and WithRetryInterval.
+func (c *client) lookupOnceRetries() (int, time.Duration) {
+	retries, interval := lookupOnceRetries, lookupOnceRetryInterval
+	if c.opts.retries >= 0 {
+		retries = c.opts.retries
+	}
+	if c.opts.retryInterval > 0 {
+		interval = c.opts.retryInterval
+	}
+	return retries, interval
+}
+
+// LookupOnce looks up a specific service instance and returns the first entry
+// resolved completely, i.e. with host name, port and at least one address. The
+// query is repeated a few times until ctx expires, in which case the context's
+// error is returned.
+func (r *Resolver) LookupOnce(ctx context.Context, instance, service, domain string) (*ServiceEntry, error) {
+	params := defaultParams(service)
+	params.Instance = instance
+	if domain != "" {
+		params.Domain = domain
+	}
+	entries := make(chan *ServiceEntry)
+	params.Entries = entries
+	params.needAddrs = true
+	ctx, cancel, err := r.c.lookupContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		cancel()
+		// Unblock the mainloop until it closes the channel.
+		for range entries {
+		}
+	}()
+	unicast := r.c.isUnicast(domain)
+	if unicast {
+		// The unicast loop repeats the queries itself.
+		params = newLookupParams(instance, service, domain, false, entries)
+		params.needAddrs = true
+		go r.c.unicastLoop(ctx, params)
+	} else {
+		go r.c.mainloop(ctx, params)
+		if err := r.c.query(params); err != nil {
+			return nil, err
+		}
+	}
+
+	maxRetries, interval := r.c.lookupOnceRetries()
+	retry := time.NewTicker(interval)
+	defer retry.Stop()
+	for retries := 0; ; {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				return nil, errReceiveFailed
+			}
+			if e.TTL > 0 {
+				return e, nil
+			}
+		case <-retry.C:
+			if retries < maxRetries && !unicast {
+				retries++
+				if err := r.c.requery(params); err != nil {
+					return nil, err
+				}
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// defaultParams returns a default set of QueryParams.
+func defaultParams(service string) *lookupParams {
+	return newLookupParams("", service, "local", false, make(chan *ServiceEntry))
+}
+
+// Client structure encapsulates both IPv4/IPv6 UDP connections.
+type client struct {
+	stats stats // first for the alignment of its 64-bit counters
+
+	ipv4conn ipv4Conn
+	ipv6conn ipv6Conn
+	ifaces   []net.Interface
+	opts     clientOpts
+	ownAddrs []net.IP // addresses of this host, see WithExcludeSelf
+	cache    recordCache
+
+	closed    chan struct{} // closed by Resolver.Close
+	closeOnce sync.Once
+}
+
+// Client structure constructor
+func newClient(opts clientOpts) (*client, error) {
+	ifaces := opts.ifaces
+	if len(opts.ifaceNames) > 0 {
+		ifaces = append(ifaces, interfacesByName(opts.ifaceNames, opts.logger)...)
+	}
+	if len(opts.ifaces) > 0 || len(opts.ifaceNames) > 0 {
+		ifaces = filterMulticastInterfaces(ifaces, opts.logger)
+		if len(ifaces) == 0 {
+			return nil, fmt.Errorf("%w: none of the selected interfaces supports multicast", ErrNoInterfaces)
+		}
+	} else {
+		ifaces = listMulticastInterfaces()
+	}
+	var ipv4conn ipv4Conn
+	var ipv6conn ipv6Conn
+	if opts.conn4 != nil || opts.conn6 != nil {
+		if opts.conn4 != nil {
+			ipv4conn = userConn4{opts.conn4}
+		}
+		if opts.conn6 != nil {
+			ipv6conn = userConn6{opts.conn6}
+		}
+	} else {
+		// Interfaces failing to join the group of either IP version are
+		// left out.
+		var joined []net.Interface
+		// IPv4 interfaces
+		var err4 error
+		if (opts.listenOn & IPv4) > 0 {
+			var c *ipv4.PacketConn
+			var joined4 []net.Interface
+			if c, joined4, err4 = joinUdp4Multicast(ifaces, opts.groups, opts.hopLimit, !opts.exclusive, opts.logger); err4 != nil {
+				opts.logger.Printf("[zeroconf] no suitable IPv4 interface: %s", err4.Error())
+			} else {
+				if opts.requireTTL {
+					if err := c.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+						opts.logger.Printf("[zeroconf] failed to receive the IPv4 TTL: %s", err.Error())
+					}
+				}
+				ipv4conn = c
+				joined = joined4
+			}
+		}
+		// IPv6 interfaces
+		var err6 error
+		if (opts.listenOn & IPv6) > 0 {
+			var c *ipv6.PacketConn
+			var joined6 []net.Interface
+			if c, joined6, err6 = joinUdp6Multicast(ifaces, opts.groups, opts.hopLimit, !opts.exclusive, opts.logger); err6 != nil {
+				opts.logger.Printf("[zeroconf] no suitable IPv6 interface: %s", err6.Error())
+			} else {
+				if opts.requireTTL {
+					if err := c.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+						opts.logger.Printf("[zeroconf] failed to receive the IPv6 hop limit: %s", err.Error())
+					}
+				}
+				ipv6conn = c
+				joined = mergeInterfaces(joined, joined6)
+			}
+		}
+		// Degrade to the IP version that works, e.g. if IPv6 is disabled.
+		switch {
+		case ipv4conn == nil && ipv6conn == nil:
+			if err4 != nil {
+				return nil, err4
+			}
+			if err6 != nil {
+				return nil, err6
+			}
+			return nil, fmt.Errorf("no IP version selected")
+		case err4 != nil:
+			opts.logger.Printf("[zeroconf] IPv4 unavailable, using IPv6 only")
+		case err6 != nil:
+			opts.logger.Printf("[zeroconf] IPv6 unavailable, using IPv4 only")
+		}
+		ifaces = joined
+	}
+
+	c := &client{
+		ipv4conn: ipv4conn,
+		ipv6conn: ipv6conn,
+		ifaces:   ifaces,
+		opts:     opts,
+		closed:   make(chan struct{}),
+	}
+	if opts.excludeSelf {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			c.shutdown()
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				c.ownAddrs = append(c.ownAddrs, ipnet.IP)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Start listeners and waits for the shutdown signal from exit channel
+func (c *client) mainloop(ctx context.Context, params *lookupParams) {
+	// start listening for responses
+	msgCh := make(chan receivedMsg, 32)
+	var receivers int
+	if c.ipv4conn != nil {
+		go c.recv(ctx, c.ipv4conn, msgCh)
+		receivers++
+	}
+	if c.ipv6conn != nil {
+		go c.recv(ctx, c.ipv6conn, msgCh)
+		receivers++
+	}
+	c.processMessages(ctx, params, msgCh, receivers)
+}
+
+// processMessages assembles the entries from the received messages and
+// delivers them to the subscriber until ctx expires, or until all of the
+// given number of receivers failed.
+func (c *client) processMessages(ctx context.Context, params *lookupParams, msgCh <-chan receivedMsg, receivers int) {
+	var failedReceivers int
+
+	// Entries delivered to the subscriber are remembered until their records
+	// expire, so they are neither sent twice nor kept forever. The records
+	// are queried for again before they expire.
+	sentEntries := make(map[string]*ServiceEntry)
+	expiryTicker := time.NewTicker(time.Second)
+	defer expiryTicker.Stop()
+	records := make(entryRecords)
+	refreshTimer := time.NewTimer(0)
+	defer refreshTimer.Stop()
+	// A subscriber no longer reading must not block the shutdown. It gets a
+	// snapshot of each entry, as the entries are updated further.
+	sendEntry := func(e *ServiceEntry) {
+		if e = c.applyEntryHooks(e.clone()); e == nil {
+			return
+		}
+		select {
+		case params.Entries <- e:
+		case <-ctx.Done():
+		}
+	}
+	stopForwarding := func() {}
+	if c.opts.entryBuffer > 0 {
+		q := &entryQueue{size: c.opts.entryBuffer, policy: c.opts.dropPolicy, ready: make(chan struct{}, 1)}
+		forwarded := make(chan struct{})
+		go q.forward(ctx, params.Entries, forwarded)
+		sendEntry = func(e *ServiceEntry) {
+			if e = c.applyEntryHooks(e.clone()); e == nil {
+				return
+			}
+			if !q.push(e) {
+				atomic.AddUint64(&c.stats.droppedEntries, 1)
+			}
+		}
+		stopForwarding = func() {
+			q.close()
+			<-forwarded
+		}
+	}
+	// fromCache is set if the entry is sent because its records expired
+	// rather than because of a received packet.
+	removeEntry := func(k string, fromCache bool) {
+		e, ok := sentEntries[k]
+		if !ok {
+			return
+		}
+		delete(sentEntries, k)
+		delete(records, k)
+		params.known.remove(ptrTarget(e))
+		// Look for services more frequently again, e.g. in case the
+		// service just moved to a different host.
+		params.resetQueryInterval()
+		if c.opts.reportRemovals {
+			removed := *e
+			removed.TTL = 0
+			removed.FromCache = fromCache
+			removed.Changed = 0
+			sendEntry(&removed)
+		}
+	}
+
+	// Address records are cached by host name, as they might arrive
+	// before the SRV record referring to the host.
+	addrs := make(addrCache)
+
+	// Records of an entry may be spread across several packets. Partially
+	// assembled entries wait for the missing ones until the grace period
+	// passes.
+	pending := make(map[string]*ServiceEntry)
+	pendingSince := make(map[string]time.Time)
+	graceTimer := time.NewTimer(c.opts.addrGracePeriod)
+	defer graceTimer.Stop()
+	// fromCache is set if the entry is sent because its grace period passed
+	// rather than because of a received packet.
+	deliverEntry := func(k string, e *ServiceEntry, fromCache bool) {
+		e.FromCache = fromCache
+		e.Changed = 0
+		if prev, ok := sentEntries[k]; ok {
+			e.Changed = entryChanges(prev, e)
+		}
+		delete(pending, k)
+		delete(pendingSince, k)
+		if a, ok := addrs[e.HostName]; ok {
+			e.TTL = minTTL(e.TTL, a.ttl(time.Now()))
+		}
+		e.AddrIPv6Zone = ipv6Zones(e.AddrIPv6, e.IfIndex)
+		e.Addrs = netipAddrs(e.AddrIPv4, e.AddrIPv6, e.AddrIPv6Zone)
+		// Submit entry to subscriber and cache it.
+		// This is also a point to possibly stop probing actively for a
+		// service entry.
+		sendEntry(e)
+		sentEntries[k] = e
+		if !params.isBrowsing {
+			params.disableProbing()
+		}
+	}
+
+	// Iterate through channels from listeners goroutines
+	for {
 		select {
 		case <-ctx.Done():
 			// Context expired. Notify subscriber that we are done here.
+			stopForwarding()
 			params.done()
 			c.shutdown()
 			return
-		case msg := <-msgCh:
-			entries = make(map[string]*ServiceEntry)
-			sections := append(msg.Answer, msg.Ns...)
-			sections = append(sections, msg.Extra...)
+		case now := <-expiryTicker.C:
+			addrs.expire(now)
+			c.cache.expire(now)
+		case now := <-refreshTimer.C:
+			var questions []dns.Question
+			for k := range sentEntries {
+				due, expired := records.refresh(k, now)
+				if expired {
+					removeEntry(k, true)
+					continue
+				}
+				questions = appendQuestions(questions, due...)
+			}
+			if err := c.sendRefresh(questions); err != nil {
+				c.reportError(err)
+			}
+		case <-graceTimer.C:
+		case msg := <-msgCh:
+			if msg.err != nil {
+				c.reportError(msg.err)
+				if !msg.fatal {
+					continue
+				}
+				failedReceivers++
+				if failedReceivers == receivers {
+					// Nothing will be received anymore.
+					stopForwarding()
+					params.done()
+					c.shutdown()
+					return
+				}
+				continue
+			}
+			if !msg.Response {
+				// Queries of other hosts, e.g. probes, don't tell
+				// anything about existing services. Their questions
+				// don't need to be asked again for a while, though.
+				if len(msg.Answer) == 0 && len(msg.Ns) == 0 {
+					recentQuestions.add(msg.Question, time.Now())
+				}
+				continue
+			}
+			sections := append(msg.Answer, msg.Ns...)
+			sections = append(sections, msg.Extra...)
+			c.capTTLs(sections)
+			c.cache.add(sections, msg.src, time.Now())
+			entries := entriesFromRecords(params, sections)
+			if params.isBrowsing {
+				for _, rr := range sections {
+					if ptr, ok := rr.(*dns.PTR); ok && (params.recordByServiceName(ptr.Hdr.Name) != nil || params.recordBySubtypeName(ptr.Hdr.Name) != nil) {
+						params.known.add(ptr, time.Now())
+					}
+				}
+			}
+
+			// Merge the records into the entries assembled so far.
+			now := time.Now()
+			srvs := make(map[string]*ServiceEntry) // SRV records of delivered entries
+			for name, e := range entries {
+				if !c.matchesInstance(e.Instance) {
+					continue
+				}
+				k := name
+				if c.opts.anyDomain {
+					k = e.Instance + "." + e.Service
+				}
+				if c.opts.perIfaceEntries {
+					k = fmt.Sprintf("%s%%%d", k, msg.ifIndex)
+				}
+				if c.opts.anyDomain && !sameDomain(e, pending[k], sentEntries[k]) {
+					// The first domain seen wins.
+					continue
+				}
+				e.IfIndex = msg.ifIndex
+				if e.TTL == 0 {
+					// Goodbye packet, RFC6762 section 10.1
+					delete(pending, k)
+					delete(pendingSince, k)
+					delete(records, k)
+					removeEntry(k, false)
+					continue
+				}
+				if sent, ok := sentEntries[k]; ok {
+					updated := *sent
+					if e.Text != nil {
+						updated.Text = e.Text
+					}
+					updated.Subtypes = mergeSubtypes(sent.Subtypes, e.Subtypes)
+					if entryChanges(sent, &updated) != 0 {
+						deliverEntry(k, &updated, false)
+					}
+					if params.watch && e.HostName != "" {
+						srvs[k] = e
+					}
+					continue
+				}
+				p, ok := pending[k]
+				if !ok {
+					if c.opts.maxEntries > 0 && len(pending)+len(sentEntries) >= c.opts.maxEntries {
+						atomic.AddUint64(&c.stats.droppedEntries, 1)
+						continue
+					}
+					pending[k] = e
+					pendingSince[k] = now
+					continue
+				}
+				if e.HostName != "" {
+					if p.HostName == "" {
+						// The entry might have waited for the SRV
+						// record, give its addresses some time, too.
+						pendingSince[k] = now
+					}
+					p.HostName = e.HostName
+					p.Port = e.Port
+					p.Priority = e.Priority
+					p.Weight = e.Weight
+				}
+				if e.Text != nil {
+					p.Text = e.Text
+				}
+				p.Subtypes = mergeSubtypes(p.Subtypes, e.Subtypes)
+				p.TTL = minTTL(p.TTL, e.TTL)
+			}
+
+			// Associate IPs in a second round as other fields should be filled by now.
+			for _, answer := range sections {
+				switch rr := answer.(type) {
+				case *dns.A:
+					if !addrs.add(rr.Hdr.Name, rr.A, rr.Hdr.Ttl, now, c.opts.maxAddrs) {
+						atomic.AddUint64(&c.stats.droppedAddrs, 1)
+					}
+				case *dns.AAAA:
+					if !addrs.add(rr.Hdr.Name, rr.AAAA, rr.Hdr.Ttl, now, c.opts.maxAddrs) {
+						atomic.AddUint64(&c.stats.droppedAddrs, 1)
+					}
+				}
+			}
+			for _, e := range pending {
+				if a, ok := addrs[e.HostName]; ok {
+					mergeAddrs(e, a, c.opts.maxAddrs)
+				}
+			}
+			// Entries already delivered are updated with addresses
+			// received later, e.g. on another interface.
+			for k, e := range sentEntries {
+				if params.watch {
+					if updated := watchUpdate(e, srvs[k], sections, addrs, c.opts.maxAddrs); updated != nil {
+						deliverEntry(k, updated, false)
+					}
+					continue
+				}
+				a, ok := addrs[e.HostName]
+				if !ok || c.opts.perIfaceEntries {
+					continue
+				}
+				updated := *e
+				updated.AddrIPv4 = append([]net.IP(nil), e.AddrIPv4...)
+				updated.AddrIPv6 = append([]net.IP(nil), e.AddrIPv6...)
+				mergeAddrs(&updated, a, c.opts.maxAddrs)
+				if len(updated.AddrIPv4) != len(e.AddrIPv4) || len(updated.AddrIPv6) != len(e.AddrIPv6) {
+					deliverEntry(k, &updated, false)
+				}
+			}
+
+			// Track the records of the entries, to refresh them
+			// before they expire.
+			for _, assembled := range []map[string]*ServiceEntry{pending, sentEntries} {
+				for k, e := range assembled {
+					if c.opts.perIfaceEntries && e.IfIndex != msg.ifIndex {
+						continue
+					}
+					records.update(k, e, sections, params.isBrowsing, now)
+				}
+			}
+		}
+
+		// Deliver the entries that are complete by now, or whose grace
+		// period is over.
+		now := time.Now()
+		var nextDeadline time.Time
+		for k, e := range pending {
+			// If this is an DNS-SD query do not throw PTR away.
+			// It is expected to have only PTR for enumeration
+			if params.ServiceRecord.ServiceTypeName() == params.ServiceRecord.ServiceName() ||
+				(e.HostName != "" && (len(e.AddrIPv4) > 0 || len(e.AddrIPv6) > 0)) {
+				deliverEntry(k, e, false)
+				continue
+			}
+			deadline := pendingSince[k].Add(c.opts.addrGracePeriod)
+			if !now.Before(deadline) {
+				// Addresses might be announced by a different responder
+				// or not at all. Leave it to the subscriber.
+				if params.needAddrs {
+					continue
+				} else if e.HostName != "" {
+					deliverEntry(k, e, true)
+				} else if e.Text == nil || !now.Before(pendingSince[k].Add(time.Duration(e.TTL)*time.Second)) {
+					// The text of an entry is kept until its SRV
+					// record arrives, or the TXT record expired.
+					delete(pending, k)
+					delete(pendingSince, k)
+					delete(records, k)
+				}
+				continue
+			}
+			if nextDeadline.IsZero() || deadline.Before(nextDeadline) {
+				nextDeadline = deadline
+			}
+		}
+		if !graceTimer.Stop() {
+			select {
+			case <-graceTimer.C:
+			default:
+			}
+		}
+		if !nextDeadline.IsZero() {
+			graceTimer.Reset(nextDeadline.Sub(now))
+		}
+
+		var nextRefresh time.Time
+		for k, e := range sentEntries {
+			if params.isBrowsing {
+				params.known.hold(ptrTarget(e), records.fresh(k))
+			}
+			if due := records.next(k); !due.IsZero() && (nextRefresh.IsZero() || due.Before(nextRefresh)) {
+				nextRefresh = due
+			}
+		}
+		if !refreshTimer.Stop() {
+			select {
+			case <-refreshTimer.C:
+			default:
+			}
+		}
+		if !nextRefresh.IsZero() {
+			refreshTimer.Reset(nextRefresh.Sub(now))
+		}
+	}
+}
+
+// sameDomain reports whether the entries known, if any, are in the domain of e.
+func sameDomain(e *ServiceEntry, known ...*ServiceEntry) bool {
+	for _, k := range known {
+		if k != nil && k.Domain != e.Domain {
+			return false
+		}
+	}
+	return true
+}
+
+// ParsePacket parses a raw mDNS response, e.g. captured from the network, and
+// returns the service instances described by its records, sorted by service
+// instance name. The entries only contain the information found in the
+// packet, so fields like the host name or the addresses might be missing.
+func ParsePacket(packet []byte) ([]*ServiceEntry, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packet); err != nil {
+		return nil, err
+	}
+	if !msg.Response {
+		return nil, errors.New("packet is not a response")
+	}
+	sections := append(msg.Answer, msg.Ns...)
+	sections = append(sections, msg.Extra...)
+
+	// Look for all services the records refer to.
+	var params *lookupParams
+	for _, rr := range sections {
+		var service, domain string
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			_, service, domain = splitServiceInstanceName(rr.Ptr)
+		case *dns.SRV, *dns.TXT:
+			_, service, domain = splitServiceInstanceName(rr.Header().Name)
+		}
+		if service == "" {
+			continue
+		}
+		if params == nil {
+			params = newLookupParams("", service, domain, true, nil)
+		} else if params.recordByServiceName(fmt.Sprintf("%s.%s.", service, domain)) == nil {
+			params.others = append(params.others, NewServiceRecord("", service, domain))
+		}
+	}
+	if params == nil {
+		return nil, nil
+	}
+
+	addrs := make(addrCache)
+	now := time.Now()
+	for _, rr := range sections {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs.add(rr.Hdr.Name, rr.A, rr.Hdr.Ttl, now, 0)
+		case *dns.AAAA:
+			addrs.add(rr.Hdr.Name, rr.AAAA, rr.Hdr.Ttl, now, 0)
+		}
+	}
+	entries := make([]*ServiceEntry, 0)
+	for _, e := range entriesFromRecords(params, sections) {
+		if a, ok := addrs[e.HostName]; ok {
+			mergeAddrs(e, a, 0)
+			e.TTL = minTTL(e.TTL, a.ttl(now))
+		}
+		e.Addrs = netipAddrs(e.AddrIPv4, e.AddrIPv6, nil)
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ServiceInstanceName() < entries[j].ServiceInstanceName()
+	})
+	return entries, nil
+}
+
+// splitServiceInstanceName splits a service instance name like
+// "My\ Printer._ipp._tcp.local." into its instance, service and domain. It
+// returns empty strings if name is no service instance name.
+func splitServiceInstanceName(name string) (instance, service, domain string) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 4 {
+		return "", "", ""
+	}
+	if proto := labels[2]; !strings.HasPrefix(labels[1], "_") || (proto != "_tcp" && proto != "_udp") {
+		return "", "", ""
+	}
+	return labels[0], labels[1] + "." + labels[2], strings.Join(labels[3:], ".")
+}
+
+// entriesFromRecords assembles the entries of the services looked up from the
+// PTR, SRV and TXT records given, keyed by service instance name.
+func entriesFromRecords(params *lookupParams, sections []dns.RR) map[string]*ServiceEntry {
+	entries := make(map[string]*ServiceEntry)
+	// The entry is valid as long as all of its records are.
+	hasTTL := make(map[*ServiceEntry]bool)
+	setTTL := func(e *ServiceEntry, ttl uint32) {
+		if !hasTTL[e] || ttl < e.TTL {
+			e.TTL = ttl
+		}
+		hasTTL[e] = true
+	}
+	for _, answer := range sections {
+		switch rr := answer.(type) {
+		case *dns.PTR:
+			rec := params.recordByServiceName(rr.Hdr.Name)
+			var subtype string
+			if rec == nil {
+				// The instance might be announced under a
+				// subtype of the service, too.
+				if rec = params.recordBySubtypeName(rr.Hdr.Name); rec == nil {
+					continue
+				}
+				subtype = rr.Hdr.Name
+			}
+			if rec.ServiceInstanceName() != "" && rec.ServiceInstanceName() != rr.Ptr {
+				continue
+			}
+			instance := trimDot(strings.Replace(rr.Ptr, rec.ServiceName(), "", -1))
+			if instance == "" {
+				continue
+			}
+			if _, ok := entries[rr.Ptr]; !ok {
+				entries[rr.Ptr] = NewServiceEntry(instance, rec.Service, rec.Domain)
+			}
+			if subtype != "" {
+				entries[rr.Ptr].Subtypes = mergeSubtypes(entries[rr.Ptr].Subtypes, []string{subtype})
+			}
+			setTTL(entries[rr.Ptr], rr.Hdr.Ttl)
+		case *dns.SRV:
+			rec := params.recordByInstanceName(rr.Hdr.Name)
+			if rec == nil {
+				continue
+			}
+			if _, ok := dns.IsDomainName(rr.Target); !ok {
+				// A host can't be looked up by an invalid name.
+				continue
+			}
+			if _, ok := entries[rr.Hdr.Name]; !ok {
+				entries[rr.Hdr.Name] = NewServiceEntry(
+					trimDot(strings.Replace(rr.Hdr.Name, rec.ServiceName(), "", 1)),
+					rec.Service,
+					rec.Domain)
+			}
+			entries[rr.Hdr.Name].HostName = rr.Target
+			entries[rr.Hdr.Name].Port = int(rr.Port)
+			entries[rr.Hdr.Name].Priority = rr.Priority
+			entries[rr.Hdr.Name].Weight = rr.Weight
+			setTTL(entries[rr.Hdr.Name], rr.Hdr.Ttl)
+		case *dns.TXT:
+			rec := params.recordByInstanceName(rr.Hdr.Name)
+			if rec == nil {
+				continue
+			}
+			if _, ok := entries[rr.Hdr.Name]; !ok {
+				entries[rr.Hdr.Name] = NewServiceEntry(
+					trimDot(strings.Replace(rr.Hdr.Name, rec.ServiceName(), "", 1)),
+					rec.Service,
+					rec.Domain)
+			}
+			entries[rr.Hdr.Name].Text = rr.Txt
+			setTTL(entries[rr.Hdr.Name], rr.Hdr.Ttl)
+		}
+	}
+	return entries
+}
+
+// watchUpdate returns the entry updated with the SRV record srv, if not nil,
+// and the addresses of its host in the records received, or nil if nothing
+// changed. The addresses received replace the known ones of their IP version.
+func watchUpdate(e, srv *ServiceEntry, rrs []dns.RR, addrs addrCache, max int) *ServiceEntry {
+	updated := e.clone()
+	if srv != nil {
+		updated.HostName = srv.HostName
+		updated.Port = srv.Port
+		updated.Priority = srv.Priority
+		updated.Weight = srv.Weight
+	}
+	received := &cachedAddrs{}
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if rr.Hdr.Ttl > 0 && strings.EqualFold(rr.Hdr.Name, updated.HostName) {
+				received.v4 = appendAddr(received.v4, rr.A)
+			}
+		case *dns.AAAA:
+			if rr.Hdr.Ttl > 0 && strings.EqualFold(rr.Hdr.Name, updated.HostName) {
+				received.v6 = appendAddr(received.v6, rr.AAAA)
+			}
+		}
+	}
+	if updated.HostName != e.HostName {
+		// The addresses of the old host don't apply anymore.
+		updated.AddrIPv4, updated.AddrIPv6 = nil, nil
+		if a, ok := addrs[updated.HostName]; ok {
+			mergeAddrs(updated, a, max)
+		}
+	}
+	if len(received.v4) > 0 {
+		updated.AddrIPv4 = nil
+	}
+	if len(received.v6) > 0 {
+		updated.AddrIPv6 = nil
+	}
+	mergeAddrs(updated, received, max)
+
+	if updated.HostName == e.HostName && updated.Port == e.Port &&
+		sameAddrs(updated.AddrIPv4, e.AddrIPv4) && sameAddrs(updated.AddrIPv6, e.AddrIPv6) {
+		return nil
+	}
+	return updated
+}
+
+// sameAddrs reports whether a and b contain the same addresses.
+func sameAddrs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ip := range a {
+		if !containsAddr(b, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// minTTL returns the smaller of two TTLs.
+func minTTL(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// cachedAddrs holds the addresses of a host until they expire.
+type cachedAddrs struct {
+	v4, v6 []net.IP
+	expiry time.Time
+}
+
+// ttl returns the seconds left until the addresses expire, at least 1 so that
+// addresses about to expire aren't mistaken for removed ones.
+func (a *cachedAddrs) ttl(now time.Time) uint32 {
+	if left := uint32(a.expiry.Sub(now) / time.Second); left > 0 {
+		return left
+	}
+	return 1
+}
+
+// addrCache holds the addresses received for each host name.
+type addrCache map[string]*cachedAddrs
+
+// add caches ip for the given host. A TTL of 0 removes all addresses of the
+// host. If the host has max addresses already, a new address is dropped and
+// add returns false. max <= 0 means no limit.
+func (c addrCache) add(host string, ip net.IP, ttl uint32, now time.Time, max int) bool {
+	if ttl == 0 {
+		delete(c, host)
+		return true
+	}
+	a, ok := c[host]
+	if !ok {
+		a = &cachedAddrs{}
+		c[host] = a
+	}
+	if max > 0 && len(a.v4)+len(a.v6) >= max && !containsAddr(a.v4, ip) && !containsAddr(a.v6, ip) {
+		return false
+	}
+	if ip.To4() != nil {
+		a.v4 = appendAddr(a.v4, ip)
+	} else {
+		a.v6 = appendAddr(a.v6, ip)
+	}
+	if expiry := now.Add(time.Duration(ttl) * time.Second); expiry.After(a.expiry) {
+		a.expiry = expiry
+	}
+	return true
+}
+
+// expire removes the hosts whose addresses expired.
+func (c addrCache) expire(now time.Time) {
+	for host, a := range c {
+		if now.After(a.expiry) {
+			delete(c, host)
+		}
+	}
+}
+
+// mergeAddrs adds the cached addresses to the entry, up to max addresses in
+// total. max <= 0 means no limit.
+func mergeAddrs(e *ServiceEntry, a *cachedAddrs, max int) {
+	for _, ip := range a.v4 {
+		if max > 0 && len(e.AddrIPv4)+len(e.AddrIPv6) >= max {
+			return
+		}
+		e.AddrIPv4 = appendAddr(e.AddrIPv4, ip)
+	}
+	for _, ip := range a.v6 {
+		if max > 0 && len(e.AddrIPv4)+len(e.AddrIPv6) >= max {
+			return
+		}
+		e.AddrIPv6 = appendAddr(e.AddrIPv6, ip)
+	}
+}
 
-			for _, answer := range sections {
-				switch rr := answer.(type) {
-				case *dns.PTR:
-					if params.ServiceName() != rr.Hdr.Name {
-						continue
-					}
-					if params.ServiceInstanceName() != "" && params.ServiceInstanceName() != rr.Ptr {
-						continue
-					}
-					if _, ok := entries[rr.Ptr]; !ok {
-						entries[rr.Ptr] = NewServiceEntry(
-							trimDot(strings.Replace(rr.Ptr, rr.Hdr.Name, "", -1)),
-							params.Service,
-							params.Domain)
-					}
-					entries[rr.Ptr].TTL = rr.Hdr.Ttl
-				case *dns.SRV:
-					if params.ServiceInstanceName() != "" && params.ServiceInstanceName() != rr.Hdr.Name {
-						continue
-					} else if !strings.HasSuffix(rr.Hdr.Name, params.ServiceName()) {
-						continue
-					}
-					if _, ok := entries[rr.Hdr.Name]; !ok {
-						entries[rr.Hdr.Name] = NewServiceEntry(
-							trimDot(strings.Replace(rr.Hdr.Name, params.ServiceName(), "", 1)),
-							params.Service,
-							params.Domain)
-					}
-					entries[rr.Hdr.Name].HostName = rr.Target
-					entries[rr.Hdr.Name].Port = int(rr.Port)
-					entries[rr.Hdr.Name].TTL = rr.Hdr.Ttl
-				case *dns.TXT:
-					if params.ServiceInstanceName() != "" && params.ServiceInstanceName() != rr.Hdr.Name {
-						continue
-					} else if !strings.HasSuffix(rr.Hdr.Name, params.ServiceName()) {
-						continue
-					}
-					if _, ok := entries[rr.Hdr.Name]; !ok {
-						entries[rr.Hdr.Name] = NewServiceEntry(
-							trimDot(strings.Replace(rr.Hdr.Name, params.ServiceName(), "", 1)),
-							params.Service,
-							params.Domain)
-					}
-					entries[rr.Hdr.Name].Text = rr.Txt
-					entries[rr.Hdr.Name].TTL = rr.Hdr.Ttl
-				}
-			}
-			// Associate IPs in a second round as other fields should be filled by now.
-			for _, answer := range sections {
-				switch rr := answer.(type) {
-				case *dns.A:
-					for k, e := range entries {
-						if e.HostName == rr.Hdr.Name {
-							entries[k].AddrIPv4 = append(entries[k].AddrIPv4, rr.A)
-						}
-					}
-				case *dns.AAAA:
-					for k, e := range entries {
-						if e.HostName == rr.Hdr.Name {
-							entries[k].AddrIPv6 = append(entries[k].AddrIPv6, rr.AAAA)
-						}
-					}
-				}
+// ipv6Zones returns the zone of each address, which is the name of the
+// receiving interface for link-local addresses and empty otherwise.
+func ipv6Zones(addrs []net.IP, ifIndex int) []string {
+	if len(addrs) == 0 {
+		return nil
+	}
+	var ifaceName string
+	if ifIndex != 0 {
+		if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+			ifaceName = iface.Name
+		}
+	}
+	zones := make([]string, len(addrs))
+	for i, ip := range addrs {
+		if ip.IsLinkLocalUnicast() {
+			zones[i] = ifaceName
+		}
+	}
+	return zones
+}
+
+// mergeSubtypes returns a copy of subtypes with the given ones added that it
+// does not contain yet.
+func mergeSubtypes(subtypes []string, add []string) []string {
+	merged := append([]string(nil), subtypes...)
+outer:
+	for _, a := range add {
+		for _, s := range merged {
+			if strings.EqualFold(s, a) {
+				continue outer
 			}
 		}
+		merged = append(merged, a)
+	}
+	return merged
+}
 
-		if len(entries) > 0 {
-			for k, e := range entries {
-				if e.TTL == 0 {
-					delete(entries, k)
-					delete(sentEntries, k)
-					continue
-				}
-				if _, ok := sentEntries[k]; ok {
-					continue
-				}
+// netipAddrs converts the IPv4 and IPv6 addresses of an entry to netip.Addr,
+// attaching the given zones to the IPv6 addresses.
+func netipAddrs(v4, v6 []net.IP, zones []string) []netip.Addr {
+	if len(v4) == 0 && len(v6) == 0 {
+		return nil
+	}
+	addrs := make([]netip.Addr, 0, len(v4)+len(v6))
+	for _, ip := range v4 {
+		if addr, ok := netip.AddrFromSlice(ip.To4()); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	for i, ip := range v6 {
+		addr, ok := netip.AddrFromSlice(ip.To16())
+		if !ok {
+			continue
+		}
+		if i < len(zones) && zones[i] != "" {
+			addr = addr.WithZone(zones[i])
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
 
-				// If this is an DNS-SD query do not throw PTR away.
-				// It is expected to have only PTR for enumeration
-				if params.ServiceRecord.ServiceTypeName() != params.ServiceRecord.ServiceName() {
-					// Require at least one resolved IP address for ServiceEntry
-					// TODO: wait some more time as chances are high both will arrive.
-					if len(e.AddrIPv4) == 0 && len(e.AddrIPv6) == 0 {
-						continue
-					}
-				}
-				// Submit entry to subscriber and cache it.
-				// This is also a point to possibly stop probing actively for a
-				// service entry.
-				params.Entries <- e
-				sentEntries[k] = e
-				if !params.isBrowsing {
-					params.disableProbing()
-				}
-			}
+// containsAddr reports whether addrs contains ip.
+func containsAddr(addrs []net.IP, ip net.IP) bool {
+	for _, a := range addrs {
+		if a.Equal(ip) {
+			return true
 		}
 	}
+	return false
+}
+
+// appendAddr appends ip to addrs unless it is already contained.
+func appendAddr(addrs []net.IP, ip net.IP) []net.IP {
+	if containsAddr(addrs, ip) {
+		return addrs
+	}
+	return append(addrs, ip)
 }
 
 // Shutdown client will close currently open connections and channel implicitly.
@@ -312,28 +1782,153 @@ func (c *client) shutdown() {
 	}
 }
 
-// Data receiving routine reads from connection, unpacks packets into dns.Msg
-// structures and sends them to a given msgCh channel
-func (c *client) recv(ctx context.Context, l interface{}, msgCh chan *dns.Msg) {
-	var readFrom func([]byte) (n int, src net.Addr, err error)
+// receivedMsg is a DNS message along with the index of the interface it was
+// received on, or the error receiving it.
+type receivedMsg struct {
+	*dns.Msg
+	ifIndex int
+	src     net.Addr
+	err     error
+	fatal   bool // the receiver stopped due to err
+}
+
+// capTTLs lowers the TTLs of the records to the cap of WithMaxRecordTTL.
+func (c *client) capTTLs(rrs []dns.RR) {
+	if c.opts.maxRecordTTL <= 0 {
+		return
+	}
+	max := uint32(c.opts.maxRecordTTL / time.Second)
+	if max == 0 {
+		max = 1
+	}
+	for _, rr := range rrs {
+		if h := rr.Header(); h.Ttl > max {
+			h.Ttl = max
+		}
+	}
+}
+
+// matchesInstance reports whether the service instance passes the filter set
+// with WithInstanceFilter or WithInstanceRegexp, if any.
+func (c *client) matchesInstance(instance string) bool {
+	return c.opts.instanceFilter == nil || c.opts.instanceFilter.MatchString(instance)
+}
+
+// applyEntryHooks applies the filter and the mapper of the options to e, which
+// must be a copy owned by the caller. It returns nil if the entry is dropped.
+func (c *client) applyEntryHooks(e *ServiceEntry) *ServiceEntry {
+	if c.opts.entryFilter != nil && !c.opts.entryFilter(e) {
+		return nil
+	}
+	if c.opts.entryMapper != nil {
+		return c.opts.entryMapper(e)
+	}
+	return e
+}
+
+// entryQueue buffers the entries for a subscriber, see WithEntryBuffer.
+type entryQueue struct {
+	size   int
+	policy DropPolicy
+	ready  chan struct{} // signals pushed entries
+
+	mu      sync.Mutex
+	entries []*ServiceEntry
+	closed  bool
+}
+
+// push adds e to the queue. It returns false if an entry was dropped.
+func (q *entryQueue) push(e *ServiceEntry) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dropped := len(q.entries) >= q.size
+	if dropped {
+		if q.policy != DropOldest {
+			return false
+		}
+		q.entries = q.entries[1:]
+	}
+	q.entries = append(q.entries, e)
+	q.signal()
+	return !dropped
+}
+
+// close makes forward return once the queue is drained.
+func (q *entryQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+func (q *entryQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
 
-	switch pConn := l.(type) {
-	case *ipv6.PacketConn:
-		readFrom = func(b []byte) (n int, src net.Addr, err error) {
-			n, _, src, err = pConn.ReadFrom(b)
+// pop removes the first entry. It returns nil if the queue is empty, and
+// whether the queue was closed.
+func (q *entryQueue) pop() (*ServiceEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return nil, q.closed
+	}
+	e := q.entries[0]
+	q.entries[0] = nil
+	q.entries = q.entries[1:]
+	return e, false
+}
+
+// forward sends the queued entries to out until the queue is closed and
+// drained, or until ctx expires. It closes done when returning.
+func (q *entryQueue) forward(ctx context.Context, out chan<- *ServiceEntry, done chan<- struct{}) {
+	defer close(done)
+	for {
+		e, closed := q.pop()
+		if closed {
 			return
 		}
-	case *ipv4.PacketConn:
-		readFrom = func(b []byte) (n int, src net.Addr, err error) {
-			n, _, src, err = pConn.ReadFrom(b)
+		if e == nil {
+			select {
+			case <-q.ready:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		select {
+		case out <- e:
+		case <-ctx.Done():
 			return
 		}
+	}
+}
 
+// reportError passes a receiving or sending error to the error channel, if
+// any, without blocking.
+func (c *client) reportError(err error) {
+	c.opts.logger.Printf("[WARN] zeroconf: %v", err)
+	if c.opts.errors == nil {
+		return
+	}
+	select {
+	case c.opts.errors <- err:
 	default:
+	}
+}
+
+// Data receiving routine reads from connection, unpacks packets into dns.Msg
+// structures and sends them to a given msgCh channel
+func (c *client) recv(ctx context.Context, l interface{}, msgCh chan receivedMsg) {
+	read, release := newPacketReader(l)
+	defer release()
+	if read == nil {
 		return
 	}
 
-	buf := make([]byte, 65536)
 	var fatalErr error
 	for {
 		// Handles the following cases:
@@ -344,56 +1939,120 @@ func (c *client) recv(ctx context.Context, l interface{}, msgCh chan *dns.Msg) {
 			return
 		}
 
-		n, _, err := readFrom(buf)
+		packets, err := read()
 		if err != nil {
 			fatalErr = err
+			if ctx.Err() == nil {
+				// The connection failed, rather than being closed
+				// on shutdown.
+				select {
+				case msgCh <- receivedMsg{err: fmt.Errorf("failed to receive: %w", err), fatal: true}:
+				case <-ctx.Done():
+				}
+			}
 			continue
 		}
-		msg := new(dns.Msg)
-		if err := msg.Unpack(buf[:n]); err != nil {
-			// log.Printf("[WARN] mdns: Failed to unpack packet: %v", err)
-			continue
+		for _, p := range packets {
+			atomic.AddUint64(&c.stats.packetsReceived, 1)
+			if !c.acceptsFrom(p.src) || (c.opts.requireTTL && offLink(p.ttl)) {
+				atomic.AddUint64(&c.stats.droppedPackets, 1)
+				continue
+			}
+			msg := new(dns.Msg)
+			if err := msg.Unpack(p.data); err != nil {
+				atomic.AddUint64(&c.stats.malformedPackets, 1)
+				select {
+				case msgCh <- receivedMsg{err: fmt.Errorf("failed to unpack packet: %w", err)}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			if c.opts.packetHook != nil {
+				c.opts.packetHook(msg, p.src, false)
+			}
+			if c.isOwnAddr(p.src) {
+				continue
+			}
+			select {
+			case msgCh <- receivedMsg{Msg: msg, ifIndex: p.ifIndex, src: p.src}:
+				// Submit decoded DNS message and continue.
+			case <-ctx.Done():
+				// Abort.
+				return
+			}
 		}
-		select {
-		case msgCh <- msg:
-			// Submit decoded DNS message and continue.
-		case <-ctx.Done():
-			// Abort.
-			return
+	}
+}
+
+// acceptsFrom reports whether packets from addr are accepted, see
+// WithAcceptFrom.
+func (c *client) acceptsFrom(addr net.Addr) bool {
+	if len(c.opts.acceptFrom) == 0 {
+		return true
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range c.opts.acceptFrom {
+		if n.Contains(udpAddr.IP) {
+			return true
 		}
 	}
+	return false
 }
 
-// periodicQuery sens multiple probes until a valid response is received by
-// the main processing loop or some timeout/cancel fires.
-// TODO: move error reporting to shutdown function as periodicQuery is called from
-// go routine context.
-func (c *client) periodicQuery(ctx context.Context, params *lookupParams) error {
-	bo := backoff.NewExponentialBackOff()
-	bo.InitialInterval = 4 * time.Second
-	bo.MaxInterval = 60 * time.Second
-	bo.Reset()
+// isOwnAddr reports whether addr is an address of this host, as determined if
+// WithExcludeSelf is set.
+func (c *client) isOwnAddr(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	return containsAddr(c.ownAddrs, udpAddr.IP)
+}
 
-	var timer *time.Timer
-	defer func() {
-		if timer != nil {
-			timer.Stop()
-		}
-	}()
-	for {
-		// Backoff and cancel logic.
-		wait := bo.NextBackOff()
-		if wait == backoff.Stop {
-			return fmt.Errorf("periodicQuery: abort due to timeout")
-		}
-		if timer == nil {
-			timer = time.NewTimer(wait)
-		} else {
-			timer.Reset(wait)
-		}
+// periodicQuery sends queries at increasing intervals until a valid response
+// is received by the main processing loop or some timeout/cancel fires.
+func (c *client) periodicQuery(ctx context.Context, params *lookupParams) error {
+	// From RFC6762
+	//    The Multicast DNS querier should then repeat the query [...]. The
+	//    interval between the first two queries MUST be at least one second,
+	//    the intervals between successive queries MUST increase by at least a
+	//    factor of two. When the interval between queries reaches or exceeds
+	//    60 minutes, a querier MAY cap the interval to a maximum of 60 minutes.
+	bo := c.newQueryBackOff()
+	next := bo.NextBackOff
+	// Lookups may be limited to a number of retries, see WithRetries, and
+	// repeated at a fixed interval, see WithRetryInterval.
+	limited := !params.isBrowsing && c.opts.retries >= 0
+	if limited && c.opts.retries == 0 {
+		return nil
+	}
+	if !params.isBrowsing && c.opts.retryInterval > 0 {
+		next = func() time.Duration { return c.opts.retryInterval }
+	}
+	timer := time.NewTimer(next())
+	defer timer.Stop()
+	for retries := 0; ; {
 		select {
 		case <-timer.C:
-			// Wait for next iteration.
+			// Do periodic query.
+			if err := c.requery(params); err != nil {
+				return err
+			}
+			if retries++; limited && retries == c.opts.retries {
+				return nil
+			}
+		case <-params.resetQuery:
+			bo.Reset()
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
 		case <-params.stopProbing:
 			// Chan is closed (or happened in the past).
 			// Done here. Received a matching mDNS entry.
@@ -401,40 +2060,331 @@ func (c *client) periodicQuery(ctx context.Context, params *lookupParams) error
 		case <-ctx.Done():
 			return ctx.Err()
 		}
-		// Do periodic query.
-		if err := c.query(params); err != nil {
-			return err
-		}
+		timer.Reset(next())
 	}
 }
 
-// Performs the actual query by service name (browse) or service instance name (lookup),
-// start response listeners goroutines and loops over the entries channel.
+// newQueryBackOff returns the schedule of the intervals between queries.
+func (c *client) newQueryBackOff() *backoff.ExponentialBackOff {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = c.opts.queryInterval
+	bo.MaxInterval = c.opts.maxInterval
+	bo.Multiplier = 2
+	bo.RandomizationFactor = 0
+	bo.MaxElapsedTime = 0 // never stop
+	bo.Reset()
+	return bo
+}
+
+// query sends the initial query of a lookup. Its questions are suppressed if
+// they were asked recently, see WithDuplicateQuestionSuppression.
 func (c *client) query(params *lookupParams) error {
-	var serviceName, serviceInstanceName string
-	serviceName = fmt.Sprintf("%s.%s.", trimDot(params.Service), trimDot(params.Domain))
+	return c.sendQuestions(params, c.opts.suppressWindow)
+}
+
+// requery repeats the query of a lookup. The lookup's own earlier queries
+// must not suppress its retransmissions.
+func (c *client) requery(params *lookupParams) error {
+	return c.sendQuestions(params, 0)
+}
 
+// Performs the actual query by service name (browse) or service instance name (lookup),
+// start response listeners goroutines and loops over the entries channel.
+// Questions asked within suppressWindow are left out.
+func (c *client) sendQuestions(params *lookupParams, suppressWindow time.Duration) error {
 	// send the query
 	m := new(dns.Msg)
-	if params.Instance != "" { // service instance name lookup
-		serviceInstanceName = fmt.Sprintf("%s.%s", params.Instance, serviceName)
-		m.Question = []dns.Question{
-			{Name: serviceInstanceName, Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
-			{Name: serviceInstanceName, Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+	for _, rec := range params.records() {
+		serviceName := fmt.Sprintf("%s.%s.", trimDot(rec.Service), trimDot(rec.Domain))
+		if rec.Instance != "" { // service instance name lookup
+			serviceInstanceName := fmt.Sprintf("%s.%s", rec.Instance, serviceName)
+			m.Question = append(m.Question,
+				dns.Question{Name: serviceInstanceName, Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+				dns.Question{Name: serviceInstanceName, Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+			)
+		} else if len(rec.Subtypes) > 0 { // service subtype browse
+			m.Question = append(m.Question, dns.Question{Name: rec.Subtypes[0], Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		} else { // service name browse
+			m.Question = append(m.Question, dns.Question{Name: serviceName, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
 		}
-	} else if len(params.Subtypes) > 0 { // service subtype browse
-		m.SetQuestion(params.Subtypes[0], dns.TypePTR)
-	} else { // service name browse
-		m.SetQuestion(serviceName, dns.TypePTR)
 	}
 	m.RecursionDesired = false
-	if err := c.sendQuery(m); err != nil {
-		return err
+	now := time.Now()
+	if suppressWindow > 0 {
+		if m.Question = recentQuestions.unasked(m.Question, suppressWindow, now); len(m.Question) == 0 {
+			atomic.AddUint64(&c.stats.queriesSuppressed, 1)
+			return nil
+		}
+	}
+	// From RFC6762
+	//    When a Multicast DNS querier sends a query to which it already knows
+	//    some answers, it populates the Answer Section of the DNS query
+	//    message with those answers.
+	m.Answer = params.known.list(m.Question, now)
+	for _, msg := range splitQuery(m, c.opts.maxPacketSize) {
+		if err := c.sendQuery(msg); err != nil {
+			return err
+		}
 	}
+	recentQuestions.add(m.Question, now)
 
 	return nil
 }
 
+// splitQuery splits the known answers of query into packets of at most size
+// bytes at record boundaries.
+func splitQuery(query *dns.Msg, size int) []*dns.Msg {
+	// From RFC6762
+	//    In this case, it should issue a Multicast DNS query containing a
+	//    question and as many Known-Answer records as will fit. It MUST then
+	//    set the TC (Truncated) bit in the header before sending the query.
+	//    It MUST immediately follow the packet with another query packet
+	//    containing no questions and as many more Known-Answer records as
+	//    will fit.
+	if query.Len() <= size {
+		return []*dns.Msg{query}
+	}
+	var msgs []*dns.Msg
+	msg := query.Copy()
+	msg.Answer = nil
+	for _, rr := range query.Answer {
+		msg.Answer = append(msg.Answer, rr)
+		if len(msg.Answer) > 1 && msg.Len() > size {
+			msg.Answer = msg.Answer[:len(msg.Answer)-1]
+			msg.Truncated = true
+			msgs = append(msgs, msg)
+			msg = new(dns.Msg)
+			msg.Answer = []dns.RR{rr}
+		}
+	}
+	return append(msgs, msg)
+}
+
+// knownAnswers holds the PTR records received while browsing, which are
+// listed as known answers in further queries.
+type knownAnswers struct {
+	mu      sync.Mutex
+	records map[string]knownAnswer // by lower-case owner name and target
+}
+
+// knownAnswer is a PTR record along with the time it expires, and the time
+// until which the other records of its service instance are fresh.
+type knownAnswer struct {
+	ptr    *dns.PTR
+	expiry time.Time
+	fresh  time.Time
+}
+
+// add records ptr, or removes it if its TTL is 0.
+func (k *knownAnswers) add(ptr *dns.PTR, now time.Time) {
+	key := strings.ToLower(ptr.Hdr.Name + " " + ptr.Ptr)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if ptr.Hdr.Ttl == 0 {
+		delete(k.records, key)
+		return
+	}
+	if k.records == nil {
+		k.records = make(map[string]knownAnswer)
+	}
+	k.records[key] = knownAnswer{
+		ptr:    dns.Copy(ptr).(*dns.PTR),
+		expiry: now.Add(time.Duration(ptr.Hdr.Ttl) * time.Second),
+		fresh:  k.records[key].fresh,
+	}
+}
+
+// hold lets the PTR records pointing at instance be listed until the given
+// time, when the other records of the instance are no longer fresh.
+func (k *knownAnswers) hold(instance string, until time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for key, a := range k.records {
+		if strings.EqualFold(a.ptr.Ptr, instance) {
+			a.fresh = until
+			k.records[key] = a
+		}
+	}
+}
+
+// remove forgets the PTR records pointing at instance.
+func (k *knownAnswers) remove(instance string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for key, a := range k.records {
+		if strings.EqualFold(a.ptr.Ptr, instance) {
+			delete(k.records, key)
+		}
+	}
+}
+
+// list returns the known answers to the PTR questions given. Records past
+// half of their TTL are left out, so that responders refresh them. So are
+// records of instances whose other records are past half of their TTL, or not
+// known at all: a responder suppressing its PTR record leaves out the SRV,
+// TXT and address records, too.
+func (k *knownAnswers) list(questions []dns.Question, now time.Time) []dns.RR {
+	// From RFC6762
+	//    A Multicast DNS responder MUST NOT answer a Multicast DNS query if
+	//    the answer it would give is already included in the Answer Section
+	//    with an RR TTL at least half the correct value.
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var answers []dns.RR
+	for key, a := range k.records {
+		left := a.expiry.Sub(now)
+		if left <= 0 {
+			delete(k.records, key)
+			continue
+		}
+		if left < time.Duration(a.ptr.Hdr.Ttl)*time.Second/2 || !now.Before(a.fresh) {
+			continue
+		}
+		for _, q := range questions {
+			if q.Qtype == dns.TypePTR && strings.EqualFold(q.Name, a.ptr.Hdr.Name) {
+				ptr := dns.Copy(a.ptr).(*dns.PTR)
+				ptr.Hdr.Class = dns.ClassINET
+				ptr.Hdr.Ttl = uint32(left / time.Second)
+				answers = append(answers, ptr)
+				break
+			}
+		}
+	}
+	return answers
+}
+
+// recentQuestions holds the questions recently asked on the network, for
+// duplicate question suppression. It is shared by all resolvers, so that a
+// restarted browse knows about the queries of the previous one.
+var recentQuestions = questionLog{asked: make(map[dns.Question]time.Time)}
+
+// maxQuestionAge is how long questions are remembered at least.
+const maxQuestionAge = time.Hour
+
+// questionLog holds the time each question was last asked.
+type questionLog struct {
+	mu    sync.Mutex
+	asked map[dns.Question]time.Time
+}
+
+// questionKey returns the key of q in a questionLog, ignoring the case of the
+// name. Questions requesting unicast responses are not recorded, as other
+// hosts don't see their answers.
+func questionKey(q dns.Question) (dns.Question, bool) {
+	if isUnicastQuestion(q) {
+		return q, false
+	}
+	q.Name = strings.ToLower(q.Name)
+	return q, true
+}
+
+// add records that the questions were asked at the given time.
+func (l *questionLog) add(questions []dns.Question, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, q := range questions {
+		if k, ok := questionKey(q); ok {
+			l.asked[k] = now
+		}
+	}
+	if len(l.asked) > 1024 {
+		for k, t := range l.asked {
+			if now.Sub(t) > maxQuestionAge {
+				delete(l.asked, k)
+			}
+		}
+	}
+}
+
+// unasked returns the questions not asked within the given window.
+func (l *questionLog) unasked(questions []dns.Question, window time.Duration, now time.Time) []dns.Question {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var unasked []dns.Question
+	for _, q := range questions {
+		if k, ok := questionKey(q); ok {
+			if t, ok := l.asked[k]; ok && now.Sub(t) < window {
+				continue
+			}
+		}
+		unasked = append(unasked, q)
+	}
+	return unasked
+}
+
+// lookupRecords sends a query with the single question q and returns the
+// matching records of the first response answering it. Like in LookupOnce, the
+// query is repeated a few times until ctx expires. The client is shut down
+// afterwards.
+func (c *client) lookupRecords(ctx context.Context, q dns.Question) ([]dns.RR, error) {
+	ctx, cancel, err := c.lookupContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer c.shutdown()
+
+	msgCh := make(chan receivedMsg, 32)
+	var receivers int
+	if c.ipv4conn != nil {
+		go c.recv(ctx, c.ipv4conn, msgCh)
+		receivers++
+	}
+	if c.ipv6conn != nil {
+		go c.recv(ctx, c.ipv6conn, msgCh)
+		receivers++
+	}
+
+	m := new(dns.Msg)
+	m.Question = []dns.Question{q}
+	m.RecursionDesired = false
+	if err := c.sendQuery(m); err != nil {
+		return nil, err
+	}
+
+	maxRetries, interval := c.lookupOnceRetries()
+	retry := time.NewTicker(interval)
+	defer retry.Stop()
+	var failedReceivers int
+	for retries := 0; ; {
+		select {
+		case msg := <-msgCh:
+			if msg.err != nil {
+				c.reportError(msg.err)
+				if msg.fatal {
+					failedReceivers++
+					if failedReceivers == receivers {
+						return nil, errReceiveFailed
+					}
+				}
+				continue
+			}
+			if !msg.Response {
+				continue
+			}
+			var rrs []dns.RR
+			for _, rr := range append(msg.Answer, msg.Extra...) {
+				h := rr.Header()
+				if h.Rrtype == q.Qtype && h.Ttl > 0 && strings.EqualFold(h.Name, q.Name) {
+					rrs = append(rrs, rr)
+				}
+			}
+			if len(rrs) > 0 {
+				return rrs, nil
+			}
+		case <-retry.C:
+			if retries < maxRetries {
+				retries++
+				if err := c.sendQuery(m); err != nil {
+					return nil, err
+				}
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 // Pack the dns.Msg and write to available connections (multicast)
 func (c *client) sendQuery(msg *dns.Msg) error {
 	buf, err := msg.Pack()
@@ -442,17 +2392,25 @@ func (c *client) sendQuery(msg *dns.Msg) error {
 		return err
 	}
 	if c.ipv4conn != nil {
+		if c.opts.packetHook != nil {
+			c.opts.packetHook(msg, c.opts.groups.ipv4Addr(), true)
+		}
 		var wcm ipv4.ControlMessage
-		for ifi := range c.ifaces {
-			wcm.IfIndex = c.ifaces[ifi].Index
-			c.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
+		for _, index := range ifaceIndexes(c.ipv4conn, c.ifaces) {
+			wcm.IfIndex = index
+			_, err = c.ipv4conn.WriteTo(buf, &wcm, c.opts.groups.ipv4Addr())
+			c.stats.written(wcm.IfIndex, err)
 		}
 	}
 	if c.ipv6conn != nil {
+		if c.opts.packetHook != nil {
+			c.opts.packetHook(msg, c.opts.groups.ipv6Addr(), true)
+		}
 		var wcm ipv6.ControlMessage
-		for ifi := range c.ifaces {
-			wcm.IfIndex = c.ifaces[ifi].Index
-			c.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+		for _, index := range ifaceIndexes(c.ipv6conn, c.ifaces) {
+			wcm.IfIndex = index
+			_, err = c.ipv6conn.WriteTo(buf, &wcm, c.opts.groups.ipv6Addr())
+			c.stats.written(wcm.IfIndex, err)
 		}
 	}
 	return nil
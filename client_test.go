@@ -0,0 +1,1109 @@
+package zeroconf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+func TestSelectIfacesByName(t *testing.T) {
+	if _, err := NewResolver(SelectIfacesByName("zeroconf-does-not-exist")); !errors.Is(err, ErrNoInterfaces) {
+		t.Fatalf("Expected create resolver to fail with ErrNoInterfaces, but got %v", err)
+	}
+
+	ifaces := listMulticastInterfaces()
+	if len(ifaces) == 0 {
+		t.Skip("no multicast interface available")
+	}
+	resolver, err := NewResolver(SelectIfacesByName("zeroconf-does-not-exist", ifaces[0].Name))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	defer resolver.c.shutdown()
+	if got := resolver.Interfaces(); len(got) != 1 || got[0].Name != ifaces[0].Name {
+		t.Fatalf("Expected interface %s only, but got %v", ifaces[0].Name, got)
+	}
+}
+
+func TestIPv6Only(t *testing.T) {
+	// Binding the IPv4 mDNS port exclusively makes joining the IPv4 group
+	// fail, as on a host without IPv4.
+	blocker, err := listenMulticast("udp4", &net.UDPAddr{IP: mdnsWildcardIPv4, Port: 5353}, false)
+	if err != nil {
+		t.Skipf("IPv4 mDNS port in use: %v", err)
+	}
+	defer blocker.Close()
+
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Skipf("IPv6 multicast unavailable: %v", err)
+	}
+	defer server.Shutdown()
+	if server.ipv4conn != nil {
+		t.Fatal("Expected the server to degrade to IPv6")
+	}
+
+	var logger recordingLogger
+	resolver, err := NewResolver(WithLogger(&logger))
+	if err != nil {
+		t.Fatalf("Expected create resolver to succeed with IPv6 only, but got %v", err)
+	}
+	if resolver.c.ipv4conn != nil || resolver.c.ipv6conn == nil {
+		t.Fatal("Expected the resolver to degrade to IPv6")
+	}
+	if len(logger) == 0 || logger[len(logger)-1] != "[zeroconf] IPv4 unavailable, using IPv6 only" {
+		t.Fatalf("Expected IPv4 to be logged as unavailable, but got %q", logger)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entry, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected the service to be found over IPv6, but got %v", err)
+	}
+	if entry.Port != mdnsPort {
+		t.Fatalf("Expected port %d, but got %d", mdnsPort, entry.Port)
+	}
+}
+
+func TestSocketErrors(t *testing.T) {
+	err := listenError("udp4", &net.OpError{Op: "listen", Net: "udp4", Err: os.NewSyscallError("bind", syscall.EACCES)})
+	if !errors.Is(err, ErrBindPermission) || !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("Expected a permission error, but got %v", err)
+	}
+	var socketErr *SocketError
+	if !errors.As(err, &socketErr) || socketErr.Network != "udp4" {
+		t.Fatalf("Expected a SocketError for udp4, but got %v", err)
+	}
+
+	err = listenError("udp6", &net.OpError{Op: "listen", Net: "udp6", Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)})
+	if !errors.Is(err, ErrIPv6Unavailable) || errors.Is(err, ErrBindPermission) {
+		t.Fatalf("Expected IPv6 to be unavailable, but got %v", err)
+	}
+
+	err = listenError("udp4", errors.New("other"))
+	if errors.Is(err, ErrNoInterfaces) || errors.Is(err, ErrBindPermission) || errors.Is(err, ErrIPv6Unavailable) {
+		t.Fatalf("Expected an unclassified error, but got %v", err)
+	}
+}
+
+func TestJoinInterfaces(t *testing.T) {
+	ifaces := []net.Interface{{Index: 1, Name: "eth0"}, {Index: 2, Name: "tun0"}}
+	join := func(iface *net.Interface) error {
+		if iface.Name == "tun0" {
+			return syscall.ENODEV
+		}
+		return nil
+	}
+	joined, err := joinInterfaces("udp4", ifaces, join, nopLogger{})
+	if err != nil {
+		t.Fatalf("Expected the failing interface to be skipped, but got %v", err)
+	}
+	if len(joined) != 1 || joined[0].Name != "eth0" {
+		t.Fatalf("Expected eth0 to be joined only, but got %v", joined)
+	}
+
+	_, err = joinInterfaces("udp4", ifaces[1:], join, nopLogger{})
+	var socketErr *SocketError
+	if !errors.Is(err, ErrNoInterfaces) || !errors.As(err, &socketErr) {
+		t.Fatalf("Expected ErrNoInterfaces, but got %v", err)
+	}
+	if len(socketErr.Skipped) != 1 || socketErr.Skipped[0] != "tun0" {
+		t.Fatalf("Expected tun0 to be listed as skipped, but got %v", socketErr.Skipped)
+	}
+}
+
+func TestIPv6Zones(t *testing.T) {
+	ifaces := listMulticastInterfaces()
+	if len(ifaces) == 0 {
+		t.Skip("no multicast interface available")
+	}
+	addrs := []net.IP{net.ParseIP("fe80::1"), net.ParseIP("fd00::1")}
+	zones := ipv6Zones(addrs, ifaces[0].Index)
+	if len(zones) != 2 || zones[0] != ifaces[0].Name || zones[1] != "" {
+		t.Fatalf("Expected zones [%s ''], but got %q", ifaces[0].Name, zones)
+	}
+}
+
+func TestMulticastHopLimitOption(t *testing.T) {
+	if _, err := NewResolver(WithMulticastHopLimit(0)); err == nil {
+		t.Fatal("Expected create resolver to fail with an invalid hop limit")
+	}
+	resolver, err := NewResolver(SelectIPTraffic(IPv4), WithMulticastHopLimit(1))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	defer resolver.c.shutdown()
+	if ttl, err := resolver.c.ipv4conn.(*ipv4.PacketConn).MulticastTTL(); err != nil || ttl != 1 {
+		t.Fatalf("Expected a multicast TTL of 1, but got %d (%v)", ttl, err)
+	}
+}
+
+type recordingLogger []string
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestWithLogger(t *testing.T) {
+	var logger recordingLogger
+	if _, err := NewResolver(WithLogger(&logger), SelectIfacesByName("zeroconf-does-not-exist")); err == nil {
+		t.Fatal("Expected create resolver to fail without usable interfaces")
+	}
+	if len(logger) != 1 || !strings.Contains(logger[0], "zeroconf-does-not-exist") {
+		t.Fatalf("Expected a warning about the unknown interface, but got %q", logger)
+	}
+}
+
+// testResponse returns a response announcing a service instance on a host
+// with the given address.
+func testResponse(instance, host string, ip net.IP) *dns.Msg {
+	entry := NewServiceEntry(instance, mdnsService, mdnsDomain)
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		&dns.PTR{Hdr: dns.RR_Header{Name: entry.ServiceName(), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120}, Ptr: entry.ServiceInstanceName()},
+		&dns.SRV{Hdr: dns.RR_Header{Name: entry.ServiceInstanceName(), Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120}, Port: uint16(mdnsPort), Target: host},
+		&dns.TXT{Hdr: dns.RR_Header{Name: entry.ServiceInstanceName(), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120}, Txt: []string{"txtv=0"}},
+	}
+	msg.Extra = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: ip},
+	}
+	return msg
+}
+
+// runMessages feeds msgs to a client's message processing and returns the
+// entries delivered until it went idle.
+func runMessages(t *testing.T, opts clientOpts, msgs ...receivedMsg) []*ServiceEntry {
+	t.Helper()
+	if opts.logger == nil {
+		opts.logger = nopLogger{}
+	}
+	c := &client{opts: opts}
+	params := defaultParams(mdnsService)
+	entries := make(chan *ServiceEntry, 16)
+	params.Entries = entries
+	params.isBrowsing = true
+	msgCh := make(chan receivedMsg, len(msgs))
+	for _, m := range msgs {
+		msgCh <- m
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c.processMessages(ctx, params, msgCh, 0)
+
+	var result []*ServiceEntry
+	for e := range entries {
+		result = append(result, e)
+	}
+	return result
+}
+
+func TestDeduplicateInterfaces(t *testing.T) {
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	msgs := []receivedMsg{
+		{Msg: testResponse(mdnsName, "host.local.", ip1), ifIndex: 1},
+		{Msg: testResponse(mdnsName, "host.local.", ip1), ifIndex: 2},
+		{Msg: testResponse(mdnsName, "host.local.", ip2), ifIndex: 2},
+	}
+
+	entries := runMessages(t, clientOpts{}, msgs...)
+	if len(entries) != 2 {
+		t.Fatalf("Expected an entry and its address update, but got %d entries", len(entries))
+	}
+	if len(entries[0].AddrIPv4) != 1 || len(entries[1].AddrIPv4) != 2 {
+		t.Fatalf("Expected the update to merge the addresses, but got %v and %v", entries[0].AddrIPv4, entries[1].AddrIPv4)
+	}
+
+	entries = runMessages(t, clientOpts{perIfaceEntries: true}, msgs...)
+	if len(entries) != 2 || entries[0].IfIndex == entries[1].IfIndex {
+		t.Fatalf("Expected an entry per interface, but got %d entries", len(entries))
+	}
+}
+
+func TestDumpCache(t *testing.T) {
+	c := &client{opts: clientOpts{logger: nopLogger{}}}
+	params := defaultParams(mdnsService)
+	params.Entries = make(chan *ServiceEntry, 16)
+	params.isBrowsing = true
+	src := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	goodbye := testResponse(mdnsName+"-2", "other.local.", net.ParseIP("192.0.2.3"))
+	msgs := []receivedMsg{
+		{Msg: testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1")), src: src},
+		{Msg: testResponse(mdnsName+"-2", "other.local.", net.ParseIP("192.0.2.3")), src: src},
+		{Msg: goodbye, src: src},
+	}
+	for _, rr := range goodbye.Answer {
+		rr.Header().Ttl = 0
+	}
+	msgCh := make(chan receivedMsg, len(msgs))
+	for _, m := range msgs {
+		msgCh <- m
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c.processMessages(ctx, params, msgCh, 0)
+
+	dump := (&Resolver{c: c}).DumpCache()
+	lines := strings.Split(strings.TrimSuffix(dump, "\n"), "\n")
+	// The goodbye packet removed all but the address record of the second
+	// instance.
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 cached records, but got:\n%s", dump)
+	}
+	for _, l := range lines {
+		if !strings.HasSuffix(l, "; from 192.0.2.1:5353") {
+			t.Fatalf("Expected the source address in %q", l)
+		}
+	}
+	if !strings.Contains(dump, "host.local.\t120\tIN\tA\t192.0.2.1") {
+		t.Fatalf("Expected the address of host.local. with its remaining TTL, but got:\n%s", dump)
+	}
+}
+
+func TestWithErrors(t *testing.T) {
+	errs := make(chan error, 2)
+	c := &client{opts: clientOpts{logger: nopLogger{}, errors: errs}}
+	params := defaultParams(mdnsService)
+	entries := make(chan *ServiceEntry)
+	params.Entries = entries
+	params.isBrowsing = true
+	msgCh := make(chan receivedMsg, 2)
+	msgCh <- receivedMsg{err: errors.New("malformed")}
+	msgCh <- receivedMsg{err: errors.New("closed"), fatal: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.processMessages(ctx, params, msgCh, 1)
+	if ctx.Err() != nil {
+		t.Fatal("Expected processing to stop once the receiver failed")
+	}
+	if _, ok := <-entries; ok {
+		t.Fatal("Expected entries channel to be closed")
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Expected both errors to be reported, but got %d", len(errs))
+	}
+}
+
+func TestQueryBackOff(t *testing.T) {
+	c := &client{opts: clientOpts{queryInterval: time.Second, maxInterval: 5 * time.Second}}
+	bo := c.newQueryBackOff()
+	for _, expected := range []time.Duration{1, 2, 4, 5, 5} {
+		if got := bo.NextBackOff(); got != expected*time.Second {
+			t.Fatalf("Expected interval %v, but got %v", expected*time.Second, got)
+		}
+	}
+	bo.Reset()
+	if got := bo.NextBackOff(); got != time.Second {
+		t.Fatalf("Expected initial interval after reset, but got %v", got)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	network := new(memNetwork)
+	c, err := newClient(clientOpts{
+		logger:        nopLogger{},
+		groups:        defaultGroups,
+		conn4:         network.conn("198.51.100.1"),
+		retries:       2,
+		retryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.shutdown()
+	params := defaultParams(mdnsService)
+	params.Instance = mdnsName
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.periodicQuery(ctx, params); err != nil {
+		t.Fatalf("Expected the queries to stop after the retries, but got %v", err)
+	}
+	if sent := c.stats.snapshot().PacketsSent; sent != 2 {
+		t.Fatalf("Expected 2 retries to be sent, but got %d", sent)
+	}
+
+	// The retry interval applies without a limit on the retries, too.
+	listener := network.conn("198.51.100.2")
+	c, err = newClient(clientOpts{
+		logger:        nopLogger{},
+		groups:        defaultGroups,
+		conn4:         network.conn("198.51.100.3"),
+		queryInterval: time.Second,
+		maxInterval:   time.Minute,
+		retries:       -1,
+		retryInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.shutdown()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go c.periodicQuery(ctx, params)
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		if _, _, err := listener.ReadFrom(make([]byte, 9000)); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Duration(i)*40*time.Millisecond || elapsed > time.Duration(i)*500*time.Millisecond {
+			t.Fatalf("Expected query %d after about %v, but got it after %v", i, time.Duration(i)*50*time.Millisecond, elapsed)
+		}
+	}
+
+	if _, err := NewResolver(WithRetryInterval(-time.Second)); err == nil {
+		t.Fatal("Expected a negative retry interval to be rejected")
+	}
+}
+
+func TestMaxAddresses(t *testing.T) {
+	msg := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	for i := 2; i <= 10; i++ {
+		msg.Extra = append(msg.Extra, &dns.A{
+			Hdr: dns.RR_Header{Name: "host.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	c := &client{opts: clientOpts{logger: nopLogger{}, maxAddrs: 4}}
+	params := defaultParams(mdnsService)
+	entries := make(chan *ServiceEntry, 16)
+	params.Entries = entries
+	params.isBrowsing = true
+	msgCh := make(chan receivedMsg, 1)
+	msgCh <- receivedMsg{Msg: msg}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c.processMessages(ctx, params, msgCh, 0)
+
+	e := <-entries
+	if len(e.AddrIPv4) != 4 {
+		t.Fatalf("Expected 4 addresses, but got %v", e.AddrIPv4)
+	}
+	if dropped := c.stats.snapshot().DroppedAddresses; dropped != 6 {
+		t.Fatalf("Expected 6 dropped addresses, but got %d", dropped)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	var msgs []receivedMsg
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, receivedMsg{Msg: testResponse(fmt.Sprintf("instance%d", i), "host.local.", net.ParseIP("192.0.2.1"))})
+	}
+	if entries := runMessages(t, clientOpts{maxEntries: 2}, msgs...); len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, but got %d", len(entries))
+	}
+	if entries := runMessages(t, clientOpts{}, msgs...); len(entries) != 5 {
+		t.Fatalf("Expected 5 entries without a limit, but got %d", len(entries))
+	}
+}
+
+func TestNetipAddrs(t *testing.T) {
+	v4 := []net.IP{net.ParseIP("192.0.2.1")}
+	v6 := []net.IP{net.ParseIP("fe80::1"), net.ParseIP("2001:db8::1")}
+	addrs := netipAddrs(v4, v6, []string{"eth0", ""})
+	expected := []string{"192.0.2.1", "fe80::1%eth0", "2001:db8::1"}
+	if len(addrs) != len(expected) {
+		t.Fatalf("Expected %v, but got %v", expected, addrs)
+	}
+	for i, addr := range addrs {
+		if addr.String() != expected[i] {
+			t.Fatalf("Expected %v, but got %v", expected, addrs)
+		}
+	}
+	if !addrs[0].Is4() {
+		t.Fatal("Expected an unmapped IPv4 address")
+	}
+}
+
+func TestTextMap(t *testing.T) {
+	e := NewServiceEntry(mdnsName, mdnsService, mdnsDomain)
+	e.Text = []string{"txtvers=1", "note=", "duplex", "=orphan", "", "Model=a=b", "model=ignored", "DUPLEX=ignored"}
+
+	attrs := e.TextMap()
+	expected := map[string]string{"txtvers": "1", "note": "", "duplex": "", "Model": "a=b"}
+	if len(attrs) != len(expected) {
+		t.Fatalf("Expected attributes %v, but got %v", expected, attrs)
+	}
+	for k, v := range expected {
+		if got, ok := attrs[k]; !ok || got != v {
+			t.Fatalf("Expected %s=%q, but got %v", k, v, attrs)
+		}
+	}
+	if flags := e.TextFlags(); len(flags) != 1 || flags[0] != "duplex" {
+		t.Fatalf("Expected the flag duplex only, but got %v", flags)
+	}
+}
+
+func TestAddrPorts(t *testing.T) {
+	e := NewServiceEntry(mdnsName, mdnsService, mdnsDomain)
+	e.Port = 8080
+	e.AddrIPv4 = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.3")}
+	e.AddrIPv6 = []net.IP{net.ParseIP("fe80::1")}
+	e.AddrIPv6Zone = []string{"eth0"}
+
+	for pref, expected := range map[AddrPreference][]string{
+		PreferIPv4: {"192.0.2.1:8080", "192.0.2.3:8080", "[fe80::1%eth0]:8080"},
+		PreferIPv6: {"[fe80::1%eth0]:8080", "192.0.2.1:8080", "192.0.2.3:8080"},
+	} {
+		addrs := e.AddrPorts(pref)
+		if len(addrs) != len(expected) {
+			t.Fatalf("Expected %v, but got %v", expected, addrs)
+		}
+		for i, addr := range addrs {
+			if addr.String() != expected[i] {
+				t.Fatalf("Expected %v, but got %v", expected, addrs)
+			}
+		}
+	}
+	if addrs := NewServiceEntry(mdnsName, mdnsService, mdnsDomain).AddrPorts(PreferIPv6); addrs != nil {
+		t.Fatalf("Expected no addresses, but got %v", addrs)
+	}
+}
+
+func TestCompressedNames(t *testing.T) {
+	msg := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	msg.Compress = true
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked := new(dns.Msg)
+	if err := unpacked.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	entries := runMessages(t, clientOpts{}, receivedMsg{Msg: unpacked})
+	if len(entries) != 1 || entries[0].HostName != "host.local." {
+		t.Fatalf("Expected an entry on host.local., but got %v", entries)
+	}
+
+	// A name pointing to itself must not be followed forever.
+	loop := []byte{
+		0, 0, 0x84, 0, // ID, flags: response, authoritative
+		0, 0, 0, 1, 0, 0, 0, 0, // one answer
+		0xc0, 12, // name: pointer to itself
+		0, byte(dns.TypePTR), 0, 1, 0, 0, 0, 120, 0, 2, 0xc0, 12,
+	}
+	if err := new(dns.Msg).Unpack(loop); err == nil {
+		t.Fatal("Expected a compression pointer loop to fail")
+	}
+}
+
+func FuzzUnpackResponse(f *testing.F) {
+	msg := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	for _, compress := range []bool{false, true} {
+		msg.Compress = compress
+		buf, err := msg.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(data); err != nil {
+			return
+		}
+		for _, rr := range append(msg.Answer, msg.Extra...) {
+			// Empty rdata unpacks to empty names.
+			if srv, ok := rr.(*dns.SRV); ok && srv.Target != "" && !dns.IsFqdn(srv.Target) {
+				t.Fatalf("Expected a fully qualified SRV target, but got %q", srv.Target)
+			}
+			if ptr, ok := rr.(*dns.PTR); ok && ptr.Ptr != "" && !dns.IsFqdn(ptr.Ptr) {
+				t.Fatalf("Expected a fully qualified PTR name, but got %q", ptr.Ptr)
+			}
+		}
+	})
+}
+
+func TestParsePacket(t *testing.T) {
+	msg := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	msg.Compress = true
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ParsePacket(buf)
+	if err != nil {
+		t.Fatalf("Expected parse success, but got %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected one entry, but got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Instance != mdnsName || e.Service != mdnsService || e.Domain != "local" {
+		t.Fatalf("Unexpected service instance %s", e.ServiceInstanceName())
+	}
+	if e.HostName != "host.local." || e.Port != mdnsPort || len(e.Text) != 1 {
+		t.Fatalf("Unexpected entry %s:%d %v", e.HostName, e.Port, e.Text)
+	}
+	if len(e.AddrIPv4) != 1 || len(e.Addrs) != 1 {
+		t.Fatalf("Expected an address, but got %v", e.AddrIPv4)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(e.ServiceName(), dns.TypePTR)
+	if buf, err = query.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePacket(buf); err == nil {
+		t.Fatal("Expected parsing a query to fail")
+	}
+}
+
+func FuzzParsePacket(f *testing.F) {
+	msg := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	for _, compress := range []bool{false, true} {
+		msg.Compress = compress
+		buf, err := msg.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries, err := ParsePacket(data)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if e.ServiceInstanceName() == "" {
+				t.Fatalf("Expected a service instance name, but got %+v", e.ServiceRecord)
+			}
+		}
+	})
+}
+
+func TestEntryTTL(t *testing.T) {
+	msg := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	msg.Answer[0].Header().Ttl = 4500
+	msg.Answer[1].Header().Ttl = 60
+	msg.Extra[0].Header().Ttl = 30
+	entries := runMessages(t, clientOpts{}, receivedMsg{Msg: msg})
+	if len(entries) != 1 {
+		t.Fatalf("Expected one entry, but got %d", len(entries))
+	}
+	if ttl := entries[0].TTL; ttl == 0 || ttl > 30 {
+		t.Fatalf("Expected the TTL of the address record, but got %d", ttl)
+	}
+
+	// Removing any record of the entry removes the entry.
+	goodbye := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	goodbye.Answer[1].Header().Ttl = 0
+	buf, err := goodbye.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePacket(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 1 || parsed[0].TTL != 0 {
+		t.Fatalf("Expected an entry with a TTL of 0, but got %v", parsed)
+	}
+}
+
+func TestRecordRefresh(t *testing.T) {
+	now := time.Now()
+	e := NewServiceEntry(mdnsName, mdnsService, mdnsDomain)
+	e.HostName = "host.local."
+	msg := testResponse(mdnsName, e.HostName, net.ParseIP("192.0.2.1"))
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		rr.Header().Ttl = 100
+		if rr.Header().Rrtype == dns.TypeSRV {
+			rr.Header().Ttl = 20
+		}
+	}
+	records := make(entryRecords)
+	records.update("k", e, append(msg.Answer, msg.Extra...), true, now)
+
+	// The SRV record is queried at 80%, 85%, 90% and 95% of its TTL, plus
+	// up to 2%.
+	if qs, expired := records.refresh("k", now.Add(15*time.Second)); len(qs) != 0 || expired {
+		t.Fatalf("Expected no refresh before 80%% of the TTL, but got %v", qs)
+	}
+	for _, at := range []time.Duration{16400, 17400, 18400, 19400} {
+		qs, expired := records.refresh("k", now.Add(at*time.Millisecond))
+		if expired || len(qs) != 1 || qs[0].Qtype != dns.TypeSRV || !strings.EqualFold(qs[0].Name, e.ServiceInstanceName()) {
+			t.Fatalf("Expected a query for the SRV record after %v, but got %v", at*time.Millisecond, qs)
+		}
+		if qs, _ := records.refresh("k", now.Add(at*time.Millisecond)); len(qs) != 0 {
+			t.Fatalf("Expected a single query per refresh point, but got %v", qs)
+		}
+	}
+	if _, expired := records.refresh("k", now.Add(20*time.Second)); !expired {
+		t.Fatal("Expected the entry to expire with its SRV record")
+	}
+
+	// A refreshed record starts over.
+	records.update("k", e, append(msg.Answer, msg.Extra...), true, now)
+	records.update("k", e, msg.Answer[1:2], true, now.Add(16*time.Second))
+	if qs, expired := records.refresh("k", now.Add(20*time.Second)); len(qs) != 0 || expired {
+		t.Fatalf("Expected the refreshed SRV record to be kept, but got %v", qs)
+	}
+	if next := records.next("k"); next.Before(now.Add(32 * time.Second)) {
+		t.Fatalf("Expected the next refresh at 80%% of the new TTL, but got %v", next.Sub(now))
+	}
+}
+
+func TestFromCache(t *testing.T) {
+	fresh := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	noAddrs := testResponse("other", "other.local.", net.ParseIP("192.0.2.2"))
+	noAddrs.Extra = nil
+	entries := runMessages(t, clientOpts{addrGracePeriod: 20 * time.Millisecond},
+		receivedMsg{Msg: fresh}, receivedMsg{Msg: noAddrs})
+	if len(entries) != 2 {
+		t.Fatalf("Expected two entries, but got %d", len(entries))
+	}
+	if entries[0].FromCache {
+		t.Fatal("Expected the entry completed by a response not to be from cache")
+	}
+	if !entries[1].FromCache || entries[1].Instance != "other" {
+		t.Fatalf("Expected the entry delivered after the grace period to be from cache, but got %+v", entries[1])
+	}
+}
+
+func TestTextBeforeSRV(t *testing.T) {
+	c := &client{opts: clientOpts{logger: nopLogger{}, addrGracePeriod: 20 * time.Millisecond}}
+	params := defaultParams(mdnsService)
+	entries := make(chan *ServiceEntry, 16)
+	params.Entries = entries
+	params.isBrowsing = true
+	msgCh := make(chan receivedMsg)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go c.processMessages(ctx, params, msgCh, 0)
+
+	// The TXT record arrives long before the SRV record.
+	full := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	txt := new(dns.Msg)
+	txt.Response = true
+	txt.Answer = []dns.RR{full.Answer[2]}
+	msgCh <- receivedMsg{Msg: txt}
+	time.Sleep(100 * time.Millisecond)
+	srv := new(dns.Msg)
+	srv.Response = true
+	srv.Answer = []dns.RR{full.Answer[1]}
+	srv.Extra = full.Extra
+	msgCh <- receivedMsg{Msg: srv}
+
+	var e *ServiceEntry
+	select {
+	case e = <-entries:
+	case <-ctx.Done():
+		t.Fatal("Expected an entry")
+	}
+	if len(e.Text) != 1 || e.Text[0] != "txtv=0" {
+		t.Fatalf("Expected the text received before, but got %v", e.Text)
+	}
+
+	// Updates carry the text received in the meantime.
+	update := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.2"))
+	update.Answer[2].(*dns.TXT).Txt = []string{"txtv=1"}
+	msgCh <- receivedMsg{Msg: update}
+	select {
+	case e = <-entries:
+	case <-ctx.Done():
+		t.Fatal("Expected an address update")
+	}
+	if len(e.Text) != 1 || e.Text[0] != "txtv=1" {
+		t.Fatalf("Expected the updated text, but got %v", e.Text)
+	}
+}
+
+func TestResolverClose(t *testing.T) {
+	network := new(memNetwork)
+	resolver, err := NewResolver(WithConnIPv4(network.conn("198.51.100.1")))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	entries := make(chan *ServiceEntry)
+	if err := resolver.Browse(context.Background(), mdnsService, mdnsDomain, entries); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+	if err := resolver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-entries:
+		if ok {
+			t.Fatal("Expected no entries")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the entries channel to be closed")
+	}
+	if err := resolver.Browse(context.Background(), mdnsService, mdnsDomain, make(chan *ServiceEntry)); !errors.Is(err, ErrResolverClosed) {
+		t.Fatalf("Expected browse to fail with ErrResolverClosed, but got %v", err)
+	}
+	if _, err := resolver.LookupOnce(context.Background(), mdnsName, mdnsService, mdnsDomain); !errors.Is(err, ErrResolverClosed) {
+		t.Fatalf("Expected lookup to fail with ErrResolverClosed, but got %v", err)
+	}
+	if err := resolver.Close(); err != nil {
+		t.Fatalf("Expected closing twice to succeed, but got %v", err)
+	}
+}
+
+func TestSplitQuery(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	for i := 0; i < 500; i++ {
+		query.Answer = append(query.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: "_http._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500},
+			Ptr: fmt.Sprintf("instance%d._http._tcp.local.", i),
+		})
+	}
+	if _, err := NewResolver(WithMaxPacketSize(maxResponseSize + 1)); err == nil {
+		t.Fatal("Expected a too large packet size to be rejected")
+	}
+
+	msgs := splitQuery(query, maxResponseSize)
+	if len(msgs) < 2 {
+		t.Fatalf("Expected the known answers to be split, but got %d packets", len(msgs))
+	}
+	var answers int
+	for i, msg := range msgs {
+		if msg.Len() > maxResponseSize {
+			t.Fatalf("Expected at most %d bytes, but got %d", maxResponseSize, msg.Len())
+		}
+		if msg.Truncated != (i < len(msgs)-1) {
+			t.Fatalf("Expected the TC bit on all but the last packet, but got %t on packet %d", msg.Truncated, i)
+		}
+		if (len(msg.Question) > 0) != (i == 0) {
+			t.Fatalf("Expected the question in the first packet only, but got %v in packet %d", msg.Question, i)
+		}
+		answers += len(msg.Answer)
+	}
+	if answers != len(query.Answer) {
+		t.Fatalf("Expected all %d known answers to be sent, but got %d", len(query.Answer), answers)
+	}
+}
+
+func TestDuplicateQuestionSuppression(t *testing.T) {
+	now := time.Now()
+	l := questionLog{asked: make(map[dns.Question]time.Time)}
+	asked := dns.Question{Name: "_asked._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}
+	unicast := dns.Question{Name: "_unicast._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET | qClassCacheFlush}
+	l.add([]dns.Question{asked, unicast}, now)
+
+	other := dns.Question{Name: "_other._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}
+	upper := asked
+	upper.Name = strings.ToUpper(asked.Name)
+	unasked := l.unasked([]dns.Question{upper, unicast, other}, time.Second, now.Add(500*time.Millisecond))
+	if len(unasked) != 2 || unasked[0] != unicast || unasked[1] != other {
+		t.Fatalf("Expected the question asked to be suppressed, but got %v", unasked)
+	}
+	if unasked := l.unasked([]dns.Question{asked}, time.Second, now.Add(time.Second)); len(unasked) != 1 {
+		t.Fatal("Expected the question to be asked again after the window")
+	}
+
+	// A restarted browse doesn't query again within the window.
+	network := new(memNetwork)
+	for i := 0; i < 2; i++ {
+		c, err := newClient(clientOpts{
+			logger:         nopLogger{},
+			groups:         defaultGroups,
+			conn4:          network.conn("198.51.100.1"),
+			suppressWindow: time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.query(defaultParams("_suppressed._tcp")); err != nil {
+			t.Fatal(err)
+		}
+		c.shutdown()
+		st := c.stats.snapshot()
+		if expected := uint64(i); st.QueriesSuppressed != expected || st.PacketsSent != 1-expected {
+			t.Fatalf("Query %d: expected %d queries suppressed, but got %d with %d packets sent", i, expected, st.QueriesSuppressed, st.PacketsSent)
+		}
+	}
+
+	// A lookup's own query doesn't suppress its retransmissions.
+	c, err := newClient(clientOpts{
+		logger:         nopLogger{},
+		groups:         defaultGroups,
+		conn4:          network.conn("198.51.100.2"),
+		suppressWindow: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.shutdown()
+	params := defaultParams("_retransmitted._tcp")
+	if err := c.query(params); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.requery(params); err != nil {
+		t.Fatal(err)
+	}
+	if st := c.stats.snapshot(); st.QueriesSuppressed != 0 || st.PacketsSent != 2 {
+		t.Fatalf("Expected the retransmission to be sent, but got %d queries suppressed with %d packets sent", st.QueriesSuppressed, st.PacketsSent)
+	}
+}
+
+func TestKnownAnswers(t *testing.T) {
+	params := newLookupParams("", "_known._tcp", "local", true, nil)
+	ptr := func(instance string, ttl uint32) *dns.PTR {
+		return &dns.PTR{
+			Hdr: dns.RR_Header{Name: params.ServiceName(), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: instance + "." + params.ServiceName(),
+		}
+	}
+	now := time.Now()
+	params.known.add(ptr("fresh", 120), now)
+	params.known.add(ptr("stale", 100), now.Add(-60*time.Second))
+	params.known.add(ptr("removed", 120), now)
+	params.known.add(ptr("removed", 0), now)
+	// Instances whose host records aren't fresh or known, or which were
+	// removed, are left out, too.
+	params.known.add(ptr("expiring", 120), now)
+	params.known.add(ptr("unresolved", 120), now)
+	params.known.add(ptr("gone", 120), now)
+	for _, instance := range []string{"fresh", "stale", "gone"} {
+		params.known.hold(ptr(instance, 0).Ptr, now.Add(time.Minute))
+	}
+	params.known.hold(ptr("expiring", 0).Ptr, now)
+	params.known.remove(ptr("gone", 0).Ptr)
+
+	network := new(memNetwork)
+	c, err := newClient(clientOpts{logger: nopLogger{}, groups: defaultGroups, conn4: network.conn("198.51.100.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.shutdown()
+	listener := network.conn("198.51.100.2")
+	if err := c.query(params); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65536)
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	if err := query.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if len(query.Answer) != 1 {
+		t.Fatalf("Expected a single known answer, but got %v", query.Answer)
+	}
+	if known := query.Answer[0].(*dns.PTR); known.Ptr != ptr("fresh", 0).Ptr || known.Hdr.Ttl > 120 || known.Hdr.Ttl < 60 {
+		t.Fatalf("Expected the fresh record with its remaining TTL, but got %v", known)
+	}
+}
+
+func TestEntryHooks(t *testing.T) {
+	camera := testResponse("camera", "camera.local.", net.ParseIP("192.0.2.1"))
+	camera.Answer[2].(*dns.TXT).Txt = []string{"deviceType=camera"}
+	printer := testResponse("printer", "printer.local.", net.ParseIP("192.0.2.2"))
+	opts := clientOpts{
+		entryFilter: func(e *ServiceEntry) bool {
+			return len(e.Text) > 0 && e.Text[0] == "deviceType=camera"
+		},
+		entryMapper: func(e *ServiceEntry) *ServiceEntry {
+			e.Instance = strings.ToUpper(e.Instance)
+			return e
+		},
+	}
+	entries := runMessages(t, opts, receivedMsg{Msg: camera}, receivedMsg{Msg: printer})
+	if len(entries) != 1 || entries[0].Instance != "CAMERA" {
+		t.Fatalf("Expected the mapped camera entry only, but got %v", entries)
+	}
+
+	opts.entryMapper = func(*ServiceEntry) *ServiceEntry { return nil }
+	if entries := runMessages(t, opts, receivedMsg{Msg: camera}); len(entries) != 0 {
+		t.Fatalf("Expected the mapper to drop the entry, but got %v", entries)
+	}
+}
+
+func TestEntriesOwnData(t *testing.T) {
+	msg := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	entries := runMessages(t, clientOpts{}, receivedMsg{Msg: msg})
+	if len(entries) != 1 {
+		t.Fatalf("Expected one entry, but got %v", entries)
+	}
+	// Recycling the records must not change the entry handed out.
+	msg.Answer[2].(*dns.TXT).Txt[0] = "txtv=1"
+	a := msg.Extra[0].(*dns.A).A
+	a[len(a)-1] = 2
+	if e := entries[0]; e.Text[0] != "txtv=0" || !e.AddrIPv4[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected the entry to own its text and addresses, but got %v", e)
+	}
+}
+
+func TestEntryChanges(t *testing.T) {
+	first := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	text := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	text.Answer[2].(*dns.TXT).Txt = []string{"status=busy"}
+	addr := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.3"))
+	addr.Answer[2].(*dns.TXT).Txt = []string{"status=busy"}
+
+	entries := runMessages(t, clientOpts{}, receivedMsg{Msg: first}, receivedMsg{Msg: first}, receivedMsg{Msg: text}, receivedMsg{Msg: addr})
+	if len(entries) != 3 {
+		t.Fatalf("Expected the entry and two updates, but got %v", entries)
+	}
+	if entries[0].Changed != 0 {
+		t.Fatalf("Expected no changes for a new entry, but got %v", entries[0].Changed)
+	}
+	if entries[1].Changed != TextChanged || entries[1].Text[0] != "status=busy" {
+		t.Fatalf("Expected a text change, but got %v", entries[1])
+	}
+	if entries[2].Changed != AddrsChanged || len(entries[2].AddrIPv4) != 2 {
+		t.Fatalf("Expected an address change, but got %v", entries[2])
+	}
+}
+
+func TestInstanceFilter(t *testing.T) {
+	kitchen := testResponse("kitchen-1", "kitchen.local.", net.ParseIP("192.0.2.1"))
+	bedroom := testResponse("Bedroom", "bedroom.local.", net.ParseIP("192.0.2.3"))
+	for _, o := range []ClientOption{WithInstanceFilter("Kitchen-?"), WithInstanceRegexp(regexp.MustCompile(`^kitchen-\d$`))} {
+		var opts clientOpts
+		o(&opts)
+		entries := runMessages(t, opts, receivedMsg{Msg: kitchen}, receivedMsg{Msg: bedroom})
+		if len(entries) != 1 || entries[0].Instance != "kitchen-1" {
+			t.Fatalf("Expected the kitchen entry only, but got %v", entries)
+		}
+	}
+
+	var opts clientOpts
+	WithInstanceFilter("Kitchen.*")(&opts)
+	if entries := runMessages(t, opts, receivedMsg{Msg: kitchen}); len(entries) != 0 {
+		t.Fatalf("Expected regular expression syntax to be matched literally, but got %v", entries)
+	}
+}
+
+func TestCrossDomainDeduplication(t *testing.T) {
+	local := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	other := testResponse(mdnsName, "host.example.com.", net.ParseIP("192.0.2.1"))
+	for _, rr := range other.Answer {
+		h := rr.Header()
+		h.Name = strings.Replace(h.Name, ".local.", ".example.com.", 1)
+		if ptr, ok := rr.(*dns.PTR); ok {
+			ptr.Ptr = strings.Replace(ptr.Ptr, ".local.", ".example.com.", 1)
+		}
+	}
+
+	for _, anyDomain := range []bool{false, true} {
+		c := &client{opts: clientOpts{logger: nopLogger{}, anyDomain: anyDomain}}
+		entries := make(chan *ServiceEntry, 16)
+		params := newLookupParams("", mdnsService, "local", true, entries)
+		params.others = append(params.others, NewServiceRecord("", mdnsService, "example.com"))
+		msgCh := make(chan receivedMsg, 2)
+		msgCh <- receivedMsg{Msg: local}
+		msgCh <- receivedMsg{Msg: other}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		c.processMessages(ctx, params, msgCh, 0)
+		cancel()
+
+		var result []*ServiceEntry
+		for e := range entries {
+			result = append(result, e)
+		}
+		if !anyDomain && len(result) != 2 {
+			t.Fatalf("Expected an entry per domain, but got %v", result)
+		}
+		if anyDomain && (len(result) != 1 || result[0].Domain != params.Domain) {
+			t.Fatalf("Expected a single entry in domain %s, but got %v", params.Domain, result)
+		}
+	}
+}
+
+func TestEntryBuffer(t *testing.T) {
+	for _, policy := range []DropPolicy{DropNewest, DropOldest} {
+		q := &entryQueue{size: 2, policy: policy, ready: make(chan struct{}, 1)}
+		for i, instance := range []string{"a", "b", "c"} {
+			if ok := q.push(NewServiceEntry(instance, mdnsService, mdnsDomain)); ok != (i < 2) {
+				t.Fatalf("Policy %d: unexpected drop result %t for entry %d", policy, ok, i)
+			}
+		}
+		expected := []string{"a", "b"}
+		if policy == DropOldest {
+			expected = []string{"b", "c"}
+		}
+		for _, instance := range expected {
+			if e, _ := q.pop(); e == nil || e.Instance != instance {
+				t.Fatalf("Policy %d: expected entry %s, but got %v", policy, instance, e)
+			}
+		}
+		q.close()
+		if e, closed := q.pop(); e != nil || !closed {
+			t.Fatalf("Policy %d: expected the queue to be closed and drained", policy)
+		}
+	}
+
+	// The messages are processed while nobody reads the entries.
+	c := &client{opts: clientOpts{logger: nopLogger{}, entryBuffer: 2, dropPolicy: DropOldest}}
+	params := defaultParams(mdnsService)
+	params.isBrowsing = true
+	msgCh := make(chan receivedMsg, 5)
+	for i := 0; i < 5; i++ {
+		msgCh <- receivedMsg{Msg: testResponse(fmt.Sprintf("instance%d", i), "host.local.", net.ParseIP("192.0.2.1"))}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c.processMessages(ctx, params, msgCh, 0)
+	// Besides the buffered entries, one might wait for the subscriber.
+	if dropped := c.stats.snapshot().DroppedEntries; dropped < 2 || dropped > 3 {
+		t.Fatalf("Expected 2 or 3 entries to be dropped, but got %d", dropped)
+	}
+}
+
+func TestMaxRecordTTL(t *testing.T) {
+	msg := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1"))
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		rr.Header().Ttl = 3 * 24 * 3600
+	}
+	entries := runMessages(t, clientOpts{maxRecordTTL: time.Minute}, receivedMsg{Msg: msg})
+	if len(entries) != 1 {
+		t.Fatalf("Expected one entry, but got %d", len(entries))
+	}
+	if ttl := entries[0].TTL; ttl == 0 || ttl > 60 {
+		t.Fatalf("Expected a TTL of at most 60 seconds, but got %d", ttl)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	c := &client{opts: clientOpts{logger: nopLogger{}}}
+	entries := make(chan *ServiceEntry, 16)
+	params := newLookupParams(mdnsName, mdnsService, "local", true, entries)
+	params.watch = true
+
+	moved := testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.2"))
+	moved.Answer[1].(*dns.SRV).Port = 9999
+	msgs := []*dns.Msg{
+		testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1")),
+		testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.1")),
+		testResponse(mdnsName, "host.local.", net.ParseIP("192.0.2.2")),
+		moved,
+	}
+	msgCh := make(chan receivedMsg, len(msgs))
+	for _, m := range msgs {
+		msgCh <- receivedMsg{Msg: m}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c.processMessages(ctx, params, msgCh, 0)
+
+	var got []string
+	for e := range entries {
+		got = append(got, fmt.Sprintf("%v:%d", e.AddrIPv4, e.Port))
+	}
+	expected := []string{
+		fmt.Sprintf("[192.0.2.1]:%d", mdnsPort),
+		fmt.Sprintf("[192.0.2.2]:%d", mdnsPort),
+		"[192.0.2.2]:9999",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("Expected the entries %v, but got %v", expected, got)
+	}
+}
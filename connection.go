@@ -1,9 +1,16 @@
 package zeroconf
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/miekg/dns"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
@@ -14,86 +21,456 @@ var (
 	mdnsGroupIPv6 = net.ParseIP("ff02::fb")
 
 	// mDNS wildcard addresses
-	mdnsWildcardAddrIPv4 = &net.UDPAddr{
-		IP:   net.ParseIP("224.0.0.0"),
-		Port: 5353,
+	mdnsWildcardIPv4 = net.ParseIP("224.0.0.0")
+	mdnsWildcardIPv6 = net.ParseIP("ff02::")
+)
+
+// Errors setting up the mDNS sockets, to be tested for with errors.Is.
+var (
+	// ErrNoInterfaces means that none of the interfaces could join the
+	// multicast group.
+	ErrNoInterfaces = errors.New("no usable multicast interface")
+	// ErrBindPermission means that binding the mDNS port was not permitted.
+	ErrBindPermission = errors.New("permission denied binding the mDNS port")
+	// ErrIPv6Unavailable means that the host doesn't support IPv6.
+	ErrIPv6Unavailable = errors.New("IPv6 unavailable")
+)
+
+// SocketError describes why the socket of an IP version could not be set up.
+// It matches ErrNoInterfaces, ErrBindPermission or ErrIPv6Unavailable with
+// errors.Is, as well as the underlying error.
+type SocketError struct {
+	Network string   // "udp4" or "udp6"
+	Skipped []string // names of the interfaces which failed to join the group
+	Err     error
+	kind    error
+}
+
+func (e *SocketError) Error() string {
+	if e.kind == nil {
+		return fmt.Sprintf("%s: %s", e.Network, e.Err)
 	}
-	mdnsWildcardAddrIPv6 = &net.UDPAddr{
-		IP: net.ParseIP("ff02::"),
-		// IP:   net.ParseIP("fd00::12d3:26e7:48db:e7d"),
-		Port: 5353,
+	return fmt.Sprintf("%s: %s: %s", e.Network, e.kind, e.Err)
+}
+
+func (e *SocketError) Unwrap() error { return e.Err }
+
+func (e *SocketError) Is(target error) bool { return e.kind != nil && target == e.kind }
+
+// listenError classifies the error binding the mDNS port of the given network.
+func listenError(network string, err error) error {
+	var kind error
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		kind = ErrBindPermission
+	case network == "udp6" && (errors.Is(err, syscall.EAFNOSUPPORT) || errors.Is(err, syscall.EADDRNOTAVAIL)):
+		kind = ErrIPv6Unavailable
 	}
+	return &SocketError{Network: network, Err: err, kind: kind}
+}
+
+// PacketHook inspects a packet received from or sent to the given address. It
+// is called synchronously for every packet, so it must return quickly, and it
+// must not modify msg.
+type PacketHook func(msg *dns.Msg, addr net.Addr, outbound bool)
 
-	// mDNS endpoint addresses
-	ipv4Addr = &net.UDPAddr{
-		IP:   mdnsGroupIPv4,
-		Port: 5353,
+// multicastGroups holds the multicast groups and the port to use for mDNS.
+type multicastGroups struct {
+	ipv4, ipv6 net.IP
+	port       int
+}
+
+// defaultHopLimit is the IP TTL of multicast packets sent. RFC6762 section 11
+// recommends 255, which allows receivers to check that a packet was sent on
+// the local link.
+const defaultHopLimit = 255
+
+// offLink reports whether a packet received with the given IP TTL, or hop
+// limit, was routed, as packets sent on the local link arrive with a TTL of
+// 255 according to RFC6762 section 11. A TTL of 0 means it is unknown.
+func offLink(ttl int) bool {
+	return ttl != 0 && ttl != 255
+}
+
+// defaultGroups are the multicast groups and the port assigned to mDNS.
+var defaultGroups = multicastGroups{
+	ipv4: mdnsGroupIPv4,
+	ipv6: mdnsGroupIPv6,
+	port: 5353,
+}
+
+// validate checks that the groups are multicast addresses of their IP version.
+func (g multicastGroups) validate() error {
+	if g.ipv4.To4() == nil || !g.ipv4.IsMulticast() {
+		return fmt.Errorf("invalid IPv4 multicast group %v", g.ipv4)
 	}
-	ipv6Addr = &net.UDPAddr{
-		IP:   mdnsGroupIPv6,
-		Port: 5353,
+	if len(g.ipv6) != net.IPv6len || g.ipv6.To4() != nil || !g.ipv6.IsMulticast() {
+		return fmt.Errorf("invalid IPv6 multicast group %v", g.ipv6)
 	}
-)
+	return nil
+}
+
+// ipv4Addr returns the IPv4 mDNS endpoint address.
+func (g multicastGroups) ipv4Addr() *net.UDPAddr {
+	return &net.UDPAddr{IP: g.ipv4, Port: g.port}
+}
+
+// ipv6Addr returns the IPv6 mDNS endpoint address.
+func (g multicastGroups) ipv6Addr() *net.UDPAddr {
+	return &net.UDPAddr{IP: g.ipv6, Port: g.port}
+}
+
+// ipv4Conn is the IPv4 connection used for mDNS, an *ipv4.PacketConn unless
+// the connection was passed by the user.
+type ipv4Conn interface {
+	ReadFrom(b []byte) (int, *ipv4.ControlMessage, net.Addr, error)
+	WriteTo(b []byte, cm *ipv4.ControlMessage, dst net.Addr) (int, error)
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	LeaveGroup(ifi *net.Interface, group net.Addr) error
+	Close() error
+}
+
+// ipv6Conn is the IPv6 connection used for mDNS, an *ipv6.PacketConn unless
+// the connection was passed by the user.
+type ipv6Conn interface {
+	ReadFrom(b []byte) (int, *ipv6.ControlMessage, net.Addr, error)
+	WriteTo(b []byte, cm *ipv6.ControlMessage, dst net.Addr) (int, error)
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	LeaveGroup(ifi *net.Interface, group net.Addr) error
+	Close() error
+}
+
+// userConn4 adapts a connection passed by the user to ipv4Conn. It neither
+// reports nor selects interfaces, and joining the multicast groups is up to
+// the user.
+type userConn4 struct {
+	net.PacketConn
+}
+
+func (c userConn4) ReadFrom(b []byte) (int, *ipv4.ControlMessage, net.Addr, error) {
+	n, src, err := c.PacketConn.ReadFrom(b)
+	return n, nil, src, err
+}
+
+func (c userConn4) WriteTo(b []byte, _ *ipv4.ControlMessage, dst net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(b, dst)
+}
+
+func (userConn4) JoinGroup(*net.Interface, net.Addr) error  { return nil }
+func (userConn4) LeaveGroup(*net.Interface, net.Addr) error { return nil }
+
+// userConn6 adapts a connection passed by the user to ipv6Conn, like
+// userConn4.
+type userConn6 struct {
+	net.PacketConn
+}
+
+func (c userConn6) ReadFrom(b []byte) (int, *ipv6.ControlMessage, net.Addr, error) {
+	n, src, err := c.PacketConn.ReadFrom(b)
+	return n, nil, src, err
+}
+
+func (c userConn6) WriteTo(b []byte, _ *ipv6.ControlMessage, dst net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(b, dst)
+}
+
+func (userConn6) JoinGroup(*net.Interface, net.Addr) error  { return nil }
+func (userConn6) LeaveGroup(*net.Interface, net.Addr) error { return nil }
+
+// readBatchSize is the number of packets read at once by a packetReader on
+// platforms supporting it.
+const readBatchSize = 4
+
+// receivedPacket is a packet read from an mDNS connection.
+type receivedPacket struct {
+	data    []byte
+	ifIndex int // 0 if unknown
+	ttl     int // IP TTL or hop limit, 0 if unknown
+	src     net.Addr
+}
+
+// isUserConn reports whether conn was passed by the user, see
+// WithRegisterConnIPv4 and WithConnIPv4.
+func isUserConn(conn interface{}) bool {
+	switch conn.(type) {
+	case userConn4, userConn6:
+		return true
+	}
+	return false
+}
+
+// isTimeout reports whether err is a timeout, after which reading may succeed
+// again.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// packetReader reads the next packets from a connection. They are valid until
+// the next read.
+type packetReader func() ([]receivedPacket, error)
+
+// packetBufPool recycles the receive buffers between packet readers, which are
+// set up for every browse and lookup. A reader keeps its buffers while it is
+// running, so this saves allocations per lookup rather than per packet.
+// Unpacking a packet copies its contents, so the buffers can be reused as soon
+// as the packet has been parsed. The client doesn't reuse the parsed messages,
+// which are passed on to processMessages; the server does, see parsePacket.
+var packetBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 65536)
+		return &b
+	},
+}
+
+// newPacketReader returns a packetReader for conn, an ipv4Conn or ipv6Conn, or
+// nil if conn is neither. The connections of the ipv4 and ipv6 packages read
+// several packets per system call on Linux, one by one elsewhere, like the
+// connections passed by the user. The returned function puts the buffers back
+// into the pool once reading is done.
+func newPacketReader(conn interface{}) (packetReader, func()) {
+	var bufs []*[]byte
+	newBuf := func() []byte {
+		b := packetBufPool.Get().(*[]byte)
+		bufs = append(bufs, b)
+		return *b
+	}
+	release := func() {
+		for _, b := range bufs {
+			packetBufPool.Put(b)
+		}
+		bufs = nil
+	}
+
+	switch c := conn.(type) {
+	case *ipv4.PacketConn:
+		msgs := make([]ipv4.Message, readBatchSize)
+		for i := range msgs {
+			msgs[i].Buffers = [][]byte{newBuf()}
+			msgs[i].OOB = ipv4.NewControlMessage(ipv4.FlagInterface | ipv4.FlagTTL)
+		}
+		packets := make([]receivedPacket, readBatchSize)
+		return func() ([]receivedPacket, error) {
+			n, err := c.ReadBatch(msgs, 0)
+			if err != nil {
+				return nil, err
+			}
+			for i, m := range msgs[:n] {
+				packets[i] = receivedPacket{data: m.Buffers[0][:m.N], src: m.Addr}
+				var cm ipv4.ControlMessage
+				if m.NN > 0 && cm.Parse(m.OOB[:m.NN]) == nil {
+					packets[i].ifIndex = cm.IfIndex
+					packets[i].ttl = cm.TTL
+				}
+			}
+			return packets[:n], nil
+		}, release
+	case *ipv6.PacketConn:
+		msgs := make([]ipv6.Message, readBatchSize)
+		for i := range msgs {
+			msgs[i].Buffers = [][]byte{newBuf()}
+			msgs[i].OOB = ipv6.NewControlMessage(ipv6.FlagInterface | ipv6.FlagHopLimit)
+		}
+		packets := make([]receivedPacket, readBatchSize)
+		return func() ([]receivedPacket, error) {
+			n, err := c.ReadBatch(msgs, 0)
+			if err != nil {
+				return nil, err
+			}
+			for i, m := range msgs[:n] {
+				packets[i] = receivedPacket{data: m.Buffers[0][:m.N], src: m.Addr}
+				var cm ipv6.ControlMessage
+				if m.NN > 0 && cm.Parse(m.OOB[:m.NN]) == nil {
+					packets[i].ifIndex = cm.IfIndex
+					packets[i].ttl = cm.HopLimit
+				}
+			}
+			return packets[:n], nil
+		}, release
+	case ipv4Conn:
+		buf := newBuf()
+		return func() ([]receivedPacket, error) {
+			n, cm, src, err := c.ReadFrom(buf)
+			if err != nil {
+				return nil, err
+			}
+			p := receivedPacket{data: buf[:n], src: src}
+			if cm != nil {
+				p.ifIndex = cm.IfIndex
+				p.ttl = cm.TTL
+			}
+			return []receivedPacket{p}, nil
+		}, release
+	case ipv6Conn:
+		buf := newBuf()
+		return func() ([]receivedPacket, error) {
+			n, cm, src, err := c.ReadFrom(buf)
+			if err != nil {
+				return nil, err
+			}
+			p := receivedPacket{data: buf[:n], src: src}
+			if cm != nil {
+				p.ifIndex = cm.IfIndex
+				p.ttl = cm.HopLimit
+			}
+			return []receivedPacket{p}, nil
+		}, release
+	}
+	return nil, release
+}
+
+// ifaceIndexes returns the indexes of the interfaces to send a multicast
+// packet on through conn, one by one. Connections passed by the user can't
+// select the interface, so they are written to once.
+func ifaceIndexes(conn interface{}, ifaces []net.Interface) []int {
+	switch conn.(type) {
+	case userConn4, userConn6:
+		return []int{0}
+	}
+	indexes := make([]int, len(ifaces))
+	for i, iface := range ifaces {
+		indexes[i] = iface.Index
+	}
+	return indexes
+}
 
-func joinUdp6Multicast(interfaces []net.Interface) (*ipv6.PacketConn, error) {
-	udpConn, err := net.ListenUDP("udp6", mdnsWildcardAddrIPv6)
+// sourceAddr returns the address of the interface with the given index to
+// respond to dst from, i.e. an address on the same link, or nil if there is
+// none. Queriers ignore responses from addresses which are not on their link.
+func sourceAddr(ifIndex int, dst net.IP) net.IP {
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() == nil) != (dst.To4() == nil) {
+			continue
+		}
+		if ipnet.Contains(dst) || (dst.IsLinkLocalUnicast() && ipnet.IP.IsLinkLocalUnicast()) {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+// listenMulticast binds a UDP socket to addr. Unless reuse is false, other
+// sockets may bind the same address and port, so that mDNS can be used
+// alongside the mDNS daemon of the operating system.
+func listenMulticast(network string, addr *net.UDPAddr, reuse bool) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = setReuse(fd, reuse)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, addr.String())
 	if err != nil {
 		return nil, err
 	}
+	return conn.(*net.UDPConn), nil
+}
+
+func joinUdp6Multicast(interfaces []net.Interface, groups multicastGroups, hopLimit int, reuse bool, logger Logger) (*ipv6.PacketConn, []net.Interface, error) {
+	udpConn, err := listenMulticast("udp6", &net.UDPAddr{IP: mdnsWildcardIPv6, Port: groups.port}, reuse)
+	if err != nil {
+		return nil, nil, listenError("udp6", err)
+	}
 
 	// Join multicast groups to receive announcements
 	pkConn := ipv6.NewPacketConn(udpConn)
 	pkConn.SetControlMessage(ipv6.FlagInterface, true)
+	if err := pkConn.SetMulticastHopLimit(hopLimit); err != nil {
+		pkConn.Close()
+		return nil, nil, &SocketError{Network: "udp6", Err: err}
+	}
 
 	if len(interfaces) == 0 {
 		interfaces = listMulticastInterfaces()
 	}
-	// log.Println("Using multicast interfaces: ", interfaces)
-
-	var failedJoins int
-	for _, iface := range interfaces {
-		if err := pkConn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
-			// log.Println("Udp6 JoinGroup failed for iface ", iface)
-			failedJoins++
-		}
-	}
-	if failedJoins == len(interfaces) {
+	joined, err := joinInterfaces("udp6", interfaces, func(iface *net.Interface) error {
+		return pkConn.JoinGroup(iface, &net.UDPAddr{IP: groups.ipv6})
+	}, logger)
+	if err != nil {
 		pkConn.Close()
-		return nil, fmt.Errorf("udp6: failed to join any of these interfaces: %v", interfaces)
+		return nil, nil, err
 	}
-
-	return pkConn, nil
+	return pkConn, joined, nil
 }
 
-func joinUdp4Multicast(interfaces []net.Interface) (*ipv4.PacketConn, error) {
-	udpConn, err := net.ListenUDP("udp4", mdnsWildcardAddrIPv4)
+func joinUdp4Multicast(interfaces []net.Interface, groups multicastGroups, hopLimit int, reuse bool, logger Logger) (*ipv4.PacketConn, []net.Interface, error) {
+	udpConn, err := listenMulticast("udp4", &net.UDPAddr{IP: mdnsWildcardIPv4, Port: groups.port}, reuse)
 	if err != nil {
 		// log.Printf("[ERR] bonjour: Failed to bind to udp4 mutlicast: %v", err)
-		return nil, err
+		return nil, nil, listenError("udp4", err)
 	}
 
 	// Join multicast groups to receive announcements
 	pkConn := ipv4.NewPacketConn(udpConn)
 	pkConn.SetControlMessage(ipv4.FlagInterface, true)
+	if err := pkConn.SetMulticastTTL(hopLimit); err != nil {
+		pkConn.Close()
+		return nil, nil, &SocketError{Network: "udp4", Err: err}
+	}
 
 	if len(interfaces) == 0 {
 		interfaces = listMulticastInterfaces()
 	}
-	// log.Println("Using multicast interfaces: ", interfaces)
+	joined, err := joinInterfaces("udp4", interfaces, func(iface *net.Interface) error {
+		return pkConn.JoinGroup(iface, &net.UDPAddr{IP: groups.ipv4})
+	}, logger)
+	if err != nil {
+		pkConn.Close()
+		return nil, nil, err
+	}
+	return pkConn, joined, nil
+}
 
-	var failedJoins int
-	for _, iface := range interfaces {
-		if err := pkConn.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
-			// log.Println("Udp4 JoinGroup failed for iface ", iface)
-			failedJoins++
+// joinInterfaces joins the multicast group of network on each interface by
+// calling join. Interfaces failing to join it, e.g. point-to-point tunnels,
+// are skipped with a warning. It returns the interfaces joined, or an error
+// listing the skipped ones if there are none.
+func joinInterfaces(network string, interfaces []net.Interface, join func(*net.Interface) error, logger Logger) ([]net.Interface, error) {
+	var joined []net.Interface
+	var skipped []string
+	for i := range interfaces {
+		if err := join(&interfaces[i]); err != nil {
+			logger.Printf("[WARN] zeroconf: skipping interface %s for %s: %v", interfaces[i].Name, network, err)
+			skipped = append(skipped, interfaces[i].Name)
+			continue
 		}
+		joined = append(joined, interfaces[i])
 	}
-	if failedJoins == len(interfaces) {
-		pkConn.Close()
-		return nil, fmt.Errorf("udp4: failed to join any of these interfaces: %v", interfaces)
+	if len(joined) == 0 {
+		return nil, &SocketError{
+			Network: network,
+			Skipped: skipped,
+			Err:     fmt.Errorf("failed to join any of these interfaces: %v", skipped),
+			kind:    ErrNoInterfaces,
+		}
 	}
+	return joined, nil
+}
 
-	return pkConn, nil
+// mergeInterfaces returns the interfaces of a followed by those of b missing
+// in a.
+func mergeInterfaces(a, b []net.Interface) []net.Interface {
+	merged := append([]net.Interface(nil), a...)
+	for _, iface := range b {
+		if !containsInterface(merged, iface) {
+			merged = append(merged, iface)
+		}
+	}
+	return merged
 }
 
 func listMulticastInterfaces() []net.Interface {
@@ -113,3 +490,58 @@ func listMulticastInterfaces() []net.Interface {
 
 	return interfaces
 }
+
+// interfacesByName looks up the interfaces with the given names. Unknown names
+// are skipped with a warning.
+func interfacesByName(names []string, logger Logger) []net.Interface {
+	var interfaces []net.Interface
+	for _, name := range names {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			logger.Printf("[WARN] zeroconf: skipping interface %s: %v", name, err)
+			continue
+		}
+		interfaces = append(interfaces, *ifi)
+	}
+	return interfaces
+}
+
+// filterMulticastInterfaces drops the interfaces which are down or not
+// multicast capable with a warning.
+func filterMulticastInterfaces(ifaces []net.Interface, logger Logger) []net.Interface {
+	var interfaces []net.Interface
+	for _, ifi := range ifaces {
+		if (ifi.Flags & net.FlagUp) == 0 {
+			logger.Printf("[WARN] zeroconf: skipping interface %s: interface is down", ifi.Name)
+			continue
+		}
+		if (ifi.Flags & net.FlagMulticast) == 0 {
+			logger.Printf("[WARN] zeroconf: skipping interface %s: no multicast support", ifi.Name)
+			continue
+		}
+		interfaces = append(interfaces, ifi)
+	}
+	return interfaces
+}
+
+// interfacesState describes the interfaces along with their addresses, in order
+// to detect changes.
+func interfacesState(ifaces []net.Interface) string {
+	var b strings.Builder
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		fmt.Fprintf(&b, "%d %s %v %v\n", iface.Index, iface.Name, iface.Flags, addrs)
+	}
+	return b.String()
+}
+
+// containsInterface reports whether ifaces contains an interface with the same
+// index and name as iface.
+func containsInterface(ifaces []net.Interface, iface net.Interface) bool {
+	for _, i := range ifaces {
+		if i.Index == iface.Index && i.Name == iface.Name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package zeroconf
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxCachedRecords limits the records kept for DumpCache, so that a busy
+// network doesn't make the cache grow without bounds.
+const maxCachedRecords = 4096
+
+// recordCache holds the records received, for troubleshooting only. The
+// entries are assembled by processMessages independently.
+type recordCache struct {
+	mu      sync.Mutex
+	records map[string]*cachedRecord // by recordKey
+}
+
+// cachedRecord is a record received from src, kept until it expires.
+type cachedRecord struct {
+	rr     dns.RR
+	src    net.Addr
+	expiry time.Time
+}
+
+// add caches the records received from src. A TTL of 0 removes a record, see
+// RFC6762 section 10.1.
+func (c *recordCache) add(rrs []dns.RR, src net.Addr, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.records == nil {
+		c.records = make(map[string]*cachedRecord)
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := recordKey(rr)
+		if rr.Header().Ttl == 0 {
+			delete(c.records, k)
+			continue
+		}
+		if _, ok := c.records[k]; !ok && len(c.records) >= maxCachedRecords {
+			continue
+		}
+		c.records[k] = &cachedRecord{
+			rr:     rr,
+			src:    src,
+			expiry: now.Add(time.Duration(rr.Header().Ttl) * time.Second),
+		}
+	}
+}
+
+// expire removes the records whose TTL passed.
+func (c *recordCache) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, r := range c.records {
+		if !now.Before(r.expiry) {
+			delete(c.records, k)
+		}
+	}
+}
+
+// dump renders the cached records in zone file format, sorted by name, with
+// their remaining TTL and the address they were received from.
+func (c *recordCache) dump(now time.Time) string {
+	c.mu.Lock()
+	var lines []string
+	for _, r := range c.records {
+		left := r.expiry.Sub(now)
+		if left <= 0 {
+			continue
+		}
+		rr := withoutCacheFlush(r.rr)
+		// Round up, so that records about to expire don't look removed.
+		rr.Header().Ttl = uint32((left + time.Second - 1) / time.Second)
+		line := rr.String()
+		if r.src != nil {
+			line += " ; from " + r.src.String()
+		}
+		lines = append(lines, line)
+	}
+	c.mu.Unlock()
+
+	sort.Strings(lines)
+	return joinLines(lines)
+}
+
+// DumpCache returns a human-readable listing of the records the resolver
+// received and still caches, one per line in zone file format, each with its
+// remaining TTL and the address it was received from. It is meant for
+// troubleshooting, e.g. to be attached to bug reports.
+func (r *Resolver) DumpCache() string {
+	return r.c.cache.dump(time.Now())
+}
+
+// DumpRecords returns a human-readable listing of the records the server is
+// authoritative for, one per line in zone file format. Services still probing
+// are left out. It is meant for troubleshooting, e.g. to be attached to bug
+// reports.
+func (s *Server) DumpRecords() string {
+	resp := new(dns.Msg)
+	s.mu.RLock()
+	for _, entry := range s.services {
+		r := new(dns.Msg)
+		s.composeLookupAnswers(r, entry, s.ttl, 0)
+		resp.Answer = appendUnique(resp.Answer, r.Answer...)
+	}
+	s.mu.RUnlock()
+	resp.Answer = appendUnique(resp.Answer, s.opts.extraRecords...)
+
+	lines := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		lines = append(lines, withoutCacheFlush(rr).String())
+	}
+	return joinLines(lines)
+}
+
+// withoutCacheFlush returns a copy of rr without the cache-flush bit, which
+// would render its class as a number.
+func withoutCacheFlush(rr dns.RR) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Class &^= qClassCacheFlush
+	return rr
+}
+
+// joinLines joins lines, each terminated by a newline.
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
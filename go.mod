@@ -1,11 +1,12 @@
 module github.com/grandcat/zeroconf
 
-go 1.13
+go 1.18
 
 require (
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/miekg/dns v1.1.41
 	github.com/pkg/errors v0.9.1
+	go.uber.org/goleak v1.1.12
 	golang.org/x/net v0.0.0-20210423184538-5f58ad60dda6
-	golang.org/x/sys v0.0.0-20210426080607-c94f62235c83 // indirect
+	golang.org/x/sys v0.0.0-20210510120138-977fb7262007
 )
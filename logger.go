@@ -0,0 +1,12 @@
+package zeroconf
+
+// Logger receives the warnings and errors of the library, which are otherwise
+// discarded. It is satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// nopLogger discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
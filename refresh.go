@@ -0,0 +1,224 @@
+package zeroconf
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// From RFC6762
+//    The querier should plan to issue a query at 80% of the record lifetime,
+//    and then if no answer is received, at 85%, 90%, and 95%. If an answer is
+//    received, then the remaining TTL is reset to the value given in the
+//    answer, and this process repeats for as long as the Multicast DNS querier
+//    has an ongoing interest in the record. If no answer is received after
+//    four queries, the record is deleted when it reaches 100% of its
+//    lifetime. [...] To avoid the case where multiple Multicast DNS queriers
+//    on a network all issue their queries simultaneously, a random variation
+//    of 2% of the record TTL should be added to the time at which each query
+//    is sent.
+
+// refreshPoints are the fractions of their TTL at which records are queried
+// again before they expire.
+var refreshPoints = []float64{0.80, 0.85, 0.90, 0.95}
+
+// refreshJitter is the random variation added to the refresh points.
+const refreshJitter = 0.02
+
+// trackedRecord is a record of an entry, along with the refresh queries sent
+// for it.
+type trackedRecord struct {
+	q        dns.Question // asks for the record
+	received time.Time
+	ttl      uint32
+	jitter   float64
+	queries  int // refresh queries sent since the record was received
+}
+
+// expiry returns the time the record expires unless it is refreshed.
+func (r *trackedRecord) expiry() time.Time {
+	return r.received.Add(time.Duration(r.ttl) * time.Second)
+}
+
+// next returns the time of the next refresh query, or the expiry once all of
+// them were sent.
+func (r *trackedRecord) next() time.Time {
+	if r.queries >= len(refreshPoints) {
+		return r.expiry()
+	}
+	lifetime := float64(time.Duration(r.ttl) * time.Second)
+	return r.received.Add(time.Duration(lifetime * (refreshPoints[r.queries] + r.jitter)))
+}
+
+// entryRecords tracks the records of the entries assembled, by entry key, to
+// refresh them before they expire.
+type entryRecords map[string]map[dns.Question]*trackedRecord
+
+// update tracks the records of e found in rrs. PTR records are only tracked
+// if browsing is set.
+func (t entryRecords) update(k string, e *ServiceEntry, rrs []dns.RR, browsing bool, now time.Time) {
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			if !browsing || !isEntryPTR(e, rr) {
+				continue
+			}
+		case *dns.SRV, *dns.TXT:
+			if !strings.EqualFold(h.Name, e.ServiceInstanceName()) {
+				continue
+			}
+		case *dns.A, *dns.AAAA:
+			if e.HostName == "" || !strings.EqualFold(h.Name, e.HostName) {
+				continue
+			}
+		default:
+			continue
+		}
+		q := dns.Question{Name: strings.ToLower(h.Name), Qtype: h.Rrtype, Qclass: dns.ClassINET}
+		records := t[k]
+		if h.Ttl == 0 {
+			delete(records, q)
+			continue
+		}
+		if records == nil {
+			records = make(map[dns.Question]*trackedRecord)
+			t[k] = records
+		}
+		r := &trackedRecord{
+			q:        dns.Question{Name: h.Name, Qtype: h.Rrtype, Qclass: dns.ClassINET},
+			received: now,
+			ttl:      h.Ttl,
+			jitter:   rand.Float64() * refreshJitter,
+		}
+		// Several address records of a host expire with the last one.
+		if prev, ok := records[q]; ok && prev.expiry().After(r.expiry()) {
+			continue
+		}
+		records[q] = r
+	}
+}
+
+// isEntryPTR reports whether ptr points at entry e, from its service name or
+// one of its subtypes.
+func isEntryPTR(e *ServiceEntry, ptr *dns.PTR) bool {
+	if !strings.EqualFold(ptr.Ptr, ptrTarget(e)) {
+		return false
+	}
+	if strings.EqualFold(ptr.Hdr.Name, e.ServiceName()) {
+		return true
+	}
+	for _, subtype := range e.Subtypes {
+		if strings.EqualFold(ptr.Hdr.Name, subtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// ptrTarget returns the name the PTR records of e point at.
+func ptrTarget(e *ServiceEntry) string {
+	if e.ServiceName() == e.ServiceTypeName() {
+		// Service type enumeration, RFC6763 section 9.
+		return e.Instance + "."
+	}
+	return e.ServiceInstanceName()
+}
+
+// refresh returns the questions refreshing the records of entry k that are due
+// at now, and whether the entry expired: once its PTR or SRV record expired,
+// or, lacking those, its last record.
+func (t entryRecords) refresh(k string, now time.Time) ([]dns.Question, bool) {
+	records := t[k]
+	var questions []dns.Question
+	for key, r := range records {
+		if !now.Before(r.expiry()) {
+			delete(records, key)
+			if r.q.Qtype == dns.TypePTR || r.q.Qtype == dns.TypeSRV {
+				return nil, true
+			}
+			continue
+		}
+		for r.queries < len(refreshPoints) && !now.Before(r.next()) {
+			if r.queries++; !now.Before(r.next()) && r.queries < len(refreshPoints) {
+				// Refresh points missed, e.g. by a suspended
+				// process, are caught up with a single query.
+				continue
+			}
+			questions = append(questions, r.q)
+		}
+	}
+	return questions, len(records) == 0
+}
+
+// next returns the time the next record of entry k is due, or the zero time if
+// it has no records.
+func (t entryRecords) next(k string) time.Time {
+	var next time.Time
+	for _, r := range t[k] {
+		if due := r.next(); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
+
+// appendQuestions appends the questions to list that it doesn't contain yet.
+func appendQuestions(list []dns.Question, questions ...dns.Question) []dns.Question {
+outer:
+	for _, q := range questions {
+		for _, known := range list {
+			if strings.EqualFold(known.Name, q.Name) && known.Qtype == q.Qtype {
+				continue outer
+			}
+		}
+		list = append(list, q)
+	}
+	return list
+}
+
+// sendRefresh queries the records due for a refresh, in as few packets as the
+// maximum packet size allows.
+func (c *client) sendRefresh(questions []dns.Question) error {
+	for len(questions) > 0 {
+		m := new(dns.Msg)
+		m.RecursionDesired = false
+		for len(questions) > 0 {
+			m.Question = append(m.Question, questions[0])
+			if len(m.Question) > 1 && m.Len() > c.opts.maxPacketSize {
+				m.Question = m.Question[:len(m.Question)-1]
+				break
+			}
+			questions = questions[1:]
+		}
+		if err := c.sendQuery(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fresh returns the time until which the SRV, TXT and address records of entry
+// k have more than half of their TTL left. Lacking those, e.g. when
+// enumerating service types, it returns the expiry of its PTR records.
+func (t entryRecords) fresh(k string) time.Time {
+	var fresh, expiry time.Time
+	for _, r := range t[k] {
+		if r.q.Qtype == dns.TypePTR {
+			if r.expiry().After(expiry) {
+				expiry = r.expiry()
+			}
+			continue
+		}
+		half := r.received.Add(time.Duration(r.ttl) * time.Second / 2)
+		if fresh.IsZero() || half.Before(fresh) {
+			fresh = half
+		}
+	}
+	if fresh.IsZero() {
+		return expiry
+	}
+	return fresh
+}
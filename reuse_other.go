@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+
+package zeroconf
+
+// setReuse leaves the socket options of the platform's defaults alone.
+func setReuse(fd uintptr, reuse bool) error {
+	return nil
+}
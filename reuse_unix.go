@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package zeroconf
+
+import "golang.org/x/sys/unix"
+
+// setReuse allows or forbids other sockets, e.g. the ones of the system's mDNS
+// daemon, to bind the same address and port as the socket fd. Both options
+// are set, since the BSDs share multicast ports only with SO_REUSEPORT.
+func setReuse(fd uintptr, reuse bool) error {
+	v := 0
+	if reuse {
+		v = 1
+	}
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, v); err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, v)
+}
@@ -0,0 +1,13 @@
+package zeroconf
+
+import "syscall"
+
+// setReuse allows or forbids other sockets, e.g. the ones of the system's mDNS
+// service, to bind the same address and port as the socket fd.
+func setReuse(fd uintptr, reuse bool) error {
+	v := 0
+	if reuse {
+		v = 1
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, v)
+}
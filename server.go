@@ -1,14 +1,16 @@
 package zeroconf
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,29 +21,525 @@ import (
 const (
 	// Number of Multicast responses sent for a query message (default: 1 < x < 9)
 	multicastRepetitions = 2
+	// Minimum interval between two multicasts of the same record on an interface
+	multicastRateLimit = time.Second
+	// Number of goodbye packets sent on shutdown and the pause between them
+	goodbyeRepetitions = 3
+	goodbyeInterval    = 50 * time.Millisecond
+	// Number of probes sent to claim an instance name and the pause between them
+	probeCount    = 3
+	probeInterval = 250 * time.Millisecond
+	// Number of name conflicts after which probing is slowed down
+	maxProbeConflicts  = 15
+	probeConflictDelay = 5 * time.Second
+	// Delay for collecting the Known-Answer packets of a truncated query
+	knownAnswersDelay  = 400 * time.Millisecond
+	knownAnswersJitter = 100 * time.Millisecond
 )
 
+// Default and maximum TTLs of records containing a host name, i.e. SRV, A and
+// AAAA records, and of all other records, RFC6762 section 10.
+const (
+	defaultHostTTL = 120
+	maxHostTTL     = 120
+	defaultTTL     = 3200
+	maxTTL         = 75 * 60
+)
+
+type serverOpts struct {
+	disableProbing    bool
+	disableCacheFlush bool
+	hostTTL           uint32
+	ttl               uint32
+	srvPriority       uint16
+	srvWeight         uint16
+	logger            Logger
+	groups            multicastGroups
+	hopLimit          int
+	maxPacketSize     int
+	packetHook        PacketHook
+	conflictHandler   func(record string)
+	announceCallback  func(iface net.Interface, err error)
+	watchInterval     time.Duration
+	unicastDNS        string
+	ipVersion         IPType
+	minResponseDelay  time.Duration
+	maxResponseDelay  time.Duration
+	subtypes          []string
+	textMap           map[string]string
+	textFlags         []string
+	text              []string // encoded from textMap and textFlags
+	announceCount     int
+	announceInterval  time.Duration
+	hostname          string
+	srvTarget         string
+	srvTargetAddrs    bool // answerAddrs of WithSRVTarget
+	withoutAddrs      bool // WithoutAddressRecords
+	noAddrs           bool // derived from the above
+	queryRate         float64
+	queryBurst        int
+	conn4, conn6      net.PacketConn
+	noLoopback        bool
+	requireTTL        bool
+	exclusive         bool
+	noAdditionals     bool
+	randSource        rand.Source
+	extraRecords      []dns.RR
+}
+
+// RegisterOption fills the option struct to configure the server.
+type RegisterOption func(*serverOpts)
+
+// WithoutProbing skips probing for a unique instance name before announcing a
+// service. The service is announced right away, but conflicting names of
+// other responders go unnoticed.
+func WithoutProbing() RegisterOption {
+	return func(o *serverOpts) {
+		o.disableProbing = true
+	}
+}
+
+// WithoutCacheFlush clears the cache-flush bit on all records. By default, it
+// is set on the unique SRV, TXT, A and AAAA records, so that receivers replace
+// outdated records instead of accumulating them. This is mostly useful for
+// debugging.
+func WithoutCacheFlush() RegisterOption {
+	return func(o *serverOpts) {
+		o.disableCacheFlush = true
+	}
+}
+
+// WithTTL sets the TTLs of the records containing a host name, i.e. SRV, A
+// and AAAA records, and of the PTR and TXT records. They default to 120
+// seconds and 3200 seconds, and must not exceed 120 seconds and 4500 seconds
+// (75 minutes, RFC6762 section 10). Lower TTLs make listeners notice vanished
+// services earlier, at the cost of more traffic.
+func WithTTL(hostTTL, ptrTTL uint32) RegisterOption {
+	return func(o *serverOpts) {
+		o.hostTTL = hostTTL
+		o.ttl = ptrTTL
+	}
+}
+
+// WithSRVPriorityWeight sets the priority and weight of the SRV records, which
+// default to 0. Clients may use them to choose among several instances of a
+// service, see RFC2782.
+func WithSRVPriorityWeight(priority, weight uint16) RegisterOption {
+	return func(o *serverOpts) {
+		o.srvPriority = priority
+		o.srvWeight = weight
+	}
+}
+
+// WithRegisterLogger sets the logger receiving warnings and errors of the
+// server. By default, they are discarded.
+func WithRegisterLogger(l Logger) RegisterOption {
+	return func(o *serverOpts) {
+		o.logger = l
+	}
+}
+
+// WithRegisterPort sets the port to use instead of the mDNS port 5353. Along
+// with WithRegisterMulticastGroups, this allows running isolated instances,
+// e.g. for testing. Only clients using the same port find the services.
+func WithRegisterPort(port int) RegisterOption {
+	return func(o *serverOpts) {
+		o.groups.port = port
+	}
+}
+
+// WithRegisterMulticastGroups sets the multicast groups to use instead of the
+// mDNS groups 224.0.0.251 and ff02::fb.
+func WithRegisterMulticastGroups(v4, v6 net.IP) RegisterOption {
+	return func(o *serverOpts) {
+		o.groups.ipv4 = v4
+		o.groups.ipv6 = v6
+	}
+}
+
+// WithRegisterIPv6MulticastGroup sets the IPv6 multicast group to use instead
+// of the link-local mDNS group ff02::fb, e.g. ff05::fb to reach the site.
+func WithRegisterIPv6MulticastGroup(group net.IP) RegisterOption {
+	return func(o *serverOpts) {
+		o.groups.ipv6 = group
+	}
+}
+
+// WithRegisterPacketHook sets a hook inspecting every packet received or sent
+// by the server, including the ones ignored otherwise.
+func WithRegisterPacketHook(hook PacketHook) RegisterOption {
+	return func(o *serverOpts) {
+		o.packetHook = hook
+	}
+}
+
+// WithConflictHandler sets a handler called with the name of a record when
+// another responder claims it with different data after the service was
+// announced, see RFC6762 section 9. The server keeps its records, so the
+// handler may for example rename the service or alert the operator. It runs
+// on its own goroutine.
+func WithConflictHandler(handler func(record string)) RegisterOption {
+	return func(o *serverOpts) {
+		o.conflictHandler = handler
+	}
+}
+
+// WithAnnounceCallback sets a callback called for every interface once the
+// first announcement of the service passed to Register has been sent on it,
+// with the error of sending it, if any. This also happens for the interfaces
+// added later, see RefreshInterfaces. The callback must not block, as it holds
+// up the announcements.
+func WithAnnounceCallback(callback func(iface net.Interface, err error)) RegisterOption {
+	return func(o *serverOpts) {
+		o.announceCallback = callback
+	}
+}
+
+// WithInterfaceWatcher checks the network interfaces for changes at the given
+// interval and updates the server accordingly, see Server.RefreshInterfaces.
+func WithInterfaceWatcher(interval time.Duration) RegisterOption {
+	return func(o *serverOpts) {
+		o.watchInterval = interval
+	}
+}
+
+// WithIPVersion restricts the server to IPv4 or IPv6 multicast. By default,
+// both are used, and the server only fails if neither works.
+func WithIPVersion(t IPType) RegisterOption {
+	return func(o *serverOpts) {
+		o.ipVersion = t
+	}
+}
+
+// WithSubtypes adds subtypes, e.g. _printer, to the registered service, in
+// addition to the ones given in the service name like "_http._tcp,_printer".
+// The instance is announced under each of them, so browsers of any subtype
+// find it.
+func WithSubtypes(subtypes ...string) RegisterOption {
+	return func(o *serverOpts) {
+		o.subtypes = append(o.subtypes, subtypes...)
+	}
+}
+
+// WithTXTMap adds the given attributes to the TXT record of the registered
+// service, encoded as "key=value" strings sorted by key, after the ones passed
+// as text. An empty value is encoded as "key=", i.e. the attribute is present
+// with an empty value, see RFC6763 section 6.4. Keys must neither be empty nor
+// contain '='. The option may be given several times.
+func WithTXTMap(attrs map[string]string) RegisterOption {
+	return func(o *serverOpts) {
+		if o.textMap == nil {
+			o.textMap = make(map[string]string)
+		}
+		for k, v := range attrs {
+			o.textMap[k] = v
+		}
+	}
+}
+
+// WithTXTFlags adds boolean attributes to the TXT record of the registered
+// service, encoded as keys without '=', i.e. the attributes are present
+// without any value, see RFC6763 section 6.4. They follow the attributes of
+// WithTXTMap.
+func WithTXTFlags(keys ...string) RegisterOption {
+	return func(o *serverOpts) {
+		o.textFlags = append(o.textFlags, keys...)
+	}
+}
+
+// WithHostname sets the host name used as target of the SRV records and as
+// name of the A and AAAA records, e.g. "myprinter" or "myprinter.local.",
+// instead of the one of the operating system. It is useful in containers,
+// whose host names tend to be random. Only applies to Register.
+func WithHostname(hostname string) RegisterOption {
+	return func(o *serverOpts) {
+		o.hostname = hostname
+	}
+}
+
+// WithSRVTarget sets the target host of the SRV records, e.g.
+// "bigserver.local.", which may be a host other than this one. Unlike
+// WithHostname, it lets another responder own the host name: unless
+// answerAddrs is set, the server neither publishes nor answers the A and AAAA
+// records of the target. WithoutAddressRecords overrides answerAddrs. Only
+// applies to Register.
+func WithSRVTarget(target string, answerAddrs bool) RegisterOption {
+	return func(o *serverOpts) {
+		o.srvTarget = target
+		o.srvTargetAddrs = answerAddrs
+	}
+}
+
+// WithoutAddressRecords makes the server publish the PTR, SRV and TXT records
+// of the services only, leaving the A and AAAA records of the host to the
+// responder owning its name, e.g. the mDNS daemon of the operating system. The
+// SRV records still point at the host, see WithHostname.
+func WithoutAddressRecords() RegisterOption {
+	return func(o *serverOpts) {
+		o.withoutAddrs = true
+	}
+}
+
+// WithRegisterConnIPv4 makes the server send and receive IPv4 mDNS messages
+// through c instead of opening a socket itself, e.g. to run over another
+// transport or in tests. Joining the multicast group is up to the caller.
+// Once a connection is passed with WithRegisterConnIPv4 or
+// WithRegisterConnIPv6, the server opens no sockets at all. It closes c on
+// shutdown, and stops receiving from c once reading fails with an error other
+// than a timeout, e.g. because the caller closed it.
+func WithRegisterConnIPv4(c net.PacketConn) RegisterOption {
+	return func(o *serverOpts) {
+		o.conn4 = c
+	}
+}
+
+// WithRegisterConnIPv6 makes the server use c for IPv6 mDNS messages, like
+// WithRegisterConnIPv4.
+func WithRegisterConnIPv6(c net.PacketConn) RegisterOption {
+	return func(o *serverOpts) {
+		o.conn6 = c
+	}
+}
+
+// WithExtraRecords adds records the server answers queries for their name and
+// type with, besides the records of the services, e.g. a TXT record of a
+// subtype. The records are served as given, so their owner names should be
+// in the domain of the services.
+func WithExtraRecords(records []dns.RR) RegisterOption {
+	return func(o *serverOpts) {
+		o.extraRecords = nil
+		for _, rr := range records {
+			if rr != nil {
+				rr = dns.Copy(rr)
+			}
+			o.extraRecords = append(o.extraRecords, rr)
+		}
+	}
+}
+
+// WithNoMulticastLoopback disables the loopback of the multicast packets sent
+// by the server, so that it doesn't receive its own packets. Clients on the
+// same host then don't receive them either. Loopback is enabled by default.
+func WithNoMulticastLoopback() RegisterOption {
+	return func(o *serverOpts) {
+		o.noLoopback = true
+	}
+}
+
+// WithRegisterMulticastHopLimit sets the IP TTL, or IPv6 hop limit, of the
+// multicast responses and announcements sent. It defaults to 255, as
+// recommended by RFC6762.
+func WithRegisterMulticastHopLimit(n int) RegisterOption {
+	return func(o *serverOpts) {
+		o.hopLimit = n
+	}
+}
+
+// WithRegisterMaxPacketSize sets the size in bytes up to which responses are
+// sent in a single packet, e.g. 1472 to avoid IP fragmentation on Ethernet.
+// Larger ones are split into several packets at record boundaries, see
+// RFC6762 section 17. It defaults to 9000 bytes, the upper limit, and must be
+// at least 512 bytes.
+func WithRegisterMaxPacketSize(size int) RegisterOption {
+	return func(o *serverOpts) {
+		o.maxPacketSize = size
+	}
+}
+
+// WithRegisterRequireLinkLocalTTL makes the server drop the packets which
+// weren't sent with an IP TTL, or hop limit, of 255, i.e. packets that were
+// routed and might have been spoofed from outside the local link. They are
+// counted in the server's Stats. Packets whose TTL is unknown are accepted. It
+// is off by default.
+func WithRegisterRequireLinkLocalTTL(require bool) RegisterOption {
+	return func(o *serverOpts) {
+		o.requireTTL = require
+	}
+}
+
+// WithRegisterAddressReuse sets whether other sockets may bind the mDNS port
+// along with the server's, see WithAddressReuse. It is on by default.
+func WithRegisterAddressReuse(reuse bool) RegisterOption {
+	return func(o *serverOpts) {
+		o.exclusive = !reuse
+	}
+}
+
+// WithoutAdditionalRecords makes the server answer with the records asked for
+// only. By default, answers to PTR queries include the SRV, TXT and address
+// records of the instance in the additional section, as recommended by
+// RFC6763, so that browsers don't need to query them separately. Leaving them
+// out keeps the responses small.
+func WithoutAdditionalRecords() RegisterOption {
+	return func(o *serverOpts) {
+		o.noAdditionals = true
+	}
+}
+
+// WithRandSource sets the source of the random delays of the server, i.e. the
+// delay before probing and the delays of responses, e.g. to make them
+// reproducible in tests. The server serializes its calls to src. By default,
+// a source seeded with the current time is used.
+func WithRandSource(src rand.Source) RegisterOption {
+	return func(o *serverOpts) {
+		o.randSource = src
+	}
+}
+
+// WithQueryRateLimit limits the queries answered per source address to rate
+// queries per second, allowing bursts of up to burst queries. Queries beyond
+// are dropped and counted in the server's Stats. There is no limit by
+// default.
+func WithQueryRateLimit(rate float64, burst int) RegisterOption {
+	return func(o *serverOpts) {
+		o.queryRate = rate
+		o.queryBurst = burst
+	}
+}
+
+// WithAnnounceCount sets how often a service is announced once probing
+// finished. RFC6762 section 8.3 asks for two to eight announcements, the
+// default is two.
+func WithAnnounceCount(n int) RegisterOption {
+	return func(o *serverOpts) {
+		o.announceCount = n
+	}
+}
+
+// WithAnnounceInterval sets the interval between the first two announcements
+// of a service, which defaults to one second. It doubles with every further
+// announcement.
+func WithAnnounceInterval(d time.Duration) RegisterOption {
+	return func(o *serverOpts) {
+		o.announceInterval = d
+	}
+}
+
+// WithResponseDelay sets the range of the random delay of multicast responses
+// containing shared records, i.e. PTR records many hosts may answer with at
+// the same time. RFC6762 section 6 recommends 20-120ms, the default. Other
+// responses are sent right away. A max of 0 disables the delay.
+func WithResponseDelay(min, max time.Duration) RegisterOption {
+	return func(o *serverOpts) {
+		o.minResponseDelay = min
+		o.maxResponseDelay = max
+	}
+}
+
+// WithUnicastDNS registers services in domains other than "local." by DNS
+// updates (RFC2136) sent to the given authoritative server, e.g.
+// "ns.example.com:53", instead of announcing them by multicast. On shutdown,
+// the records are removed again. Services added later and text changes are
+// not propagated to the server.
+func WithUnicastDNS(server string) RegisterOption {
+	return func(o *serverOpts) {
+		o.unicastDNS = server
+	}
+}
+
+// applyRegisterOptions returns the server configuration for the given options.
+func applyRegisterOptions(options []RegisterOption) (serverOpts, error) {
+	conf := serverOpts{
+		hostTTL:       defaultHostTTL,
+		ttl:           defaultTTL,
+		logger:        nopLogger{},
+		groups:        defaultGroups,
+		hopLimit:      defaultHopLimit,
+		maxPacketSize: maxResponseSize,
+		ipVersion:     IPv4AndIPv6,
+
+		minResponseDelay: 20 * time.Millisecond,
+		maxResponseDelay: 120 * time.Millisecond,
+		announceCount:    multicastRepetitions,
+		announceInterval: time.Second,
+	}
+	for _, o := range options {
+		if o != nil {
+			o(&conf)
+		}
+	}
+	if conf.logger == nil {
+		conf.logger = nopLogger{}
+	}
+	if conf.hostTTL == 0 || conf.hostTTL > maxHostTTL {
+		return conf, fmt.Errorf("host record TTL must be between 1 and %d seconds", maxHostTTL)
+	}
+	if conf.ttl == 0 || conf.ttl > maxTTL {
+		return conf, fmt.Errorf("PTR and TXT record TTL must be between 1 and %d seconds", maxTTL)
+	}
+	if conf.hopLimit < 1 || conf.hopLimit > 255 {
+		return conf, fmt.Errorf("multicast hop limit must be between 1 and 255")
+	}
+	if conf.maxPacketSize < minPacketSize || conf.maxPacketSize > maxResponseSize {
+		return conf, fmt.Errorf("maximum packet size must be between %d and %d bytes", minPacketSize, maxResponseSize)
+	}
+	if err := conf.groups.validate(); err != nil {
+		return conf, err
+	}
+	if conf.srvTarget != "" {
+		if _, ok := dns.IsDomainName(conf.srvTarget); !ok {
+			return conf, fmt.Errorf("invalid SRV target %q", conf.srvTarget)
+		}
+	}
+	// Independent of the order of the options, addresses are only published
+	// if neither option leaves them to another responder.
+	conf.noAddrs = conf.withoutAddrs || (conf.srvTarget != "" && !conf.srvTargetAddrs)
+	if conf.ipVersion&IPv4AndIPv6 == 0 {
+		return conf, fmt.Errorf("no IP version selected")
+	}
+	if conf.minResponseDelay < 0 || conf.minResponseDelay > conf.maxResponseDelay {
+		return conf, fmt.Errorf("invalid response delay range %s-%s", conf.minResponseDelay, conf.maxResponseDelay)
+	}
+	if conf.announceCount < 2 || conf.announceCount > 8 {
+		return conf, fmt.Errorf("announce count must be between 2 and 8")
+	}
+	if conf.announceInterval <= 0 {
+		return conf, fmt.Errorf("announce interval must be positive")
+	}
+	if conf.queryRate < 0 || (conf.queryRate > 0 && conf.queryBurst < 1) {
+		return conf, fmt.Errorf("invalid query rate limit")
+	}
+	for _, rr := range conf.extraRecords {
+		if rr == nil || rr.Header().Name == "" {
+			return conf, fmt.Errorf("invalid extra record %v", rr)
+		}
+	}
+	text, err := encodeText(conf.textMap, conf.textFlags)
+	if err != nil {
+		return conf, err
+	}
+	conf.text = text
+	return conf, nil
+}
+
 // Register a service by given arguments. This call will take the system's hostname
 // and lookup IP by that hostname.
-func Register(instance, service, domain string, port int, text []string, ifaces []net.Interface) (*Server, error) {
-	entry := NewServiceEntry(instance, service, domain)
-	entry.Port = port
-	entry.Text = text
-
-	if entry.Instance == "" {
-		return nil, fmt.Errorf("missing service instance name")
+//
+// Before the service is announced, the server probes whether the instance name
+// is already taken by another responder, in which case a new name like
+// "instance (2)" is chosen. The name finally claimed is returned by
+// Server.Instance.
+func Register(instance, service, domain string, port int, text []string, ifaces []net.Interface, opts ...RegisterOption) (*Server, error) {
+	conf, err := applyRegisterOptions(opts)
+	if err != nil {
+		return nil, err
 	}
-	if entry.Service == "" {
-		return nil, fmt.Errorf("missing service name")
+	entry, err := newRegistrationEntry(instance, service, domain, port, text)
+	if err != nil {
+		return nil, err
 	}
+	entry.addSubtypes(conf.subtypes)
+	entry.Text = append(entry.Text, conf.text...)
+	entry.Priority = conf.srvPriority
+	entry.Weight = conf.srvWeight
 	if entry.Domain == "" {
 		entry.Domain = "local."
 	}
-	if entry.Port == 0 {
-		return nil, fmt.Errorf("missing port")
-	}
 
-	var err error
+	entry.HostName = conf.hostname
+	if conf.srvTarget != "" {
+		entry.HostName = conf.srvTarget
+	}
 	if entry.HostName == "" {
 		entry.HostName, err = os.Hostname()
 		if err != nil {
@@ -49,179 +547,851 @@ func Register(instance, service, domain string, port int, text []string, ifaces
 		}
 	}
 
-	if !strings.HasSuffix(trimDot(entry.HostName), entry.Domain) {
+	if !strings.HasSuffix(trimDot(entry.HostName), trimDot(entry.Domain)) {
 		entry.HostName = fmt.Sprintf("%s.%s.", trimDot(entry.HostName), trimDot(entry.Domain))
 	}
 
+	selectedIfaces := ifaces
 	if len(ifaces) == 0 {
 		ifaces = listMulticastInterfaces()
 	}
 
-	for _, iface := range ifaces {
-		v4, v6 := addrsForInterface(&iface)
-		entry.AddrIPv4 = append(entry.AddrIPv4, v4...)
-		entry.AddrIPv6 = append(entry.AddrIPv6, v6...)
-	}
-
+	entry.AddrIPv4, entry.AddrIPv6 = addrsForInterfaces(ifaces)
 	if entry.AddrIPv4 == nil && entry.AddrIPv6 == nil {
 		return nil, fmt.Errorf("could not determine host IP addresses")
 	}
+	if conf.unicastDNS != "" && !isLocalDomain(entry.Domain) {
+		return registerUnicast(entry, conf)
+	}
 
-	s, err := newServer(ifaces)
+	s, err := newServer(ifaces, conf)
 	if err != nil {
 		return nil, err
 	}
+	s.selectInterfaces(selectedIfaces)
+	s.ownAddrs = true
 
 	s.service = entry
-	go s.mainloop()
-	go s.probe()
+	s.probing[entry] = make(chan struct{}, 1)
+	s.mainloop()
+	s.background(func() { s.probe(entry) })
 
 	return s, nil
 }
 
+// RegisterContext registers a service like Register, but returns only once the
+// service has been announced on all interfaces, i.e. once probing for its name
+// finished and the first announcement has been sent. If ctx expires before,
+// the server is shut down and the error of ctx is returned.
+func RegisterContext(ctx context.Context, instance, service, domain string, port int, text []string, ifaces []net.Interface, opts ...RegisterOption) (*Server, error) {
+	s, err := Register(instance, service, domain, port, text, ifaces, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.unicast {
+		// The DNS update has been acknowledged already.
+		return s, nil
+	}
+	select {
+	case <-s.announced:
+		return s, nil
+	case <-ctx.Done():
+		s.Shutdown()
+		return nil, ctx.Err()
+	}
+}
+
+// RegisterWithConflictResolution registers a service on all multicast
+// interfaces like RegisterContext, and returns the instance name finally
+// claimed along with the server. The name is probed for even if WithoutProbing
+// is passed, and renamed on conflicts the way Bonjour does, e.g. "My Printer"
+// becomes "My Printer (2)". If ctx expires before the name has been claimed,
+// the error of ctx is returned, i.e. context.DeadlineExceeded on a timeout.
+func RegisterWithConflictResolution(ctx context.Context, instance, service, domain string, port int, text []string, opts ...RegisterOption) (*Server, string, error) {
+	opts = append(opts[:len(opts):len(opts)], func(o *serverOpts) {
+		o.disableProbing = false
+	})
+	s, err := RegisterContext(ctx, instance, service, domain, port, text, nil, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	return s, s.Instance(), nil
+}
+
 // RegisterProxy registers a service proxy. This call will skip the hostname/IP lookup and
 // will use the provided values.
-func RegisterProxy(instance, service, domain string, port int, host string, ips []string, text []string, ifaces []net.Interface) (*Server, error) {
-	entry := NewServiceEntry(instance, service, domain)
-	entry.Port = port
-	entry.Text = text
-	entry.HostName = host
+func RegisterProxy(instance, service, domain string, port int, host string, ips []string, text []string, ifaces []net.Interface, opts ...RegisterOption) (*Server, error) {
+	var addrs []net.IP
+	for _, ip := range ips {
+		ipAddr := net.ParseIP(ip)
+		if ipAddr == nil {
+			return nil, fmt.Errorf("failed to parse given IP: %v", ip)
+		}
+		addrs = append(addrs, ipAddr)
+	}
+	return RegisterProxyAddrs(instance, service, domain, port, host, addrs, text, ifaces, opts...)
+}
 
-	if entry.Instance == "" {
-		return nil, fmt.Errorf("missing service instance name")
+// RegisterProxyAddrs registers a service proxy like RegisterProxy, but takes the
+// addresses of the host as net.IP. The server publishes exactly these
+// addresses as A and AAAA records of the host.
+func RegisterProxyAddrs(instance, service, domain string, port int, host string, ips []net.IP, text []string, ifaces []net.Interface, opts ...RegisterOption) (*Server, error) {
+	conf, err := applyRegisterOptions(opts)
+	if err != nil {
+		return nil, err
 	}
-	if entry.Service == "" {
-		return nil, fmt.Errorf("missing service name")
+	entry, err := newRegistrationEntry(instance, service, domain, port, text)
+	if err != nil {
+		return nil, err
 	}
+	entry.addSubtypes(conf.subtypes)
+	entry.Text = append(entry.Text, conf.text...)
+	entry.Priority = conf.srvPriority
+	entry.Weight = conf.srvWeight
+	entry.HostName = host
+
 	if entry.HostName == "" {
 		return nil, fmt.Errorf("missing host name")
 	}
 	if entry.Domain == "" {
 		entry.Domain = "local"
 	}
-	if entry.Port == 0 {
-		return nil, fmt.Errorf("missing port")
-	}
 
-	if !strings.HasSuffix(trimDot(entry.HostName), entry.Domain) {
+	if !strings.HasSuffix(trimDot(entry.HostName), trimDot(entry.Domain)) {
 		entry.HostName = fmt.Sprintf("%s.%s.", trimDot(entry.HostName), trimDot(entry.Domain))
 	}
 
-	for _, ip := range ips {
-		ipAddr := net.ParseIP(ip)
-		if ipAddr == nil {
-			return nil, fmt.Errorf("failed to parse given IP: %v", ip)
-		} else if ipv4 := ipAddr.To4(); ipv4 != nil {
-			entry.AddrIPv4 = append(entry.AddrIPv4, ipAddr)
+	for _, ipAddr := range ips {
+		if ipv4 := ipAddr.To4(); ipv4 != nil {
+			entry.AddrIPv4 = append(entry.AddrIPv4, ipv4)
 		} else if ipv6 := ipAddr.To16(); ipv6 != nil {
-			entry.AddrIPv6 = append(entry.AddrIPv6, ipAddr)
+			entry.AddrIPv6 = append(entry.AddrIPv6, ipv6)
 		} else {
 			return nil, fmt.Errorf("the IP is neither IPv4 nor IPv6: %#v", ipAddr)
 		}
 	}
+	if conf.unicastDNS != "" && !isLocalDomain(entry.Domain) {
+		return registerUnicast(entry, conf)
+	}
 
+	selectedIfaces := ifaces
 	if len(ifaces) == 0 {
 		ifaces = listMulticastInterfaces()
 	}
 
-	s, err := newServer(ifaces)
+	s, err := newServer(ifaces, conf)
 	if err != nil {
 		return nil, err
 	}
+	s.selectInterfaces(selectedIfaces)
 
 	s.service = entry
-	go s.mainloop()
-	go s.probe()
+	s.probing[entry] = make(chan struct{}, 1)
+	s.mainloop()
+	s.background(func() { s.probe(entry) })
 
 	return s, nil
 }
 
+// newRegistrationEntry constructs and validates the ServiceEntry of a service
+// to be registered.
+func newRegistrationEntry(instance, service, domain string, port int, text []string) (*ServiceEntry, error) {
+	entry := NewServiceEntry(instance, service, domain)
+	entry.Port = port
+	entry.Text = splitText(text)
+
+	if entry.Instance == "" {
+		return nil, fmt.Errorf("missing service instance name")
+	}
+	if entry.Service == "" {
+		return nil, fmt.Errorf("missing service name")
+	}
+	if entry.Port == 0 {
+		return nil, fmt.Errorf("missing port")
+	}
+	return entry, nil
+}
+
 const (
 	qClassCacheFlush uint16 = 1 << 15
 )
 
+// uniqueClass returns the class of unique records, i.e. all but PTR records.
+// It has the cache-flush bit set unless disabled.
+func (s *Server) uniqueClass() uint16 {
+	// From RFC6762
+	//    The cache-flush bit MUST NOT be set in any resource records in a
+	//    response message sent in legacy unicast responses to UDP ports other
+	//    than 5353. [...] The cache-flush bit MUST NOT be set in any resource
+	//    records in the Known-Answer list of any query message.
+	//    [...] shared resource record sets MUST NOT have the cache-flush bit
+	//    set.
+	if s.opts.disableCacheFlush {
+		return dns.ClassINET
+	}
+	return dns.ClassINET | qClassCacheFlush
+}
+
 // Server structure encapsulates both IPv4/IPv6 UDP connections
 type Server struct {
-	service  *ServiceEntry
-	ipv4conn *ipv4.PacketConn
-	ipv6conn *ipv6.PacketConn
-	ifaces   []net.Interface
-
-	shouldShutdown chan struct{}
+	stats stats // first for the alignment of its 64-bit counters
+
+	service  *ServiceEntry                   // service passed to Register
+	services []*ServiceEntry                 // all published services, guarded by mu
+	probing  map[*ServiceEntry]chan struct{} // services probed for, signals conflicts
+	paused   bool                            // see Pause, guarded by mu
+	mu       sync.RWMutex
+	ipv4conn ipv4Conn
+	ipv6conn ipv6Conn
+	opts     serverOpts
+
+	ifaces      []net.Interface // guarded by ifacesLock
+	ifacesState string          // see interfacesState
+	ifacesLock  sync.RWMutex
+	ifaceNames  []string // interfaces selected on registration, if any
+	ownAddrs    bool     // the host addresses are the interface addresses
+	unicast     bool     // registered by a unicast DNS update
+	refreshLock sync.Mutex
+	pauseLock   sync.Mutex // serializes Pause and Resume
+
+	// The background goroutines are tied to ctx, which Shutdown cancels,
+	// and counted by shutdownEnd, which Shutdown waits for.
+	ctx            context.Context
+	cancel         context.CancelFunc
+	shouldShutdown <-chan struct{} // ctx.Done()
 	shutdownLock   sync.Mutex
 	shutdownEnd    sync.WaitGroup
+	backgroundLock sync.Mutex // orders starting goroutines before cancel
 	isShutdown     bool
 	ttl            uint32
+
+	lastMulticast     map[string]time.Time // by interface and record
+	lastMulticastLock sync.Mutex
+
+	truncated     map[string]*dns.Msg // truncated queries by source address
+	truncatedLock sync.Mutex
+
+	queryBuckets     map[string]*tokenBucket // by source IP, see WithQueryRateLimit
+	queryBucketsLock sync.Mutex
+
+	announced     chan struct{} // closed once service has been announced
+	announcedOnce sync.Once
+
+	rand     *rand.Rand // see randInt63n
+	randLock sync.Mutex
 }
 
 // Constructs server structure
-func newServer(ifaces []net.Interface) (*Server, error) {
-	ipv4conn, err4 := joinUdp4Multicast(ifaces)
-	if err4 != nil {
-		log.Printf("[zeroconf] no suitable IPv4 interface: %s", err4.Error())
-	}
-	ipv6conn, err6 := joinUdp6Multicast(ifaces)
-	if err6 != nil {
-		log.Printf("[zeroconf] no suitable IPv6 interface: %s", err6.Error())
+func newServer(ifaces []net.Interface, opts serverOpts) (*Server, error) {
+	var ipv4conn ipv4Conn
+	var ipv6conn ipv6Conn
+	var connErr error
+	// The state describes the interfaces listed rather than the ones joined,
+	// so that failing ones aren't taken for changes by RefreshInterfaces.
+	state := interfacesState(ifaces)
+	if opts.conn4 != nil || opts.conn6 != nil {
+		if opts.conn4 != nil {
+			ipv4conn = userConn4{opts.conn4}
+		}
+		if opts.conn6 != nil {
+			ipv6conn = userConn6{opts.conn6}
+		}
+	} else {
+		var joined []net.Interface
+		if opts.ipVersion&IPv4 > 0 {
+			if c, joined4, err := joinUdp4Multicast(ifaces, opts.groups, opts.hopLimit, !opts.exclusive, opts.logger); err != nil {
+				connErr = err
+				opts.logger.Printf("[zeroconf] no suitable IPv4 interface: %s", err.Error())
+			} else {
+				if opts.noLoopback {
+					if err := c.SetMulticastLoopback(false); err != nil {
+						opts.logger.Printf("[zeroconf] failed to disable IPv4 multicast loopback: %s", err.Error())
+					}
+				}
+				if opts.requireTTL {
+					if err := c.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+						opts.logger.Printf("[zeroconf] failed to receive the IPv4 TTL: %s", err.Error())
+					}
+				}
+				ipv4conn = c
+				joined = joined4
+			}
+		}
+		if opts.ipVersion&IPv6 > 0 {
+			if c, joined6, err := joinUdp6Multicast(ifaces, opts.groups, opts.hopLimit, !opts.exclusive, opts.logger); err != nil {
+				if connErr == nil {
+					connErr = err
+				}
+				opts.logger.Printf("[zeroconf] no suitable IPv6 interface: %s", err.Error())
+			} else {
+				if opts.noLoopback {
+					if err := c.SetMulticastLoopback(false); err != nil {
+						opts.logger.Printf("[zeroconf] failed to disable IPv6 multicast loopback: %s", err.Error())
+					}
+				}
+				if opts.requireTTL {
+					if err := c.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+						opts.logger.Printf("[zeroconf] failed to receive the IPv6 hop limit: %s", err.Error())
+					}
+				}
+				ipv6conn = c
+				joined = mergeInterfaces(joined, joined6)
+			}
+		}
+		ifaces = joined
 	}
-	if err4 != nil && err6 != nil {
+	switch {
+	case ipv4conn == nil && ipv6conn == nil:
 		// No supported interface left.
-		return nil, fmt.Errorf("no supported interface")
+		return nil, connErr
+	case connErr != nil && ipv4conn == nil:
+		opts.logger.Printf("[zeroconf] IPv4 unavailable, using IPv6 only")
+	case connErr != nil && ipv6conn == nil:
+		opts.logger.Printf("[zeroconf] IPv6 unavailable, using IPv4 only")
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &Server{
 		ipv4conn:       ipv4conn,
 		ipv6conn:       ipv6conn,
 		ifaces:         ifaces,
-		ttl:            3200,
-		shouldShutdown: make(chan struct{}),
+		ifacesState:    state,
+		opts:           opts,
+		probing:        make(map[*ServiceEntry]chan struct{}),
+		ttl:            opts.ttl,
+		ctx:            ctx,
+		cancel:         cancel,
+		shouldShutdown: ctx.Done(),
+		lastMulticast:  make(map[string]time.Time),
+		truncated:      make(map[string]*dns.Msg),
+		announced:      make(chan struct{}),
 	}
 
 	return s, nil
 }
 
-// Start listeners and waits for the shutdown signal from exit channel
+// mainloop starts the listeners, which run until the server is shut down.
 func (s *Server) mainloop() {
+	// Count the listeners right away, so that a shutdown right after
+	// registering waits for them.
 	if s.ipv4conn != nil {
-		go s.recv4(s.ipv4conn)
+		s.shutdownEnd.Add(1)
+		go s.recv(s.ipv4conn)
 	}
 	if s.ipv6conn != nil {
-		go s.recv6(s.ipv6conn)
+		s.shutdownEnd.Add(1)
+		go s.recv(s.ipv6conn)
+	}
+	if s.opts.watchInterval > 0 {
+		s.background(s.watchInterfaces)
 	}
 }
 
-// Shutdown closes all udp connections and unregisters the service
-func (s *Server) Shutdown() {
-	s.shutdown()
+// background runs f in a goroutine which Shutdown waits for. f must return
+// once shouldShutdown is closed. Nothing is started once the server is
+// shutting down.
+func (s *Server) background(f func()) {
+	s.backgroundLock.Lock()
+	defer s.backgroundLock.Unlock()
+	select {
+	case <-s.shouldShutdown:
+		return
+	default:
+	}
+	s.shutdownEnd.Add(1)
+	go func() {
+		defer s.shutdownEnd.Done()
+		f()
+	}()
 }
 
-// SetText updates and announces the TXT records
-func (s *Server) SetText(text []string) {
-	s.service.Text = text
-	s.announceText()
+// selectInterfaces remembers the interfaces selected on registration, which
+// are looked up by name on refreshes. Otherwise, all multicast interfaces are
+// used.
+func (s *Server) selectInterfaces(ifaces []net.Interface) {
+	for _, iface := range ifaces {
+		s.ifaceNames = append(s.ifaceNames, iface.Name)
+	}
 }
 
-// TTL sets the TTL for DNS replies
-func (s *Server) TTL(ttl uint32) {
-	s.ttl = ttl
+// interfaces returns a snapshot of the interfaces in use.
+func (s *Server) interfaces() []net.Interface {
+	s.ifacesLock.RLock()
+	defer s.ifacesLock.RUnlock()
+	return s.ifaces
 }
 
-// Shutdown server will close currently open connections & channel
-func (s *Server) shutdown() error {
-	s.shutdownLock.Lock()
-	defer s.shutdownLock.Unlock()
-	if s.isShutdown {
-		return errors.New("server is already shutdown")
-	}
-
-	err := s.unregister()
-
-	close(s.shouldShutdown)
+// Interfaces returns the interfaces the server currently answers on, i.e. the
+// selected ones, or all multicast interfaces, that joined the mDNS group. They
+// change with RefreshInterfaces.
+func (s *Server) Interfaces() []net.Interface {
+	return append([]net.Interface(nil), s.interfaces()...)
+}
 
-	if s.ipv4conn != nil {
-		s.ipv4conn.Close()
+// RefreshInterfaces updates the interfaces in use after the network
+// configuration changed, e.g. when switching from Ethernet to Wi-Fi. New
+// interfaces are joined, gone ones are left, and the services are announced
+// again. Unless registered as a proxy, the host's addresses are updated as
+// well.
+func (s *Server) RefreshInterfaces() error {
+	s.refreshLock.Lock()
+	defer s.refreshLock.Unlock()
+
+	var ifaces []net.Interface
+	if len(s.ifaceNames) > 0 {
+		ifaces = filterMulticastInterfaces(interfacesByName(s.ifaceNames, s.opts.logger), s.opts.logger)
+	} else {
+		ifaces = listMulticastInterfaces()
 	}
-	if s.ipv6conn != nil {
+	state := interfacesState(ifaces)
+	s.ifacesLock.Lock()
+	if state == s.ifacesState {
+		s.ifacesLock.Unlock()
+		return nil
+	}
+	old := s.ifaces
+	s.ifacesState = state
+	s.ifacesLock.Unlock()
+
+	for _, iface := range old {
+		if !containsInterface(ifaces, iface) {
+			s.leaveGroups(iface)
+		}
+	}
+	var joined []net.Interface
+	for _, iface := range ifaces {
+		if containsInterface(old, iface) || s.joinGroups(iface) {
+			joined = append(joined, iface)
+		}
+	}
+	ifaces = joined
+	s.ifacesLock.Lock()
+	s.ifaces = ifaces
+	s.ifacesLock.Unlock()
+
+	if s.ownAddrs {
+		v4, v6 := addrsForInterfaces(ifaces)
+		s.mu.Lock()
+		host := s.service.HostName
+		for _, e := range s.allServices() {
+			if e.HostName == host {
+				e.AddrIPv4, e.AddrIPv6 = v4, v6
+			}
+		}
+		s.mu.Unlock()
+	}
+	if len(ifaces) == 0 {
+		return ErrNoInterfaces
+	}
+
+	for _, entry := range s.registeredServices() {
+		entry := entry
+		s.background(func() { s.announce(entry) })
+	}
+	return nil
+}
+
+// watchInterfaces refreshes the interfaces periodically until shutdown.
+func (s *Server) watchInterfaces() {
+	ticker := time.NewTicker(s.opts.watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.RefreshInterfaces(); err != nil {
+				s.opts.logger.Printf("[WARN] zeroconf: failed to refresh interfaces: %v", err)
+			}
+		case <-s.shouldShutdown:
+			return
+		}
+	}
+}
+
+// joinGroups joins the multicast groups on a new interface. It reports whether
+// the group of any IP version could be joined.
+func (s *Server) joinGroups(iface net.Interface) bool {
+	var joined bool
+	if s.ipv4conn != nil {
+		// The group might have been joined on the interface before.
+		if err := s.ipv4conn.JoinGroup(&iface, &net.UDPAddr{IP: s.opts.groups.ipv4}); err != nil && !errors.Is(err, syscall.EADDRINUSE) {
+			s.opts.logger.Printf("[WARN] zeroconf: failed to join IPv4 group on %s: %v", iface.Name, err)
+		} else {
+			joined = true
+		}
+	}
+	if s.ipv6conn != nil {
+		if err := s.ipv6conn.JoinGroup(&iface, &net.UDPAddr{IP: s.opts.groups.ipv6}); err != nil && !errors.Is(err, syscall.EADDRINUSE) {
+			s.opts.logger.Printf("[WARN] zeroconf: failed to join IPv6 group on %s: %v", iface.Name, err)
+		} else {
+			joined = true
+		}
+	}
+	return joined
+}
+
+// leaveGroups leaves the multicast groups on an interface which is gone.
+// Errors are ignored, as the interface might not exist anymore.
+func (s *Server) leaveGroups(iface net.Interface) {
+	if s.ipv4conn != nil {
+		s.ipv4conn.LeaveGroup(&iface, &net.UDPAddr{IP: s.opts.groups.ipv4})
+	}
+	if s.ipv6conn != nil {
+		s.ipv6conn.LeaveGroup(&iface, &net.UDPAddr{IP: s.opts.groups.ipv6})
+	}
+}
+
+// Shutdown unregisters the services and closes all udp connections. It
+// returns once the goodbye packets are sent.
+func (s *Server) Shutdown() {
+	s.shutdown(context.Background())
+}
+
+// ShutdownContext unregisters the services like Shutdown, but waits for the
+// goodbye packets to be sent only until ctx expires. It returns ctx's error in
+// that case, or the error of sending a goodbye packet, if any. The
+// connections are closed in either case.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	return s.shutdown(ctx)
+}
+
+// ServiceHandle identifies a service added to a Server by AddService.
+type ServiceHandle struct {
+	entry *ServiceEntry
+}
+
+// AddService registers another service on the server. It shares the
+// connections as well as the host name and addresses with the service passed
+// to Register or RegisterProxy. The returned handle can be used to remove the
+// service again.
+func (s *Server) AddService(instance, service, domain string, port int, text []string) (*ServiceHandle, error) {
+	entry, err := newRegistrationEntry(instance, service, domain, port, text)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Domain == "" {
+		entry.Domain = s.service.Domain
+	}
+	entry.Priority = s.opts.srvPriority
+	entry.Weight = s.opts.srvWeight
+
+	s.mu.Lock()
+	entry.HostName = s.service.HostName
+	entry.AddrIPv4 = s.service.AddrIPv4
+	entry.AddrIPv6 = s.service.AddrIPv6
+	for _, e := range s.allServices() {
+		if e.ServiceInstanceName() == entry.ServiceInstanceName() {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("service instance %s already registered", entry.ServiceInstanceName())
+		}
+	}
+	s.probing[entry] = make(chan struct{}, 1)
+	s.mu.Unlock()
+
+	s.background(func() { s.probe(entry) })
+
+	return &ServiceHandle{entry: entry}, nil
+}
+
+// RemoveService unregisters a service added by AddService and sends goodbye
+// packets for its records.
+func (s *Server) RemoveService(h *ServiceHandle) error {
+	s.mu.Lock()
+	if _, ok := s.probing[h.entry]; ok {
+		// Not announced yet, no need to say goodbye.
+		delete(s.probing, h.entry)
+		s.mu.Unlock()
+		return nil
+	}
+	var found bool
+	for i, e := range s.services {
+		if e == h.entry {
+			s.services = append(s.services[:i], s.services[i+1:]...)
+			found = true
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !found {
+		return errors.New("service is not registered")
+	}
+
+	var err error
+	for i := 0; i < goodbyeRepetitions; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(goodbyeInterval):
+			case <-s.shouldShutdown:
+				// The shutdown says goodbye for all services.
+				return err
+			}
+		}
+		for _, intf := range s.interfaces() {
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			resp.Answer = []dns.RR{}
+			resp.Extra = []dns.RR{}
+			s.mu.RLock()
+			s.composeLookupAnswers(resp, h.entry, 0, intf.Index)
+			s.mu.RUnlock()
+			// The host's address records remain valid as long as other
+			// services still refer to them, and the service type as long
+			// as other instances of it remain.
+			if s.hasHost(h.entry.HostName) {
+				resp.Answer = withoutAddrs(resp.Answer)
+			}
+			if s.hasServiceType(h.entry.ServiceName()) {
+				resp.Answer = withoutServiceTypePTR(resp.Answer, h.entry)
+			}
+			if e := s.sendResponse(resp, intf.Index, nil); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// hasHost reports whether any registered service is hosted on the given host.
+func (s *Server) hasHost(host string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.services {
+		if e.HostName == host {
+			return true
+		}
+	}
+	return false
+}
+
+// hasServiceType reports whether any registered service is an instance of the
+// given service, e.g. "_http._tcp.local.".
+func (s *Server) hasServiceType(service string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.services {
+		if strings.EqualFold(e.ServiceName(), service) {
+			return true
+		}
+	}
+	return false
+}
+
+// allServices returns the published services as well as those probed for.
+// The caller must hold mu.
+func (s *Server) allServices() []*ServiceEntry {
+	all := append([]*ServiceEntry(nil), s.services...)
+	for e := range s.probing {
+		all = append(all, e)
+	}
+	return all
+}
+
+// Instance returns the instance name of the service passed to Register. It
+// differs from the requested name if probing detected a conflict.
+func (s *Server) Instance() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.service.Instance
+}
+
+// registeredServices returns a snapshot of the published services.
+func (s *Server) registeredServices() []*ServiceEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*ServiceEntry(nil), s.services...)
+}
+
+// Services returns a snapshot of the services the server announces, i.e. the
+// service passed to Register or RegisterProxy and the ones added by
+// AddService, once probing for their names finished. It is safe to call while
+// the server is running.
+func (s *Server) Services() []*ServiceEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	services := make([]*ServiceEntry, len(s.services))
+	for i, e := range s.services {
+		services[i] = e.clone()
+	}
+	return services
+}
+
+// Stats returns a snapshot of the server's counters.
+func (s *Server) Stats() Stats {
+	return s.stats.snapshot()
+}
+
+// SetText updates and announces the TXT records of the service passed to
+// Register or RegisterProxy. It is safe to call while the server is running.
+func (s *Server) SetText(text []string) {
+	s.mu.Lock()
+	text = splitText(text)
+	s.service.Text = text
+	_, probing := s.probing[s.service]
+	s.mu.Unlock()
+	if probing {
+		// The new text is announced once probing finished.
+		return
+	}
+
+	s.announceText(s.service)
+	// Repeat the announcement in case the first one got lost, unless the
+	// text has been changed once more in the meantime.
+	s.background(func() {
+		select {
+		case <-time.After(time.Second):
+		case <-s.shouldShutdown:
+			return
+		}
+		s.mu.RLock()
+		changed := !equalText(s.service.Text, text)
+		s.mu.RUnlock()
+		if !changed {
+			s.announceText(s.service)
+		}
+	})
+}
+
+// AddSubtype adds a subtype, e.g. _duplex, to the service passed to Register
+// or RegisterProxy and announces its PTR record. It is safe to call while the
+// server is running.
+func (s *Server) AddSubtype(subtype string) error {
+	s.mu.Lock()
+	n := len(s.service.Subtypes)
+	s.service.addSubtypes([]string{subtype})
+	if len(s.service.Subtypes) == n {
+		s.mu.Unlock()
+		return nil
+	}
+	name := s.service.Subtypes[n]
+	_, probing := s.probing[s.service]
+	s.mu.Unlock()
+	if probing {
+		// The subtype is announced once probing finished.
+		return nil
+	}
+	return s.announceSubtype(name, s.ttl)
+}
+
+// RemoveSubtype removes a subtype from the service passed to Register or
+// RegisterProxy and sends a goodbye for its PTR record, while the service
+// stays registered. It is safe to call while the server is running.
+func (s *Server) RemoveSubtype(subtype string) error {
+	s.mu.Lock()
+	name := fmt.Sprintf("%s._sub.%s", trimDot(subtype), s.service.ServiceName())
+	var subtypes []string
+	for _, existing := range s.service.Subtypes {
+		if existing != name {
+			subtypes = append(subtypes, existing)
+		}
+	}
+	if len(subtypes) == len(s.service.Subtypes) {
+		s.mu.Unlock()
+		return fmt.Errorf("subtype %s is not registered", subtype)
+	}
+	s.service.Subtypes = subtypes
+	_, probing := s.probing[s.service]
+	s.mu.Unlock()
+	if probing {
+		return nil
+	}
+	return s.announceSubtype(name, 0)
+}
+
+// announceSubtype announces the PTR record of the subtype with the given name,
+// or sends a goodbye for it if ttl is 0.
+func (s *Server) announceSubtype(name string, ttl uint32) error {
+	s.mu.RLock()
+	ptr := &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ptr: s.service.ServiceInstanceName(),
+	}
+	domain := s.service.Domain
+	paused := s.paused
+	s.mu.RUnlock()
+	if paused {
+		// The subtypes are announced on Resume.
+		return nil
+	}
+	if s.unicast {
+		return s.exchangeUpdate(context.Background(), domain, []dns.RR{ptr}, ttl == 0)
+	}
+
+	resp := new(dns.Msg)
+	resp.MsgHdr.Response = true
+	resp.Answer = []dns.RR{ptr}
+	err := s.multicastResponse(resp, 0)
+	// Repeat the announcement in case the first one got lost, unless the
+	// subtype has been added or removed once more in the meantime.
+	s.background(func() {
+		select {
+		case <-time.After(time.Second):
+		case <-s.shouldShutdown:
+			return
+		}
+		s.mu.RLock()
+		var present bool
+		for _, subtype := range s.service.Subtypes {
+			present = present || subtype == name
+		}
+		s.mu.RUnlock()
+		if present == (ttl > 0) && !s.isPaused() {
+			s.multicastResponse(resp, 0)
+		}
+	})
+	return err
+}
+
+// equalText reports whether the TXT strings a and b are the same.
+func equalText(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TTL sets the TTL for DNS replies, except for the records containing a host
+// name, see WithTTL.
+func (s *Server) TTL(ttl uint32) {
+	s.ttl = ttl
+}
+
+// Shutdown server will close currently open connections & channel
+func (s *Server) shutdown(ctx context.Context) error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.isShutdown {
+		return errors.New("server is already shutdown")
+	}
+
+	// Stop answering queries and the background goroutines before saying
+	// goodbye.
+	s.backgroundLock.Lock()
+	s.cancel()
+	s.backgroundLock.Unlock()
+
+	var err error
+	switch {
+	case s.isPaused():
+		// The goodbyes have been sent by Pause.
+	case s.unicast:
+		err = s.updateUnicast(ctx, s.service, true)
+	default:
+		err = s.unregister(ctx)
+	}
+
+	if s.ipv4conn != nil {
+		s.ipv4conn.Close()
+	}
+	if s.ipv6conn != nil {
 		s.ipv6conn.Close()
 	}
 
@@ -233,213 +1403,775 @@ func (s *Server) shutdown() error {
 }
 
 // recv is a long running routine to receive packets from an interface
-func (s *Server) recv4(c *ipv4.PacketConn) {
-	if c == nil {
-		return
-	}
-	buf := make([]byte, 65536)
-	s.shutdownEnd.Add(1)
+func (s *Server) recv(c interface{}) {
+	read, release := newPacketReader(c)
+	defer release()
 	defer s.shutdownEnd.Done()
+	msg := new(dns.Msg)
 	for {
 		select {
 		case <-s.shouldShutdown:
 			return
 		default:
-			var ifIndex int
-			n, cm, from, err := c.ReadFrom(buf)
+			packets, err := read()
 			if err != nil {
+				if isUserConn(c) && !isTimeout(err) {
+					// The caller owns the connection, it won't
+					// recover once closed.
+					if s.ctx.Err() == nil {
+						s.opts.logger.Printf("[ERR] zeroconf: failed to receive: %v", err)
+					}
+					return
+				}
 				continue
 			}
-			if cm != nil {
-				ifIndex = cm.IfIndex
+			for _, p := range packets {
+				if s.opts.requireTTL && offLink(p.ttl) {
+					atomic.AddUint64(&s.stats.packetsReceived, 1)
+					atomic.AddUint64(&s.stats.droppedPackets, 1)
+					continue
+				}
+				if s.parsePacket(msg, p.data, p.ifIndex, p.src) {
+					// Still referenced, continue with a new message.
+					msg = new(dns.Msg)
+				}
 			}
-			_ = s.parsePacket(buf[:n], ifIndex, from)
 		}
 	}
 }
 
-// recv is a long running routine to receive packets from an interface
-func (s *Server) recv6(c *ipv6.PacketConn) {
-	if c == nil {
-		return
+// parsePacket is used to parse an incoming packet into msg, which is reused
+// for the next packet unless parsePacket reports that it is still referenced:
+// packet hooks may hold on to it, and truncated queries are answered later.
+// Unpacking allocates new sections, so the records of a reused message remain
+// intact.
+func (s *Server) parsePacket(msg *dns.Msg, packet []byte, ifIndex int, from net.Addr) (kept bool) {
+	atomic.AddUint64(&s.stats.packetsReceived, 1)
+	if err := msg.Unpack(packet); err != nil {
+		atomic.AddUint64(&s.stats.malformedPackets, 1)
+		s.opts.logger.Printf("[ERR] zeroconf: failed to unpack packet: %v", err)
+		return false
+	}
+	kept = s.opts.packetHook != nil
+	if kept {
+		s.opts.packetHook(msg, from, false)
+	}
+	if msg.Response {
+		s.handleResponse(msg)
+		return kept
+	}
+	_ = s.handleQuery(msg, ifIndex, from)
+	return kept || msg.Truncated
+}
+
+// handleResponse checks responses of other hosts for records conflicting with
+// the instance names currently probed for, or with the services published.
+func (s *Server) handleResponse(resp *dns.Msg) {
+	var conflicts []string
+	s.mu.RLock()
+	for entry, conflict := range s.probing {
+		for _, rr := range resp.Answer {
+			if isConflicting(entry, rr) {
+				select {
+				case conflict <- struct{}{}:
+				default:
+				}
+				break
+			}
+		}
+	}
+	if s.opts.conflictHandler != nil {
+		// Instead of probing again as RFC6762 section 9 suggests, late
+		// conflicts are left to the handler.
+		for _, entry := range s.services {
+			for _, rr := range resp.Answer {
+				if isConflicting(entry, rr) {
+					conflicts = append(conflicts, rr.Header().Name)
+					break
+				}
+			}
+		}
+	}
+	s.mu.RUnlock()
+	for _, name := range conflicts {
+		go s.opts.conflictHandler(name)
+	}
+}
+
+// isConflicting reports whether rr claims the instance name of entry with
+// different data.
+func isConflicting(entry *ServiceEntry, rr dns.RR) bool {
+	hdr := rr.Header()
+	if hdr.Ttl == 0 || !strings.EqualFold(hdr.Name, entry.ServiceInstanceName()) {
+		// Goodbye packets do not claim anything.
+		return false
+	}
+	switch rr := rr.(type) {
+	case *dns.SRV:
+		return !strings.EqualFold(rr.Target, entry.HostName) || int(rr.Port) != entry.Port
+	case *dns.TXT:
+		if len(rr.Txt) != len(entry.Text) {
+			return true
+		}
+		for i := range rr.Txt {
+			if rr.Txt[i] != entry.Text[i] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleQuery is used to handle an incoming query
+func (s *Server) handleQuery(query *dns.Msg, ifIndex int, from net.Addr) error {
+	if s.isPaused() {
+		return nil
+	}
+	if !s.allowQuery(from, time.Now()) {
+		atomic.AddUint64(&s.stats.queriesRateLimited, 1)
+		return nil
+	}
+	if !s.collectKnownAnswers(query, ifIndex, from) {
+		return nil
+	}
+	return s.answerQuery(query, ifIndex, from)
+}
+
+// tokenBucket holds the tokens left for the queries of a source address.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxQueryBuckets is the number of source addresses tracked before the ones
+// with a full bucket are forgotten.
+const maxQueryBuckets = 1024
+
+// allowQuery reports whether a query from the given address is within the
+// rate limit, taking a token from its bucket if so.
+func (s *Server) allowQuery(from net.Addr, now time.Time) bool {
+	if s.opts.queryRate == 0 {
+		return true
+	}
+	udpAddr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+	key := udpAddr.IP.String()
+	burst := float64(s.opts.queryBurst)
+
+	s.queryBucketsLock.Lock()
+	defer s.queryBucketsLock.Unlock()
+	if s.queryBuckets == nil {
+		s.queryBuckets = make(map[string]*tokenBucket)
+	}
+	if len(s.queryBuckets) >= maxQueryBuckets {
+		for k, b := range s.queryBuckets {
+			if b.tokens+now.Sub(b.last).Seconds()*s.opts.queryRate >= burst {
+				delete(s.queryBuckets, k)
+			}
+		}
 	}
-	buf := make([]byte, 65536)
+	b, ok := s.queryBuckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		s.queryBuckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * s.opts.queryRate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// collectKnownAnswers merges queries whose Known-Answer list spans multiple
+// packets. It returns false if the query is held back until the remaining
+// packets arrived, in which case it is answered later.
+func (s *Server) collectKnownAnswers(query *dns.Msg, ifIndex int, from net.Addr) bool {
+	// From RFC6762
+	//    If the TC bit is set, the responder SHOULD delay its response by a
+	//    random amount in the range 400-500 ms, to allow the querier time to
+	//    send additional Known-Answer packets.
+	if from == nil {
+		return true
+	}
+	key := from.String()
+
+	s.truncatedLock.Lock()
+	defer s.truncatedLock.Unlock()
+	// Only packets without questions continue a query, RFC6762 section 7.2.
+	// Any other packet is a new query, answered independently.
+	if pending, ok := s.truncated[key]; ok && len(query.Question) == 0 {
+		pending.Answer = append(pending.Answer, query.Answer...)
+		return false
+	}
+	if !query.Truncated {
+		return true
+	}
+	s.truncated[key] = query
+	delay := knownAnswersDelay + time.Duration(s.randInt63n(int64(knownAnswersJitter)))
 	s.shutdownEnd.Add(1)
-	defer s.shutdownEnd.Done()
-	for {
-		select {
-		case <-s.shouldShutdown:
-			return
-		default:
-			var ifIndex int
-			n, cm, from, err := c.ReadFrom(buf)
-			if err != nil {
-				continue
+	time.AfterFunc(delay, func() {
+		defer s.shutdownEnd.Done()
+		s.truncatedLock.Lock()
+		if s.truncated[key] == query {
+			delete(s.truncated, key)
+		}
+		s.truncatedLock.Unlock()
+		s.answerQuery(query, ifIndex, from)
+	})
+	return false
+}
+
+// answerQuery responds to the questions of a (reassembled) query. The answers
+// to all questions are combined into a single unicast and a single multicast
+// response, as encouraged by RFC6762 section 6.4.
+func (s *Server) answerQuery(query *dns.Msg, ifIndex int, from net.Addr) error {
+	select {
+	case <-s.shouldShutdown:
+		// Shutting down, the records are about to be unregistered.
+		return nil
+	default:
+	}
+
+	// Probe queries carry the records to be claimed in the authority
+	// section. They are answered right away to defend our names.
+	isProbe := len(query.Ns) > 0
+	legacy := s.isLegacyQuery(from)
+
+	unicastResp, multicastResp := newResponse(query), newResponse(query)
+	var unicastAnswered, multicastAnswered uint64
+	var err error
+	for _, q := range query.Question {
+		resp := newResponse(query)
+		if err = s.handleQuestion(q, resp, query, ifIndex); err != nil {
+			// log.Printf("[ERR] zeroconf: failed to handle question %v: %v", q, err)
+			continue
+		}
+		if !isProbe {
+			n := len(resp.Answer)
+			resp.Answer = suppressKnownAnswers(resp.Answer, query.Answer)
+			if n > 0 && len(resp.Answer) == 0 {
+				atomic.AddUint64(&s.stats.queriesSuppressed, 1)
 			}
-			if cm != nil {
-				ifIndex = cm.IfIndex
+		}
+		// Check if there is an answer
+		if len(resp.Answer) == 0 {
+			continue
+		}
+
+		if legacy || isUnicastQuestion(q) {
+			unicastResp.Answer = appendUnique(unicastResp.Answer, resp.Answer...)
+			unicastResp.Extra = appendUnique(unicastResp.Extra, resp.Extra...)
+			unicastAnswered++
+		} else {
+			multicastResp.Answer = appendUnique(multicastResp.Answer, resp.Answer...)
+			multicastResp.Extra = appendUnique(multicastResp.Extra, resp.Extra...)
+			multicastAnswered++
+		}
+	}
+
+	if len(unicastResp.Answer) > 0 {
+		if legacy {
+			unicastResp = legacyResponse(query, unicastResp)
+		}
+		if e := s.sendResponse(unicastResp, ifIndex, from); e != nil {
+			err = e
+		} else {
+			atomic.AddUint64(&s.stats.queriesAnswered, unicastAnswered)
+		}
+	}
+	if len(multicastResp.Answer) > 0 {
+		// From RFC6762
+		//    In any case where there may be multiple responses, such as
+		//    queries where the answer is a member of a shared resource
+		//    record set, each responder SHOULD delay its response by a random
+		//    amount of time selected with uniform random distribution in the
+		//    range 20-120 ms.
+		if delay := s.responseDelay(); !isProbe && delay > 0 && hasSharedRecord(multicastResp.Answer) {
+			// The shutdown waits for the response to be sent or dropped.
+			s.shutdownEnd.Add(1)
+			time.AfterFunc(delay, func() {
+				defer s.shutdownEnd.Done()
+				select {
+				case <-s.shouldShutdown:
+					return
+				default:
+				}
+				if err := s.multicastAnswers(multicastResp, ifIndex, false, multicastAnswered); err != nil {
+					s.opts.logger.Printf("[zeroconf] failed to send delayed response: %s", err.Error())
+				}
+			})
+		} else if e := s.multicastAnswers(multicastResp, ifIndex, isProbe, multicastAnswered); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// legacyTTL is the largest TTL in responses to legacy unicast queries.
+const legacyTTL = 10
+
+// isLegacyQuery reports whether a query was sent from a port other than the
+// mDNS port, i.e. by a simple resolver not implementing mDNS itself.
+func (s *Server) isLegacyQuery(from net.Addr) bool {
+	addr, ok := from.(*net.UDPAddr)
+	return ok && addr.Port != s.opts.groups.port
+}
+
+// legacyResponse turns resp into a response to a legacy unicast query.
+func legacyResponse(query, resp *dns.Msg) *dns.Msg {
+	// From RFC6762
+	//    If the source UDP port in a received Multicast DNS query is not port
+	//    5353, this indicates that the querier originating the query is a
+	//    simple resolver [...]. In this case, the Multicast DNS responder MUST
+	//    send a UDP response directly back to the querier, via unicast, to
+	//    the query packet's source IP address and port. This unicast response
+	//    MUST be a conventional unicast response as would be generated by a
+	//    conventional Unicast DNS server; for example, it MUST repeat the
+	//    query ID and the question given in the query message. In addition,
+	//    the cache-flush bit described in Section 10.2 MUST NOT be set in
+	//    legacy unicast responses.
+	//
+	//    The resource record TTL given in a legacy unicast response SHOULD
+	//    NOT be greater than ten seconds, even if the true TTL of the
+	//    Multicast DNS resource record is higher.
+	msg := resp.Copy()
+	msg.Question = append([]dns.Question(nil), query.Question...)
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		h := rr.Header()
+		h.Class &^= qClassCacheFlush
+		if h.Ttl > legacyTTL {
+			h.Ttl = legacyTTL
+		}
+	}
+	return msg
+}
+
+// multicastAnswers multicasts the response to the given number of questions.
+// Unless they answer a probe, records multicast recently are left out.
+func (s *Server) multicastAnswers(resp *dns.Msg, ifIndex int, isProbe bool, answered uint64) error {
+	if !isProbe {
+		resp.Answer = s.rateLimitMulticast(resp.Answer, ifIndex)
+	}
+	if len(resp.Answer) == 0 {
+		return nil
+	}
+	if err := s.sendResponse(resp, ifIndex, nil); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.stats.queriesAnswered, answered)
+	return nil
+}
+
+// responseDelay returns a random delay for a response with shared records.
+func (s *Server) responseDelay() time.Duration {
+	d := s.opts.maxResponseDelay - s.opts.minResponseDelay
+	if d <= 0 {
+		return s.opts.maxResponseDelay
+	}
+	return s.opts.minResponseDelay + time.Duration(s.randInt63n(int64(d)))
+}
+
+// randInt63n returns a random number in [0,n) from the source passed to
+// WithRandSource, or from a source seeded with the current time.
+func (s *Server) randInt63n(n int64) int64 {
+	s.randLock.Lock()
+	defer s.randLock.Unlock()
+	if s.rand == nil {
+		src := s.opts.randSource
+		if src == nil {
+			src = rand.NewSource(time.Now().UnixNano())
+		}
+		s.rand = rand.New(src)
+	}
+	return s.rand.Int63n(n)
+}
+
+// hasSharedRecord reports whether answers contain a PTR record, which other
+// responders might answer with, too.
+func hasSharedRecord(answers []dns.RR) bool {
+	for _, rr := range answers {
+		if rr.Header().Rrtype == dns.TypePTR {
+			return true
+		}
+	}
+	return false
+}
+
+// newResponse returns an empty response to query.
+func newResponse(query *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Compress = true
+	resp.RecursionDesired = false
+	resp.Authoritative = true
+	resp.Question = nil // RFC6762 section 6 "responses MUST NOT contain any questions"
+	resp.Answer = []dns.RR{}
+	resp.Extra = []dns.RR{}
+	return resp
+}
+
+// maxResponseSize is the largest packet sent by default, see RFC6762 section
+// 17. Packets are no smaller than minPacketSize, the DNS message size every
+// host must accept.
+const (
+	maxResponseSize = 9000
+	minPacketSize   = 512
+)
+
+// sendResponse sends resp by unicast to the given address, or by multicast if
+// it is nil. Additional records already among the answers are dropped, and
+// responses exceeding the maximum packet size are split into several packets.
+func (s *Server) sendResponse(resp *dns.Msg, ifIndex int, to net.Addr) error {
+	var extra []dns.RR
+	for _, rr := range resp.Extra {
+		if !containsRecord(resp.Answer, rr) {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+
+	for _, msg := range splitResponse(resp, s.opts.maxPacketSize) {
+		var err error
+		if to != nil {
+			err = s.unicastResponse(msg, ifIndex, to)
+		} else {
+			err = s.multicastResponse(msg, ifIndex)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitResponse splits resp into messages of at most size bytes at record
+// boundaries. The additional records of an answer, e.g. the SRV, TXT and
+// address records of a PTR record, go into the same message, which is why an
+// answer starts a new message if they don't fit anymore. The other additional
+// records are added to the last message as long as they fit, as they are
+// optional.
+func splitResponse(resp *dns.Msg, size int) []*dns.Msg {
+	if resp.Len() <= size {
+		return []*dns.Msg{resp}
+	}
+	var msgs []*dns.Msg
+	msg := resp.Copy()
+	msg.Answer, msg.Extra = nil, nil
+	used := make([]bool, len(resp.Extra))
+	for _, rr := range resp.Answer {
+		related := relatedRecords(rr, resp.Extra)
+		if len(msg.Answer) > 0 && !fitsRecords(msg, rr, resp.Extra, related, size) {
+			msgs = append(msgs, msg)
+			msg = resp.Copy()
+			msg.Answer, msg.Extra = nil, nil
+		}
+		msg.Answer = append(msg.Answer, rr)
+		for _, i := range related {
+			if appendFitting(msg, resp.Extra[i], size) {
+				used[i] = true
 			}
-			_ = s.parsePacket(buf[:n], ifIndex, from)
 		}
 	}
+	for i, rr := range resp.Extra {
+		if !used[i] {
+			appendFitting(msg, rr, size)
+		}
+	}
+	return append(msgs, msg)
 }
 
-// parsePacket is used to parse an incoming packet
-func (s *Server) parsePacket(packet []byte, ifIndex int, from net.Addr) error {
-	var msg dns.Msg
-	if err := msg.Unpack(packet); err != nil {
-		// log.Printf("[ERR] zeroconf: Failed to unpack packet: %v", err)
-		return err
-	}
-	return s.handleQuery(&msg, ifIndex, from)
+// fitsRecords reports whether answer and the records of extra at the given
+// indexes fit into msg without exceeding size bytes.
+func fitsRecords(msg *dns.Msg, answer dns.RR, extra []dns.RR, indexes []int, size int) bool {
+	answers, extras := len(msg.Answer), len(msg.Extra)
+	defer func() {
+		msg.Answer, msg.Extra = msg.Answer[:answers], msg.Extra[:extras]
+	}()
+	msg.Answer = append(msg.Answer, answer)
+	for _, i := range indexes {
+		msg.Extra = appendUnique(msg.Extra, extra[i])
+	}
+	return msg.Len() <= size
 }
 
-// handleQuery is used to handle an incoming query
-func (s *Server) handleQuery(query *dns.Msg, ifIndex int, from net.Addr) error {
-	// Ignore questions with authoritative section for now
-	if len(query.Ns) > 0 {
-		return nil
+// appendFitting adds rr to the additional records of msg unless it is listed
+// already or msg would exceed size bytes. It reports whether msg contains rr.
+func appendFitting(msg *dns.Msg, rr dns.RR, size int) bool {
+	if containsRecord(msg.Extra, rr) {
+		return true
 	}
+	msg.Extra = append(msg.Extra, rr)
+	if msg.Len() > size {
+		msg.Extra = msg.Extra[:len(msg.Extra)-1]
+		return false
+	}
+	return true
+}
 
-	// Handle each question
-	var err error
-	for _, q := range query.Question {
-		resp := dns.Msg{}
-		resp.SetReply(query)
-		resp.Compress = true
-		resp.RecursionDesired = false
-		resp.Authoritative = true
-		resp.Question = nil // RFC6762 section 6 "responses MUST NOT contain any questions"
-		resp.Answer = []dns.RR{}
-		resp.Extra = []dns.RR{}
-		if err = s.handleQuestion(q, &resp, query, ifIndex); err != nil {
-			// log.Printf("[ERR] zeroconf: failed to handle question %v: %v", q, err)
-			continue
-		}
-		// Check if there is an answer
-		if len(resp.Answer) == 0 {
-			continue
-		}
-
-		if isUnicastQuestion(q) {
-			// Send unicast
-			if e := s.unicastResponse(&resp, ifIndex, from); e != nil {
-				err = e
+// relatedRecords returns the indexes of the records in extra which belong to
+// answer, i.e. those named after its target, and in turn after their targets.
+func relatedRecords(answer dns.RR, extra []dns.RR) []int {
+	names := map[string]bool{strings.ToLower(recordTarget(answer)): true}
+	related := make([]bool, len(extra))
+	for found := true; found; {
+		// Records listed before may be named after a new target.
+		found = false
+		for i, rr := range extra {
+			if related[i] || !names[strings.ToLower(rr.Header().Name)] {
+				continue
 			}
-		} else {
-			// Send mulicast
-			if e := s.multicastResponse(&resp, ifIndex); e != nil {
-				err = e
+			related[i] = true
+			if target := strings.ToLower(recordTarget(rr)); target != "" && !names[target] {
+				names[target] = true
+				found = true
 			}
 		}
 	}
+	var indexes []int
+	for i, ok := range related {
+		if ok {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
 
-	return err
+// recordTarget returns the name rr points to, if any.
+func recordTarget(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.PTR:
+		return rr.Ptr
+	case *dns.SRV:
+		return rr.Target
+	case *dns.CNAME:
+		return rr.Target
+	}
+	return ""
 }
 
-// RFC6762 7.1. Known-Answer Suppression
-func isKnownAnswer(resp *dns.Msg, query *dns.Msg) bool {
-	if len(resp.Answer) == 0 || len(query.Answer) == 0 {
-		return false
+// rateLimitMulticast drops the records that have been multicast on the given
+// interface within the last second and remembers the remaining ones as sent.
+func (s *Server) rateLimitMulticast(answers []dns.RR, ifIndex int) []dns.RR {
+	// From RFC6762
+	//    To protect the network against excessive packet flooding due to
+	//    software bugs or malicious attack, a Multicast DNS responder MUST NOT
+	//    (except in the one special case of answering probe queries) multicast
+	//    a record on a given interface until at least one second has elapsed
+	//    since the last time that record was multicast on that particular
+	//    interface.
+	s.lastMulticastLock.Lock()
+	defer s.lastMulticastLock.Unlock()
+
+	now := time.Now()
+	for k, t := range s.lastMulticast {
+		if now.Sub(t) >= multicastRateLimit {
+			delete(s.lastMulticast, k)
+		}
+	}
+	var allowed []dns.RR
+	for _, rr := range answers {
+		k := fmt.Sprintf("%d|%s", ifIndex, recordKey(rr))
+		if _, ok := s.lastMulticast[k]; ok {
+			continue
+		}
+		s.lastMulticast[k] = now
+		allowed = append(allowed, rr)
 	}
+	return allowed
+}
 
-	if resp.Answer[0].Header().Rrtype != dns.TypePTR {
-		return false
+// recordKey identifies a record by its case-insensitive name, type, class and
+// data, ignoring the TTL and the cache-flush bit.
+func recordKey(rr dns.RR) string {
+	c := dns.Copy(rr)
+	c.Header().Ttl = 0
+	c.Header().Name = strings.ToLower(c.Header().Name)
+	c.Header().Class &^= qClassCacheFlush
+	return c.String()
+}
+
+// suppressKnownAnswers drops the answers the querier already knows about,
+// i.e. listed in the Known-Answer section of its query.
+func suppressKnownAnswers(answers []dns.RR, known []dns.RR) []dns.RR {
+	// From RFC6762
+	//    A Multicast DNS responder MUST NOT answer a Multicast DNS query if
+	//    the answer it would give is already included in the Answer Section
+	//    with an RR TTL at least half the correct value.
+	if len(known) == 0 {
+		return answers
+	}
+	var remaining []dns.RR
+	for _, rr := range answers {
+		if !isKnownAnswer(rr, known) {
+			remaining = append(remaining, rr)
+		}
 	}
-	answer := resp.Answer[0].(*dns.PTR)
+	return remaining
+}
 
-	for _, known := range query.Answer {
-		hdr := known.Header()
-		if hdr.Rrtype != answer.Hdr.Rrtype {
+// isKnownAnswer checks whether rr is listed in the Known-Answer section with
+// at least half of its TTL remaining.
+func isKnownAnswer(rr dns.RR, known []dns.RR) bool {
+	key := recordKey(rr)
+	for _, k := range known {
+		if k.Header().Ttl < rr.Header().Ttl/2 {
 			continue
 		}
-		ptr := known.(*dns.PTR)
-		if ptr.Ptr == answer.Ptr && hdr.Ttl >= answer.Hdr.Ttl/2 {
-			// log.Printf("skipping known answer: %v", ptr)
+		if recordKey(k) == key {
 			return true
 		}
 	}
-
 	return false
 }
 
 // handleQuestion is used to handle an incoming question
 func (s *Server) handleQuestion(q dns.Question, resp *dns.Msg, query *dns.Msg, ifIndex int) error {
-	if s.service == nil {
-		return nil
-	}
-
-	switch q.Name {
-	case s.service.ServiceTypeName():
-		s.serviceTypeName(resp, s.ttl)
-		if isKnownAnswer(resp, query) {
-			resp.Answer = nil
-		}
-
-	case s.service.ServiceName():
-		s.composeBrowsingAnswers(resp, ifIndex)
-		if isKnownAnswer(resp, query) {
-			resp.Answer = nil
-		}
-
-	case s.service.ServiceInstanceName():
-		s.composeLookupAnswers(resp, s.ttl, ifIndex, false)
-	default:
-		// handle matching subtype query
-		for _, subtype := range s.service.Subtypes {
-			subtype = fmt.Sprintf("%s._sub.%s", subtype, s.service.ServiceName())
-			if q.Name == subtype {
-				s.composeBrowsingAnswers(resp, ifIndex)
-				if isKnownAnswer(resp, query) {
-					resp.Answer = nil
-				}
+	// The records must not change while being composed, see SetText.
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, entry := range s.services {
+		// Compose the answers of each service separately, so that
+		// known answers are only suppressed for the matching service.
+		r := dns.Msg{}
+		switch q.Name {
+		case entry.ServiceTypeName():
+			s.serviceTypeName(&r, entry, s.ttl)
+
+		case entry.ServiceName():
+			s.composeBrowsingAnswers(&r, entry, entry.ServiceName(), ifIndex)
+			s.composeNegativeAnswers(&r, entry, ifIndex)
+
+		case entry.ServiceInstanceName():
+			s.composeLookupAnswers(&r, entry, s.ttl, ifIndex)
+			s.composeNegativeAnswers(&r, entry, ifIndex)
+		case entry.HostName:
+			if s.opts.noAddrs {
+				// The address records are left to the responder
+				// owning the host name.
 				break
 			}
+			s.composeHostAnswers(&r, entry, q.Qtype, ifIndex)
+			if len(r.Answer) == 0 {
+				// None of the requested records exist, assert
+				// that right away.
+				r.Answer = append(r.Answer, s.hostNSEC(entry, ifIndex))
+			} else {
+				r.Extra = append(r.Extra, s.hostNSEC(entry, ifIndex))
+			}
+		default:
+			// handle matching subtype query
+			for _, subtype := range entry.Subtypes {
+				if q.Name == subtype {
+					s.composeBrowsingAnswers(&r, entry, subtype, ifIndex)
+					s.composeNegativeAnswers(&r, entry, ifIndex)
+					break
+				}
+			}
+			if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+				s.composeReverseAnswers(&r, entry, q.Name)
+			}
+		}
+		resp.Answer = appendUnique(resp.Answer, r.Answer...)
+		if !s.opts.noAdditionals {
+			resp.Extra = appendUnique(resp.Extra, r.Extra...)
+		}
+	}
+	for _, rr := range s.opts.extraRecords {
+		h := rr.Header()
+		if strings.EqualFold(h.Name, q.Name) && (q.Qtype == dns.TypeANY || q.Qtype == h.Rrtype) {
+			resp.Answer = appendUnique(resp.Answer, dns.Copy(rr))
 		}
 	}
 
 	return nil
 }
 
-func (s *Server) composeBrowsingAnswers(resp *dns.Msg, ifIndex int) {
+// composeReverseAnswers answers a reverse mapping query, e.g. for
+// 1.2.0.192.in-addr.arpa., if the name belongs to an address of the host.
+func (s *Server) composeReverseAnswers(resp *dns.Msg, entry *ServiceEntry, name string) {
+	for _, ip := range append(append([]net.IP(nil), entry.AddrIPv4...), entry.AddrIPv6...) {
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil || !strings.EqualFold(reverse, name) {
+			continue
+		}
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   reverse,
+				Rrtype: dns.TypePTR,
+				Class:  s.uniqueClass(),
+				Ttl:    s.hostRecordTTL(s.ttl),
+			},
+			Ptr: entry.HostName,
+		})
+	}
+}
+
+// composeBrowsingAnswers answers a query for the PTR records of the given
+// service or subtype name.
+func (s *Server) composeBrowsingAnswers(resp *dns.Msg, entry *ServiceEntry, name string, ifIndex int) {
 	ptr := &dns.PTR{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceName(),
+			Name:   name,
 			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
 			Ttl:    s.ttl,
 		},
-		Ptr: s.service.ServiceInstanceName(),
+		Ptr: entry.ServiceInstanceName(),
 	}
 	resp.Answer = append(resp.Answer, ptr)
 
 	txt := &dns.TXT{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   entry.ServiceInstanceName(),
 			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET,
+			Class:  s.uniqueClass(),
 			Ttl:    s.ttl,
 		},
-		Txt: s.service.Text,
+		Txt: entry.Text,
 	}
 	srv := &dns.SRV{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   entry.ServiceInstanceName(),
 			Rrtype: dns.TypeSRV,
-			Class:  dns.ClassINET,
-			Ttl:    s.ttl,
+			Class:  s.uniqueClass(),
+			Ttl:    s.hostRecordTTL(s.ttl),
 		},
-		Priority: 0,
-		Weight:   0,
-		Port:     uint16(s.service.Port),
-		Target:   s.service.HostName,
+		Priority: entry.Priority,
+		Weight:   entry.Weight,
+		Port:     uint16(entry.Port),
+		Target:   entry.HostName,
 	}
 	resp.Extra = append(resp.Extra, srv, txt)
 
-	resp.Extra = s.appendAddrs(resp.Extra, s.ttl, ifIndex, false)
+	// The subtypes tell browsers of the service which ones the instance
+	// belongs to.
+	for _, subtype := range entry.Subtypes {
+		if subtype == name {
+			continue
+		}
+		resp.Extra = append(resp.Extra, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   subtype,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    s.ttl,
+			},
+			Ptr: entry.ServiceInstanceName(),
+		})
+	}
+
+	resp.Extra = s.appendAddrs(resp.Extra, entry, s.ttl, ifIndex)
 }
 
-func (s *Server) composeLookupAnswers(resp *dns.Msg, ttl uint32, ifIndex int, flushCache bool) {
+func (s *Server) composeLookupAnswers(resp *dns.Msg, entry *ServiceEntry, ttl uint32, ifIndex int) {
 	// From RFC6762
 	//    The most significant bit of the rrclass for a record in the Answer
 	//    Section of a response message is the Multicast DNS cache-flush bit
@@ -447,46 +2179,46 @@ func (s *Server) composeLookupAnswers(resp *dns.Msg, ttl uint32, ifIndex int, fl
 	//    to Flush Outdated Cache Entries".
 	ptr := &dns.PTR{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceName(),
+			Name:   entry.ServiceName(),
 			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
 			Ttl:    ttl,
 		},
-		Ptr: s.service.ServiceInstanceName(),
+		Ptr: entry.ServiceInstanceName(),
 	}
 	srv := &dns.SRV{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   entry.ServiceInstanceName(),
 			Rrtype: dns.TypeSRV,
-			Class:  dns.ClassINET | qClassCacheFlush,
-			Ttl:    ttl,
+			Class:  s.uniqueClass(),
+			Ttl:    s.hostRecordTTL(ttl),
 		},
-		Priority: 0,
-		Weight:   0,
-		Port:     uint16(s.service.Port),
-		Target:   s.service.HostName,
+		Priority: entry.Priority,
+		Weight:   entry.Weight,
+		Port:     uint16(entry.Port),
+		Target:   entry.HostName,
 	}
 	txt := &dns.TXT{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   entry.ServiceInstanceName(),
 			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET | qClassCacheFlush,
+			Class:  s.uniqueClass(),
 			Ttl:    ttl,
 		},
-		Txt: s.service.Text,
+		Txt: entry.Text,
 	}
 	dnssd := &dns.PTR{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceTypeName(),
+			Name:   entry.ServiceTypeName(),
 			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
 			Ttl:    ttl,
 		},
-		Ptr: s.service.ServiceName(),
+		Ptr: entry.ServiceName(),
 	}
 	resp.Answer = append(resp.Answer, srv, txt, ptr, dnssd)
 
-	for _, subtype := range s.service.Subtypes {
+	for _, subtype := range entry.Subtypes {
 		resp.Answer = append(resp.Answer,
 			&dns.PTR{
 				Hdr: dns.RR_Header{
@@ -495,14 +2227,78 @@ func (s *Server) composeLookupAnswers(resp *dns.Msg, ttl uint32, ifIndex int, fl
 					Class:  dns.ClassINET,
 					Ttl:    ttl,
 				},
-				Ptr: s.service.ServiceInstanceName(),
+				Ptr: entry.ServiceInstanceName(),
 			})
 	}
 
-	resp.Answer = s.appendAddrs(resp.Answer, ttl, ifIndex, flushCache)
+	resp.Answer = s.appendAddrs(resp.Answer, entry, ttl, ifIndex)
+}
+
+// composeHostAnswers answers a query for the address records of the host.
+func (s *Server) composeHostAnswers(resp *dns.Msg, entry *ServiceEntry, qtype uint16, ifIndex int) {
+	for _, rr := range s.appendAddrs(nil, entry, s.ttl, ifIndex) {
+		if qtype == dns.TypeANY || qtype == rr.Header().Rrtype {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+}
+
+// composeNegativeAnswers adds NSEC records to the additional section which
+// assert the record types existing for the service instance name and the host
+// name, so that queriers don't wait for records that don't exist.
+func (s *Server) composeNegativeAnswers(resp *dns.Msg, entry *ServiceEntry, ifIndex int) {
+	// From RFC6762
+	//    On receipt of a question for a particular name, rrtype, and rrclass,
+	//    for which a responder does have one or more unique answers, the
+	//    responder MAY also include an NSEC record in the Additional Record
+	//    Section indicating the nonexistence of other rrtypes for that name
+	//    and rrclass.
+	instance := s.nsec(entry.ServiceInstanceName(), s.ttl, dns.TypeTXT, dns.TypeSRV)
+	resp.Extra = append(resp.Extra, instance)
+	if !s.opts.noAddrs {
+		resp.Extra = append(resp.Extra, s.hostNSEC(entry, ifIndex))
+	}
+}
+
+// hostNSEC returns the NSEC record asserting the address record types existing
+// for the host of entry on the given interface.
+func (s *Server) hostNSEC(entry *ServiceEntry, ifIndex int) *dns.NSEC {
+	var hasA, hasAAAA bool
+	for _, rr := range s.appendAddrs(nil, entry, s.ttl, ifIndex) {
+		switch rr.Header().Rrtype {
+		case dns.TypeA:
+			hasA = true
+		case dns.TypeAAAA:
+			hasAAAA = true
+		}
+	}
+	// The types must be in ascending order.
+	var types []uint16
+	if hasA {
+		types = append(types, dns.TypeA)
+	}
+	if hasAAAA {
+		types = append(types, dns.TypeAAAA)
+	}
+	return s.nsec(entry.HostName, s.hostRecordTTL(s.ttl), types...)
+}
+
+// nsec returns an NSEC record asserting that only the given record types exist
+// for name, in the restricted form of RFC6762 section 6.1.
+func (s *Server) nsec(name string, ttl uint32, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  s.uniqueClass(),
+			Ttl:    ttl,
+		},
+		NextDomain: name,
+		TypeBitMap: types,
+	}
 }
 
-func (s *Server) serviceTypeName(resp *dns.Msg, ttl uint32) {
+func (s *Server) serviceTypeName(resp *dns.Msg, entry *ServiceEntry, ttl uint32) {
 	// From RFC6762
 	// 9.  Service Type Enumeration
 	//
@@ -513,54 +2309,158 @@ func (s *Server) serviceTypeName(resp *dns.Msg, ttl uint32) {
 	//    "_http._tcp.<Domain>".
 	dnssd := &dns.PTR{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceTypeName(),
+			Name:   entry.ServiceTypeName(),
 			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
 			Ttl:    ttl,
 		},
-		Ptr: s.service.ServiceName(),
+		Ptr: entry.ServiceName(),
 	}
 	resp.Answer = append(resp.Answer, dnssd)
 }
 
 // Perform probing & announcement
-//TODO: implement a proper probing & conflict resolution
-func (s *Server) probe() {
+func (s *Server) probe(entry *ServiceEntry) {
+	if !s.opts.disableProbing && !s.probeName(entry) {
+		return
+	}
+	if !s.publish(entry) {
+		return
+	}
+	s.announce(entry)
+}
+
+// probeName sends probe queries for the instance name of entry and picks a new
+// name whenever another responder claims it. It reports false if probing was
+// aborted by a shutdown or by removing the service.
+func (s *Server) probeName(entry *ServiceEntry) bool {
+	s.mu.RLock()
+	conflict, ok := s.probing[entry]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	// From RFC6762
+	//    When the host is ready to send his probe query he SHOULD first wait
+	//    for a short random delay time, uniformly distributed in the range
+	//    0-250 ms. [...] 250 ms after the first query, the host should send a
+	//    second; then, 250 ms after that, a third. If, by 250 ms after the
+	//    third probe, no conflicting Multicast DNS responses have been
+	//    received, the host may move to the next step, announcing.
+	wait := time.Duration(s.randInt63n(250)) * time.Millisecond
+	conflicts := 0
+	for {
+		var conflicted bool
+		for i := 0; i <= probeCount && !conflicted; i++ {
+			select {
+			case <-time.After(wait):
+			case <-conflict:
+				conflicted = true
+				continue
+			case <-s.shouldShutdown:
+				return false
+			}
+			wait = probeInterval
+			if i == probeCount {
+				break
+			}
+			s.mu.RLock()
+			q := s.probeQuery(entry)
+			s.mu.RUnlock()
+			if err := s.multicastResponse(q, 0); err != nil {
+				s.opts.logger.Printf("[ERR] zeroconf: failed to send probe: %v", err)
+			}
+		}
+		if !conflicted {
+			return true
+		}
+
+		// From RFC6762
+		//    If fifteen conflicts occur within any ten-second period, then
+		//    the host MUST wait at least five seconds before each successive
+		//    additional probe attempt.
+		conflicts++
+		wait = 0
+		if conflicts >= maxProbeConflicts {
+			wait = probeConflictDelay
+		}
+		s.mu.Lock()
+		entry.Instance = nextInstanceName(entry.Instance)
+		entry.serviceInstanceName = fmt.Sprintf("%s.%s", trimDot(entry.Instance), entry.ServiceName())
+		// Drop conflicts reported for the previous name.
+		select {
+		case <-conflict:
+		default:
+		}
+		s.mu.Unlock()
+	}
+}
+
+// probeQuery composes a probe for the instance name of entry. The records to
+// be claimed are placed in the authority section.
+func (s *Server) probeQuery(entry *ServiceEntry) *dns.Msg {
 	q := new(dns.Msg)
-	q.SetQuestion(s.service.ServiceInstanceName(), dns.TypePTR)
+	q.SetQuestion(entry.ServiceInstanceName(), dns.TypeANY)
 	q.RecursionDesired = false
 
 	srv := &dns.SRV{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   entry.ServiceInstanceName(),
 			Rrtype: dns.TypeSRV,
 			Class:  dns.ClassINET,
-			Ttl:    s.ttl,
+			Ttl:    s.hostRecordTTL(s.ttl),
 		},
-		Priority: 0,
-		Weight:   0,
-		Port:     uint16(s.service.Port),
-		Target:   s.service.HostName,
+		Priority: entry.Priority,
+		Weight:   entry.Weight,
+		Port:     uint16(entry.Port),
+		Target:   entry.HostName,
 	}
 	txt := &dns.TXT{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   entry.ServiceInstanceName(),
 			Rrtype: dns.TypeTXT,
 			Class:  dns.ClassINET,
 			Ttl:    s.ttl,
 		},
-		Txt: s.service.Text,
+		Txt: entry.Text,
 	}
 	q.Ns = []dns.RR{srv, txt}
+	return q
+}
 
-	randomizer := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	for i := 0; i < multicastRepetitions; i++ {
-		if err := s.multicastResponse(q, 0); err != nil {
-			log.Println("[ERR] zeroconf: failed to send probe:", err.Error())
+// nextInstanceName appends a number to the name, or increments it, to resolve
+// a name conflict, e.g. "My Printer" becomes "My Printer (2)".
+func nextInstanceName(name string) string {
+	if strings.HasSuffix(name, ")") {
+		if i := strings.LastIndex(name, " ("); i >= 0 {
+			var n int
+			if _, err := fmt.Sscanf(name[i:], " (%d)", &n); err == nil && n > 1 {
+				return fmt.Sprintf("%s (%d)", name[:i], n+1)
+			}
 		}
-		time.Sleep(time.Duration(randomizer.Intn(250)) * time.Millisecond)
 	}
+	return name + " (2)"
+}
+
+// publish moves entry from probing to the published services. It reports
+// false if the service was removed meanwhile.
+func (s *Server) publish(entry *ServiceEntry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.probing[entry]; !ok {
+		return false
+	}
+	delete(s.probing, entry)
+	s.services = append(s.services, entry)
+	return true
+}
+
+// announce sends unsolicited responses for the records of entry.
+func (s *Server) announce(entry *ServiceEntry) {
+	// The address records of a host shared by several services only need
+	// to be announced along with the first of them.
+	sharedHost := s.isHostAnnounced(entry)
 
 	// From RFC6762
 	//    The Multicast DNS responder MUST send at least two unsolicited
@@ -568,56 +2468,249 @@ func (s *Server) probe() {
 	//    packet loss, a responder MAY send up to eight unsolicited responses,
 	//    provided that the interval between unsolicited responses increases by
 	//    at least a factor of two with every response sent.
-	timeout := 1 * time.Second
-	for i := 0; i < multicastRepetitions; i++ {
-		for _, intf := range s.ifaces {
+	timeout := s.opts.announceInterval
+	for i := 0; i < s.opts.announceCount; i++ {
+		if s.isPaused() {
+			// The services are announced again on Resume.
+			return
+		}
+		for _, intf := range s.interfaces() {
 			resp := new(dns.Msg)
 			resp.MsgHdr.Response = true
 			// TODO: make response authoritative if we are the publisher
 			resp.Compress = true
 			resp.Answer = []dns.RR{}
 			resp.Extra = []dns.RR{}
-			s.composeLookupAnswers(resp, s.ttl, intf.Index, true)
-			if err := s.multicastResponse(resp, intf.Index); err != nil {
-				log.Println("[ERR] zeroconf: failed to send announcement:", err.Error())
+			s.mu.RLock()
+			s.composeLookupAnswers(resp, entry, s.ttl, intf.Index)
+			s.mu.RUnlock()
+			if sharedHost {
+				resp.Answer = withoutAddrs(resp.Answer)
+			}
+			err := s.sendResponse(resp, intf.Index, nil)
+			if err != nil {
+				s.opts.logger.Printf("[ERR] zeroconf: failed to send announcement: %v", err)
+			}
+			if i == 0 && entry == s.service && s.opts.announceCallback != nil {
+				s.opts.announceCallback(intf, err)
 			}
 		}
-		time.Sleep(timeout)
+		if entry == s.service {
+			s.announcedOnce.Do(func() { close(s.announced) })
+		}
+		if i == s.opts.announceCount-1 {
+			break
+		}
+		select {
+		case <-time.After(timeout):
+		case <-s.shouldShutdown:
+			return
+		}
 		timeout *= 2
 	}
 }
 
+// Announce immediately multicasts the records of all registered services on
+// all interfaces, e.g. after a network change or if clients might have missed
+// the initial announcements. Records multicast within the last second are left
+// out, see RFC6762 section 6.
+func (s *Server) Announce() error {
+	select {
+	case <-s.shouldShutdown:
+		return errors.New("server is shut down")
+	default:
+	}
+	if s.isPaused() {
+		return errors.New("server is paused")
+	}
+	if s.unicast {
+		return s.updateUnicast(s.ctx, s.service, false)
+	}
+
+	services := s.registeredServices()
+	var err error
+	for _, intf := range s.interfaces() {
+		resp := new(dns.Msg)
+		resp.MsgHdr.Response = true
+		resp.Compress = true
+		resp.Answer = []dns.RR{}
+		s.mu.RLock()
+		for _, entry := range services {
+			r := dns.Msg{}
+			s.composeLookupAnswers(&r, entry, s.ttl, intf.Index)
+			resp.Answer = appendUnique(resp.Answer, r.Answer...)
+		}
+		s.mu.RUnlock()
+		resp.Answer = s.rateLimitMulticast(resp.Answer, intf.Index)
+		if len(resp.Answer) == 0 {
+			continue
+		}
+		if e := s.sendResponse(resp, intf.Index, nil); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Pause makes the server go silent temporarily, e.g. during maintenance: it
+// sends goodbye packets for the records of all services and stops answering
+// queries and announcing, until Resume is called. The services stay
+// registered with their instance names and TXT records. Pause returns once
+// the goodbye packets are sent.
+func (s *Server) Pause() error {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	select {
+	case <-s.shouldShutdown:
+		return errors.New("server is shut down")
+	default:
+	}
+	s.mu.Lock()
+	if s.paused {
+		s.mu.Unlock()
+		return nil
+	}
+	s.paused = true
+	s.mu.Unlock()
+
+	if s.unicast {
+		return s.updateUnicast(context.Background(), s.service, true)
+	}
+	return s.unregister(context.Background())
+}
+
+// Resume ends a pause started by Pause: the services are announced again,
+// including changes made in the meantime, and queries are answered again.
+func (s *Server) Resume() error {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	select {
+	case <-s.shouldShutdown:
+		return errors.New("server is shut down")
+	default:
+	}
+	s.mu.Lock()
+	if !s.paused {
+		s.mu.Unlock()
+		return nil
+	}
+	s.paused = false
+	s.mu.Unlock()
+
+	if s.unicast {
+		return s.updateUnicast(s.ctx, s.service, false)
+	}
+	for _, entry := range s.registeredServices() {
+		entry := entry
+		s.background(func() { s.announce(entry) })
+	}
+	return nil
+}
+
+// isPaused reports whether the server is paused, see Pause.
+func (s *Server) isPaused() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.paused
+}
+
+// isHostAnnounced reports whether a service registered before entry already
+// announces the address records of entry's host.
+func (s *Server) isHostAnnounced(entry *ServiceEntry) bool {
+	for _, e := range s.registeredServices() {
+		if e == entry {
+			return false
+		}
+		if e.HostName == entry.HostName {
+			return true
+		}
+	}
+	return false
+}
+
 // announceText sends a Text announcement with cache flush enabled
-func (s *Server) announceText() {
+func (s *Server) announceText(entry *ServiceEntry) {
 	resp := new(dns.Msg)
 	resp.MsgHdr.Response = true
 
+	s.mu.RLock()
+	if s.paused {
+		// The text is announced on Resume.
+		s.mu.RUnlock()
+		return
+	}
 	txt := &dns.TXT{
 		Hdr: dns.RR_Header{
-			Name:   s.service.ServiceInstanceName(),
+			Name:   entry.ServiceInstanceName(),
 			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET | qClassCacheFlush,
+			Class:  s.uniqueClass(),
 			Ttl:    s.ttl,
 		},
-		Txt: s.service.Text,
+		Txt: entry.Text,
 	}
+	s.mu.RUnlock()
 
 	resp.Answer = []dns.RR{txt}
 	s.multicastResponse(resp, 0)
 }
 
-func (s *Server) unregister() error {
-	resp := new(dns.Msg)
-	resp.MsgHdr.Response = true
-	resp.Answer = []dns.RR{}
-	resp.Extra = []dns.RR{}
-	s.composeLookupAnswers(resp, 0, 0, true)
-	return s.multicastResponse(resp, 0)
+// unregister sends goodbye packets, i.e. all records with a TTL of 0, on every
+// interface so that listeners purge them from their caches immediately.
+func (s *Server) unregister(ctx context.Context) error {
+	// From RFC6762
+	//    In the case where a host knows that certain resource record data is
+	//    about to become invalid (for example, when the host is undergoing a
+	//    clean shutdown), the host SHOULD send an unsolicited Multicast DNS
+	//    response packet, giving the same resource record name, rrtype,
+	//    rrclass, and rdata, but an RR TTL of zero.
+	services := s.registeredServices()
+	var err error
+	for i := 0; i < goodbyeRepetitions; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(goodbyeInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		for _, intf := range s.interfaces() {
+			resp := new(dns.Msg)
+			resp.MsgHdr.Response = true
+			resp.Answer = []dns.RR{}
+			resp.Extra = []dns.RR{}
+			s.mu.RLock()
+			for _, entry := range services {
+				r := dns.Msg{}
+				s.composeLookupAnswers(&r, entry, 0, intf.Index)
+				resp.Answer = appendUnique(resp.Answer, r.Answer...)
+			}
+			s.mu.RUnlock()
+			if e := s.sendResponse(resp, intf.Index, nil); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// hostRecordTTL returns the TTL of records containing a host name for records
+// of the given TTL otherwise, i.e. 0 for goodbye packets.
+func (s *Server) hostRecordTTL(ttl uint32) uint32 {
+	// RFC6762 Section 10 says records containing a host name SHOULD use a
+	// TTL of 120s, to account for network interface and IP address
+	// changes.
+	if ttl == 0 {
+		return 0
+	}
+	return s.opts.hostTTL
 }
 
-func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache bool) []dns.RR {
-	v4 := s.service.AddrIPv4
-	v6 := s.service.AddrIPv6
+func (s *Server) appendAddrs(list []dns.RR, entry *ServiceEntry, ttl uint32, ifIndex int) []dns.RR {
+	if s.opts.noAddrs {
+		return list
+	}
+	v4 := entry.AddrIPv4
+	v6 := entry.AddrIPv6
 	if len(v4) == 0 && len(v6) == 0 {
 		iface, _ := net.InterfaceByIndex(ifIndex)
 		if iface != nil {
@@ -626,22 +2719,13 @@ func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache
 			v6 = append(v6, a6...)
 		}
 	}
-	if ttl > 0 {
-		// RFC6762 Section 10 says A/AAAA records SHOULD
-		// use TTL of 120s, to account for network interface
-		// and IP address changes.
-		ttl = 120
-	}
-	var cacheFlushBit uint16
-	if flushCache {
-		cacheFlushBit = qClassCacheFlush
-	}
+	ttl = s.hostRecordTTL(ttl)
 	for _, ipv4 := range v4 {
 		a := &dns.A{
 			Hdr: dns.RR_Header{
-				Name:   s.service.HostName,
+				Name:   entry.HostName,
 				Rrtype: dns.TypeA,
-				Class:  dns.ClassINET | cacheFlushBit,
+				Class:  s.uniqueClass(),
 				Ttl:    ttl,
 			},
 			A: ipv4,
@@ -651,9 +2735,9 @@ func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache
 	for _, ipv6 := range v6 {
 		aaaa := &dns.AAAA{
 			Hdr: dns.RR_Header{
-				Name:   s.service.HostName,
+				Name:   entry.HostName,
 				Rrtype: dns.TypeAAAA,
-				Class:  dns.ClassINET | cacheFlushBit,
+				Class:  s.uniqueClass(),
 				Ttl:    ttl,
 			},
 			AAAA: ipv6,
@@ -663,6 +2747,63 @@ func (s *Server) appendAddrs(list []dns.RR, ttl uint32, ifIndex int, flushCache
 	return list
 }
 
+// appendUnique appends those records to list that are not contained yet.
+func appendUnique(list []dns.RR, rrs ...dns.RR) []dns.RR {
+	for _, rr := range rrs {
+		if !containsRecord(list, rr) {
+			list = append(list, rr)
+		}
+	}
+	return list
+}
+
+// containsRecord reports whether list contains rr, ignoring the TTL.
+func containsRecord(list []dns.RR, rr dns.RR) bool {
+	for _, r := range list {
+		if dns.IsDuplicate(r, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutAddrs removes all A and AAAA records from list.
+func withoutAddrs(list []dns.RR) []dns.RR {
+	var filtered []dns.RR
+	for _, rr := range list {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			continue
+		}
+		filtered = append(filtered, rr)
+	}
+	return filtered
+}
+
+// withoutServiceTypePTR removes the PTR record enumerating the service type of
+// entry from list, see RFC6763 section 9.
+func withoutServiceTypePTR(list []dns.RR, entry *ServiceEntry) []dns.RR {
+	var filtered []dns.RR
+	for _, rr := range list {
+		if ptr, ok := rr.(*dns.PTR); ok && strings.EqualFold(ptr.Hdr.Name, entry.ServiceTypeName()) {
+			continue
+		}
+		filtered = append(filtered, rr)
+	}
+	return filtered
+}
+
+// addrsForInterfaces returns the addresses of all given interfaces.
+func addrsForInterfaces(ifaces []net.Interface) ([]net.IP, []net.IP) {
+	var v4, v6 []net.IP
+	for _, iface := range ifaces {
+		a4, a6 := addrsForInterface(&iface)
+		v4 = append(v4, a4...)
+		v6 = append(v6, a6...)
+	}
+	return v4, v6
+}
+
 func addrsForInterface(iface *net.Interface) ([]net.IP, []net.IP) {
 	var v4, v6, v6local []net.IP
 	addrs, _ := iface.Addrs()
@@ -693,23 +2834,38 @@ func (s *Server) unicastResponse(resp *dns.Msg, ifIndex int, from net.Addr) erro
 		return err
 	}
 	addr := from.(*net.UDPAddr)
+	if s.opts.packetHook != nil {
+		s.opts.packetHook(resp, addr, true)
+	}
 	if addr.IP.To4() != nil {
+		if s.ipv4conn == nil {
+			return errors.New("no IPv4 connection to respond to " + addr.String())
+		}
 		if ifIndex != 0 {
+			// Respond through the interface the query was received on,
+			// from an address the querier accepts.
 			var wcm ipv4.ControlMessage
 			wcm.IfIndex = ifIndex
+			wcm.Src = sourceAddr(ifIndex, addr.IP)
 			_, err = s.ipv4conn.WriteTo(buf, &wcm, addr)
 		} else {
 			_, err = s.ipv4conn.WriteTo(buf, nil, addr)
 		}
+		s.stats.written(ifIndex, err)
 		return err
 	} else {
+		if s.ipv6conn == nil {
+			return errors.New("no IPv6 connection to respond to " + addr.String())
+		}
 		if ifIndex != 0 {
 			var wcm ipv6.ControlMessage
 			wcm.IfIndex = ifIndex
+			wcm.Src = sourceAddr(ifIndex, addr.IP)
 			_, err = s.ipv6conn.WriteTo(buf, &wcm, addr)
 		} else {
 			_, err = s.ipv6conn.WriteTo(buf, nil, addr)
 		}
+		s.stats.written(ifIndex, err)
 		return err
 	}
 }
@@ -720,32 +2876,56 @@ func (s *Server) multicastResponse(msg *dns.Msg, ifIndex int) error {
 	if err != nil {
 		return err
 	}
+	// The first failure is returned, the others are counted in the stats.
+	var sendErr error
 	if s.ipv4conn != nil {
+		if s.opts.packetHook != nil {
+			s.opts.packetHook(msg, s.opts.groups.ipv4Addr(), true)
+		}
 		var wcm ipv4.ControlMessage
 		if ifIndex != 0 {
 			wcm.IfIndex = ifIndex
-			s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
+			_, err = s.ipv4conn.WriteTo(buf, &wcm, s.opts.groups.ipv4Addr())
+			s.stats.written(wcm.IfIndex, err)
+			if sendErr == nil {
+				sendErr = err
+			}
 		} else {
-			for _, intf := range s.ifaces {
-				wcm.IfIndex = intf.Index
-				s.ipv4conn.WriteTo(buf, &wcm, ipv4Addr)
+			for _, index := range ifaceIndexes(s.ipv4conn, s.interfaces()) {
+				wcm.IfIndex = index
+				_, err = s.ipv4conn.WriteTo(buf, &wcm, s.opts.groups.ipv4Addr())
+				s.stats.written(wcm.IfIndex, err)
+				if sendErr == nil {
+					sendErr = err
+				}
 			}
 		}
 	}
 
 	if s.ipv6conn != nil {
+		if s.opts.packetHook != nil {
+			s.opts.packetHook(msg, s.opts.groups.ipv6Addr(), true)
+		}
 		var wcm ipv6.ControlMessage
 		if ifIndex != 0 {
 			wcm.IfIndex = ifIndex
-			s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+			_, err = s.ipv6conn.WriteTo(buf, &wcm, s.opts.groups.ipv6Addr())
+			s.stats.written(wcm.IfIndex, err)
+			if sendErr == nil {
+				sendErr = err
+			}
 		} else {
-			for _, intf := range s.ifaces {
-				wcm.IfIndex = intf.Index
-				s.ipv6conn.WriteTo(buf, &wcm, ipv6Addr)
+			for _, index := range ifaceIndexes(s.ipv6conn, s.interfaces()) {
+				wcm.IfIndex = index
+				_, err = s.ipv6conn.WriteTo(buf, &wcm, s.opts.groups.ipv6Addr())
+				s.stats.written(wcm.IfIndex, err)
+				if sendErr == nil {
+					sendErr = err
+				}
 			}
 		}
 	}
-	return nil
+	return sendErr
 }
 
 func isUnicastQuestion(q dns.Question) bool {
@@ -0,0 +1,1931 @@
+package zeroconf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/goleak"
+	"golang.org/x/net/ipv4"
+)
+
+func TestRateLimitMulticast(t *testing.T) {
+	s := &Server{lastMulticast: make(map[string]time.Time)}
+	ptr := &dns.PTR{
+		Hdr: dns.RR_Header{Name: "_test._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+		Ptr: "instance._test._tcp.local.",
+	}
+
+	if got := s.rateLimitMulticast([]dns.RR{ptr}, 1); len(got) != 1 {
+		t.Fatalf("Expected first multicast to pass, but got %d records", len(got))
+	}
+	if got := s.rateLimitMulticast([]dns.RR{ptr}, 1); len(got) != 0 {
+		t.Fatalf("Expected repeated multicast to be dropped, but got %d records", len(got))
+	}
+	if got := s.rateLimitMulticast([]dns.RR{ptr}, 2); len(got) != 1 {
+		t.Fatalf("Expected multicast on another interface to pass, but got %d records", len(got))
+	}
+}
+
+func TestUnicastQuestion(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	msg := queryUnicast(t, server.service.ServiceName(), dns.TypePTR)
+	if len(msg.Answer) == 0 {
+		t.Fatal("Expected answers in the unicast response")
+	}
+	if ptr, ok := msg.Answer[0].(*dns.PTR); !ok || ptr.Ptr != server.service.ServiceInstanceName() {
+		t.Fatalf("Expected PTR for %s, but got %v", server.service.ServiceInstanceName(), msg.Answer[0])
+	}
+}
+
+func TestRegisterProxyAddrs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")}
+	server, err := RegisterProxyAddrs(mdnsName, mdnsService, mdnsDomain, mdnsPort, "proxied-host", ips, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	msg := queryUnicast(t, "proxied-host.local.", dns.TypeA)
+	if len(msg.Answer) != 1 {
+		t.Fatalf("Expected a single A record, but got %v", msg.Answer)
+	}
+	if a, ok := msg.Answer[0].(*dns.A); !ok || !a.A.Equal(ips[0]) {
+		t.Fatalf("Expected A record for %s, but got %v", ips[0], msg.Answer[0])
+	}
+
+	msg = queryUnicast(t, "proxied-host.local.", dns.TypeAAAA)
+	if len(msg.Answer) != 1 {
+		t.Fatalf("Expected a single AAAA record, but got %v", msg.Answer)
+	}
+	if aaaa, ok := msg.Answer[0].(*dns.AAAA); !ok || !aaaa.AAAA.Equal(ips[1]) {
+		t.Fatalf("Expected AAAA record for %s, but got %v", ips[1], msg.Answer[0])
+	}
+}
+
+func TestHostAddressQuery(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	// A plain mDNS query for the host, not a legacy one, which would be
+	// answered without the cache-flush bit.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: mdnsWildcardIPv4, Port: defaultGroups.port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packet := make([]byte, 65536)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(server.service.HostName, qtype)
+		m.Question[0].Qclass |= qClassCacheFlush
+		m.RecursionDesired = false
+		buf, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteTo(buf, defaultGroups.ipv4Addr()); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := server.service.AddrIPv4
+		if qtype == dns.TypeAAAA {
+			expected = server.service.AddrIPv6
+		}
+		var answer dns.RR
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for answer == nil {
+			n, _, err := conn.ReadFrom(packet)
+			if err != nil {
+				if len(expected) == 0 {
+					break
+				}
+				t.Fatalf("Expected an answer to the %s query, but got %v", dns.TypeToString[qtype], err)
+			}
+			resp := new(dns.Msg)
+			if resp.Unpack(packet[:n]) != nil || !resp.Response || hasSharedRecord(resp.Answer) {
+				// Not the answer, but an announcement.
+				continue
+			}
+			for _, rr := range resp.Answer {
+				if rr.Header().Rrtype == qtype && rr.Header().Name == server.service.HostName {
+					answer = rr
+				}
+			}
+		}
+		if len(expected) == 0 {
+			continue
+		}
+		if answer.Header().Class&qClassCacheFlush == 0 {
+			t.Fatalf("Expected the cache-flush bit, but got %v", answer)
+		}
+		var ip net.IP
+		switch rr := answer.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if !containsAddr(expected, ip) {
+			t.Fatalf("Expected one of %v, but got %v", expected, answer)
+		}
+	}
+}
+
+// queryUnicast sends a query requesting a unicast response to the mDNS group
+// and returns the response.
+func queryUnicast(t *testing.T, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Question[0].Qclass |= qClassCacheFlush
+	m.RecursionDesired = false
+	return sendQuery(t, m)
+}
+
+// sendQuery sends m to the mDNS group and returns the first unicast response.
+func sendQuery(t *testing.T, m *dns.Msg) *dns.Msg {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("Expected listen success, but got %v", err)
+	}
+	defer conn.Close()
+
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(buf, defaultGroups.ipv4Addr()); err != nil {
+		t.Fatalf("Expected sending the query to succeed, but got %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp := make([]byte, 65536)
+	n, _, err := conn.ReadFrom(resp)
+	if err != nil {
+		t.Fatalf("Expected a unicast response, but got %v", err)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(resp[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestNextInstanceName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"printer":          "printer (2)",
+		"printer (2)":      "printer (3)",
+		"printer (12)":     "printer (13)",
+		"printer (office)": "printer (office) (2)",
+	} {
+		if got := nextInstanceName(name); got != expected {
+			t.Errorf("Expected next name of %q is %q, but got %q", name, expected, got)
+		}
+	}
+}
+
+func TestProbeConflict(t *testing.T) {
+	first, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer first.Shutdown()
+	waitPublished(t, first)
+
+	second, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort+1, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer second.Shutdown()
+	waitPublished(t, second)
+
+	if first.Instance() != mdnsName {
+		t.Fatalf("Expected first instance is %s, but got %s", mdnsName, first.Instance())
+	}
+	if expected := mdnsName + " (2)"; second.Instance() != expected {
+		t.Fatalf("Expected conflicting instance is %s, but got %s", expected, second.Instance())
+	}
+}
+
+func TestRegisterWithConflictResolution(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, name, err := RegisterWithConflictResolution(ctx, mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"})
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer first.Shutdown()
+	if name != mdnsName {
+		t.Fatalf("Expected first instance is %s, but got %s", mdnsName, name)
+	}
+
+	second, name, err := RegisterWithConflictResolution(ctx, mdnsName, mdnsService, mdnsDomain, mdnsPort+1, []string{"txtv=0"}, WithoutProbing())
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer second.Shutdown()
+	if expected := mdnsName + " (2)"; name != expected {
+		t.Fatalf("Expected conflicting instance is %s, but got %s", expected, name)
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := RegisterWithConflictResolution(short, mdnsName, mdnsService, mdnsDomain, mdnsPort+2, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a timeout while probing, but got %v", err)
+	}
+}
+
+// waitPublished waits until the server finished probing for its services.
+func waitPublished(t *testing.T, s *Server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.RLock()
+		n := len(s.probing)
+		s.mu.RUnlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected probing to finish before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// hasRecord reports whether list contains a record of the given name and type.
+func hasRecord(list []dns.RR, name string, rrtype uint16) bool {
+	for _, rr := range list {
+		if strings.EqualFold(rr.Header().Name, name) && rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCacheFlushBit(t *testing.T) {
+	entry := NewServiceEntry(mdnsName, mdnsService, mdnsDomain)
+	entry.HostName = "host.local."
+	entry.Port = mdnsPort
+	entry.AddrIPv4 = []net.IP{net.ParseIP("192.0.2.1")}
+
+	for _, disabled := range []bool{false, true} {
+		s := &Server{ttl: defaultTTL, opts: serverOpts{disableCacheFlush: disabled, hostTTL: defaultHostTTL}}
+		resp := new(dns.Msg)
+		s.composeLookupAnswers(resp, entry, s.ttl, 0)
+		for _, rr := range resp.Answer {
+			flush := rr.Header().Class&qClassCacheFlush != 0
+			switch rr.Header().Rrtype {
+			case dns.TypePTR:
+				if flush {
+					t.Errorf("Expected no cache-flush bit on shared record %v", rr)
+				}
+			default:
+				if flush == disabled {
+					t.Errorf("Expected cache-flush bit %v on unique record %v", !disabled, rr)
+				}
+			}
+		}
+	}
+}
+
+func TestSuppressKnownAnswers(t *testing.T) {
+	ptr := &dns.PTR{
+		Hdr: dns.RR_Header{Name: "_test._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500},
+		Ptr: "instance._test._tcp.local.",
+	}
+	srv := &dns.SRV{
+		Hdr:    dns.RR_Header{Name: "instance._test._tcp.local.", Rrtype: dns.TypeSRV, Class: dns.ClassINET | qClassCacheFlush, Ttl: 120},
+		Port:   8080,
+		Target: "host.local.",
+	}
+	known := func(rr dns.RR, ttl uint32) dns.RR {
+		c := dns.Copy(rr)
+		c.Header().Class = dns.ClassINET
+		c.Header().Ttl = ttl
+		return c
+	}
+
+	if got := suppressKnownAnswers([]dns.RR{ptr, srv}, nil); len(got) != 2 {
+		t.Fatalf("Expected no suppression without known answers, but got %v", got)
+	}
+	if got := suppressKnownAnswers([]dns.RR{ptr, srv}, []dns.RR{known(ptr, 2250), known(srv, 100)}); len(got) != 0 {
+		t.Fatalf("Expected all answers to be suppressed, but got %v", got)
+	}
+	got := suppressKnownAnswers([]dns.RR{ptr, srv}, []dns.RR{known(ptr, 2249)})
+	if len(got) != 2 {
+		t.Fatalf("Expected answers with expiring known answers to be kept, but got %v", got)
+	}
+	other := known(ptr, 4500).(*dns.PTR)
+	other.Ptr = "other._test._tcp.local."
+	if got := suppressKnownAnswers([]dns.RR{ptr}, []dns.RR{other}); len(got) != 1 {
+		t.Fatalf("Expected answer with different data to be kept, but got %v", got)
+	}
+}
+
+func TestParsePacketReuse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // only collect, do not answer
+	s := &Server{truncated: make(map[string]*dns.Msg), shouldShutdown: ctx.Done(), opts: serverOpts{logger: nopLogger{}}}
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	pack := func(truncated bool) []byte {
+		query := new(dns.Msg)
+		query.SetQuestion("_unknown._tcp.local.", dns.TypePTR)
+		query.Truncated = truncated
+		buf, err := query.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+
+	msg := new(dns.Msg)
+	if s.parsePacket(msg, pack(false), 1, from) {
+		t.Fatal("Expected the message of an answered query to be reused")
+	}
+	if !s.parsePacket(msg, pack(true), 1, from) || s.truncated[from.String()] != msg {
+		t.Fatal("Expected the message of a truncated query to be kept")
+	}
+	s.opts.packetHook = func(*dns.Msg, net.Addr, bool) {}
+	if !s.parsePacket(new(dns.Msg), pack(false), 1, from) {
+		t.Fatal("Expected the message passed to a packet hook to be kept")
+	}
+}
+
+func BenchmarkParsePacket(b *testing.B) {
+	s := &Server{truncated: make(map[string]*dns.Msg), opts: serverOpts{logger: nopLogger{}}}
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	query := new(dns.Msg)
+	query.SetQuestion("_unknown._tcp.local.", dns.TypePTR)
+	for i := 0; i < 8; i++ {
+		query.Answer = append(query.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: "_unknown._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500},
+			Ptr: fmt.Sprintf("instance%d._unknown._tcp.local.", i),
+		})
+	}
+	buf, err := query.Pack()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	msg := new(dns.Msg)
+	for i := 0; i < b.N; i++ {
+		if s.parsePacket(msg, buf, 1, from) {
+			msg = new(dns.Msg)
+		}
+	}
+}
+
+func TestCollectKnownAnswers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // only collect, do not answer
+	s := &Server{truncated: make(map[string]*dns.Msg), shouldShutdown: ctx.Done()}
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+
+	query := new(dns.Msg)
+	query.SetQuestion("_test._tcp.local.", dns.TypePTR)
+	query.Truncated = true
+	if s.collectKnownAnswers(query, 1, from) {
+		t.Fatal("Expected truncated query to be held back")
+	}
+	cont := new(dns.Msg)
+	cont.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: "_test._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500},
+		Ptr: "instance._test._tcp.local.",
+	}}
+	if s.collectKnownAnswers(cont, 1, from) {
+		t.Fatal("Expected continuation packet to be merged")
+	}
+	if len(query.Answer) != 1 {
+		t.Fatalf("Expected known answers to be merged into the query, but got %v", query.Answer)
+	}
+	complete := new(dns.Msg)
+	complete.SetQuestion("_other._tcp.local.", dns.TypePTR)
+	if !s.collectKnownAnswers(complete, 1, from) {
+		t.Fatal("Expected a new query from the same host to be answered right away")
+	}
+	if len(query.Question) != 1 {
+		t.Fatalf("Expected the new query not to be merged, but got %v", query.Question)
+	}
+	next := new(dns.Msg)
+	next.SetQuestion("_next._tcp.local.", dns.TypePTR)
+	next.Truncated = true
+	if s.collectKnownAnswers(next, 1, from) {
+		t.Fatal("Expected a new truncated query to be held back")
+	}
+	if s.collectKnownAnswers(cont, 1, from) || len(next.Answer) != 1 || len(query.Answer) != 1 {
+		t.Fatal("Expected continuation packet to be merged into the latest query")
+	}
+	other := new(dns.Msg)
+	other.SetQuestion("_test._tcp.local.", dns.TypePTR)
+	if !s.collectKnownAnswers(other, 1, &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 5353}) {
+		t.Fatal("Expected query from another host to be answered right away")
+	}
+}
+
+func TestSplitKnownAnswers(t *testing.T) {
+	var mu sync.Mutex
+	var answered time.Time
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if outbound && hasSharedRecord(msg.Answer) && answered.IsZero() {
+			answered = time.Now()
+		}
+	}
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil,
+		WithIPVersion(IPv4), WithAnnounceInterval(10*time.Millisecond), WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+	// Wait for the announcements and their rate limit to pass.
+	time.Sleep(multicastRateLimit + 100*time.Millisecond)
+	mu.Lock()
+	answered = time.Time{}
+	mu.Unlock()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: mdnsWildcardIPv4, Port: defaultGroups.port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send := func(m *dns.Msg) {
+		t.Helper()
+		buf, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteTo(buf, defaultGroups.ipv4Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query := new(dns.Msg)
+	query.SetQuestion(server.service.ServiceName(), dns.TypePTR)
+	query.Truncated = true
+	cont := new(dns.Msg)
+	cont.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: server.service.ServiceName(), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: defaultTTL},
+		Ptr: server.service.ServiceInstanceName(),
+	}}
+
+	// The known answer in the continuation packet suppresses the answer.
+	send(query)
+	send(cont)
+	time.Sleep(time.Second)
+	mu.Lock()
+	if !answered.IsZero() {
+		mu.Unlock()
+		t.Fatal("Expected the answer to be suppressed by the known answer")
+	}
+	mu.Unlock()
+
+	// Without continuation, the answer is sent once the delay passed.
+	queried := time.Now()
+	send(query)
+	time.Sleep(time.Second)
+	mu.Lock()
+	defer mu.Unlock()
+	if answered.IsZero() {
+		t.Fatal("Expected the query to be answered")
+	}
+	if d := answered.Sub(queried); d < knownAnswersDelay {
+		t.Fatalf("Expected the response to be delayed by at least %s, but got %s", knownAnswersDelay, d)
+	}
+}
+
+func TestWithTTL(t *testing.T) {
+	for _, ttls := range [][2]uint32{{0, 10}, {10, 0}, {maxHostTTL + 1, 10}, {10, maxTTL + 1}} {
+		if _, err := applyRegisterOptions([]RegisterOption{WithTTL(ttls[0], ttls[1])}); err == nil {
+			t.Errorf("Expected TTLs %v to be rejected", ttls)
+		}
+	}
+
+	opts, err := applyRegisterOptions([]RegisterOption{WithTTL(5, 10)})
+	if err != nil {
+		t.Fatalf("Expected valid TTLs, but got %v", err)
+	}
+	s := &Server{ttl: opts.ttl, opts: opts}
+	entry := NewServiceEntry(mdnsName, mdnsService, mdnsDomain)
+	entry.HostName = "host.local."
+	entry.AddrIPv4 = []net.IP{net.ParseIP("192.0.2.1")}
+	resp := new(dns.Msg)
+	s.composeLookupAnswers(resp, entry, s.ttl, 0)
+	for _, rr := range resp.Answer {
+		expected := uint32(10)
+		switch rr.Header().Rrtype {
+		case dns.TypeSRV, dns.TypeA, dns.TypeAAAA:
+			expected = 5
+		}
+		if rr.Header().Ttl != expected {
+			t.Errorf("Expected TTL %d, but got %v", expected, rr)
+		}
+	}
+
+	resp = new(dns.Msg)
+	s.composeLookupAnswers(resp, entry, 0, 0)
+	for _, rr := range resp.Answer {
+		if rr.Header().Ttl != 0 {
+			t.Errorf("Expected TTL 0 in goodbye, but got %v", rr)
+		}
+	}
+}
+
+func TestNegativeResponses(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.10")}
+	server, err := RegisterProxyAddrs(mdnsName, mdnsService, mdnsDomain, mdnsPort, "proxied-host", ips, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	msg := queryUnicast(t, "proxied-host.local.", dns.TypeAAAA)
+	if len(msg.Answer) != 1 {
+		t.Fatalf("Expected a single NSEC record, but got %v", msg.Answer)
+	}
+	nsec, ok := msg.Answer[0].(*dns.NSEC)
+	if !ok || len(nsec.TypeBitMap) != 1 || nsec.TypeBitMap[0] != dns.TypeA {
+		t.Fatalf("Expected NSEC asserting the A record only, but got %v", msg.Answer[0])
+	}
+
+	msg = queryUnicast(t, server.service.ServiceInstanceName(), dns.TypeSRV)
+	var found bool
+	for _, rr := range msg.Extra {
+		if nsec, ok := rr.(*dns.NSEC); ok && nsec.Hdr.Name == server.service.ServiceInstanceName() {
+			found = len(nsec.TypeBitMap) == 2 && nsec.TypeBitMap[0] == dns.TypeTXT && nsec.TypeBitMap[1] == dns.TypeSRV
+		}
+	}
+	if !found {
+		t.Fatalf("Expected NSEC asserting the TXT and SRV records, but got %v", msg.Extra)
+	}
+}
+
+func TestRefreshInterfaces(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	ifaces := server.interfaces()
+	if err := server.RefreshInterfaces(); err != nil {
+		t.Fatalf("Expected refresh success, but got %v", err)
+	}
+
+	// Pretend the network configuration changed.
+	server.ifacesLock.Lock()
+	server.ifaces = nil
+	server.ifacesState = ""
+	server.ifacesLock.Unlock()
+	server.mu.Lock()
+	server.service.AddrIPv4, server.service.AddrIPv6 = nil, nil
+	server.mu.Unlock()
+	if err := server.RefreshInterfaces(); err != nil {
+		t.Fatalf("Expected refresh success, but got %v", err)
+	}
+	if len(server.Interfaces()) != len(ifaces) {
+		t.Fatalf("Expected interfaces %v, but got %v", ifaces, server.Interfaces())
+	}
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	if len(server.service.AddrIPv4) == 0 && len(server.service.AddrIPv6) == 0 {
+		t.Fatal("Expected the host addresses to be updated")
+	}
+}
+
+func TestWithIPVersion(t *testing.T) {
+	if _, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithIPVersion(0)); err == nil {
+		t.Fatal("Expected register to fail without an IP version")
+	}
+
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithIPVersion(IPv4), WithoutProbing())
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	if server.ipv4conn == nil || server.ipv6conn != nil {
+		t.Fatal("Expected an IPv4 connection only")
+	}
+}
+
+func TestCoalesceAnswers(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	other, err := server.AddService(mdnsName, "_other._tcp", mdnsDomain, mdnsPort, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitPublished(t, server)
+
+	m := new(dns.Msg)
+	m.Question = []dns.Question{
+		{Name: server.service.ServiceName(), Qtype: dns.TypePTR, Qclass: dns.ClassINET | qClassCacheFlush},
+		{Name: other.entry.ServiceName(), Qtype: dns.TypePTR, Qclass: dns.ClassINET | qClassCacheFlush},
+	}
+	resp := sendQuery(t, m)
+	if len(resp.Answer) != 2 {
+		t.Fatalf("Expected the answers to both questions in one response, but got %v", resp.Answer)
+	}
+}
+
+func TestConflictHandler(t *testing.T) {
+	conflicts := make(chan string, 1)
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithConflictHandler(func(record string) {
+		conflicts <- record
+	}))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	own := &dns.SRV{
+		Hdr:    dns.RR_Header{Name: server.service.ServiceInstanceName(), Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+		Target: server.service.HostName,
+		Port:   uint16(mdnsPort),
+	}
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Answer = []dns.RR{own}
+	server.handleResponse(resp)
+	select {
+	case record := <-conflicts:
+		t.Fatalf("Expected no conflict for the own record, but got %s", record)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	other := dns.Copy(own).(*dns.SRV)
+	other.Target = "otherhost.local."
+	resp.Answer = []dns.RR{other}
+	server.handleResponse(resp)
+	select {
+	case record := <-conflicts:
+		if record != server.service.ServiceInstanceName() {
+			t.Fatalf("Expected a conflict for %s, but got %s", server.service.ServiceInstanceName(), record)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the conflict to be reported")
+	}
+}
+
+func TestRegisterContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := RegisterContext(ctx, mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected register to fail before probing finished, but got %v", err)
+	}
+
+	var mu sync.Mutex
+	var announced bool
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if outbound && msg.Response && len(msg.Answer) > 0 {
+			announced = true
+		}
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, err := RegisterContext(ctx, mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	mu.Lock()
+	defer mu.Unlock()
+	if !announced {
+		t.Fatal("Expected the service to be announced")
+	}
+}
+
+func TestAnnounceCallback(t *testing.T) {
+	var mu sync.Mutex
+	var announced []string
+	var errs []error
+	callback := func(iface net.Interface, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		announced = append(announced, iface.Name)
+		errs = append(errs, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, err := RegisterContext(ctx, mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithAnnounceCallback(callback))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	server.Shutdown()
+	mu.Lock()
+	if len(announced) != len(server.interfaces()) {
+		t.Fatalf("Expected a callback per interface %v, but got %v", server.interfaces(), announced)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Expected the announcement on %s to succeed, but got %v", announced[i], err)
+		}
+	}
+	announced, errs = nil, nil
+	mu.Unlock()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	server, err = RegisterContext(ctx, mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil,
+		WithRegisterConnIPv4(conn), WithoutProbing(), WithAnnounceCallback(callback))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	server.Shutdown()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) == 0 {
+		t.Fatal("Expected the callback to be called")
+	}
+	for _, err := range errs {
+		if err == nil {
+			t.Fatal("Expected sending on a closed connection to fail")
+		}
+	}
+}
+
+func TestIPv6MulticastGroup(t *testing.T) {
+	for _, group := range []net.IP{nil, net.ParseIP("fd00::1"), net.IPv4(224, 0, 0, 251)} {
+		if _, err := applyRegisterOptions([]RegisterOption{WithRegisterIPv6MulticastGroup(group)}); err == nil {
+			t.Fatalf("Expected %v to be rejected as IPv6 multicast group", group)
+		}
+	}
+	opts, err := applyRegisterOptions([]RegisterOption{WithRegisterIPv6MulticastGroup(net.ParseIP("ff05::fb"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := opts.groups.ipv6Addr().String(); addr != "[ff05::fb]:5353" {
+		t.Fatalf("Expected the site-local group, but got %s", addr)
+	}
+	if _, err := NewResolver(WithIPv6MulticastGroup(net.ParseIP("fd00::1"))); err == nil {
+		t.Fatal("Expected create resolver to fail with an invalid IPv6 multicast group")
+	}
+}
+
+func TestWithRandSource(t *testing.T) {
+	delays := func() []time.Duration {
+		opts, err := applyRegisterOptions([]RegisterOption{WithRandSource(rand.NewSource(42))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{opts: opts}
+		var delays []time.Duration
+		for i := 0; i < 10; i++ {
+			delays = append(delays, s.responseDelay())
+		}
+		return delays
+	}
+	first, second := delays(), delays()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected the same delays from the same source, but got %v and %v", first, second)
+		}
+		if first[i] < 20*time.Millisecond || first[i] >= 120*time.Millisecond {
+			t.Fatalf("Expected delays between 20ms and 120ms, but got %s", first[i])
+		}
+	}
+}
+
+func TestServices(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	if _, err := server.AddService(mdnsName, "_other._tcp", mdnsDomain, mdnsPort+1, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitPublished(t, server)
+
+	services := make(map[string]*ServiceEntry)
+	for _, e := range server.Services() {
+		services[e.Service] = e
+	}
+	if len(services) != 2 {
+		t.Fatalf("Expected two services, but got %d", len(services))
+	}
+	if e := services[mdnsService]; e == nil || e.Port != mdnsPort || len(e.Text) != 1 {
+		t.Fatalf("Expected the registered service, but got %+v", e)
+	}
+	if e := services["_other._tcp"]; e == nil || e.Port != mdnsPort+1 {
+		t.Fatalf("Expected the added service, but got %+v", e)
+	}
+	// The snapshot doesn't change the services announced.
+	services[mdnsService].Text[0] = "txtv=1"
+	if text := server.service.Text; text[0] != "txtv=0" {
+		t.Fatalf("Expected the text to be unchanged, but got %v", text)
+	}
+}
+
+func TestWithoutAdditionalRecords(t *testing.T) {
+	for _, without := range []bool{false, true} {
+		var opts []RegisterOption
+		if without {
+			opts = append(opts, WithoutAdditionalRecords())
+		}
+		server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, opts...)
+		if err != nil {
+			t.Fatalf("Expected register success, but got %v", err)
+		}
+		waitPublished(t, server)
+		m := new(dns.Msg)
+		m.SetQuestion(server.service.ServiceName(), dns.TypePTR)
+		resp := sendQuery(t, m)
+		server.Shutdown()
+
+		if len(resp.Answer) != 1 {
+			t.Fatalf("Expected the PTR record, but got %v", resp.Answer)
+		}
+		var srv bool
+		for _, rr := range resp.Extra {
+			if _, ok := rr.(*dns.SRV); ok {
+				srv = true
+			}
+		}
+		if without && len(resp.Extra) > 0 {
+			t.Fatalf("Expected no additional records, but got %v", resp.Extra)
+		}
+		if !without && !srv {
+			t.Fatalf("Expected the SRV record in the additional section, but got %v", resp.Extra)
+		}
+	}
+}
+
+func TestWithSRVTarget(t *testing.T) {
+	const target = "bigserver.local."
+	if _, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithSRVTarget("big..server", false)); err == nil {
+		t.Fatal("Expected an invalid SRV target to be rejected")
+	}
+	for _, answerAddrs := range []bool{false, true} {
+		server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithSRVTarget(target, answerAddrs))
+		if err != nil {
+			t.Fatalf("Expected register success, but got %v", err)
+		}
+		waitPublished(t, server)
+		m := new(dns.Msg)
+		m.SetQuestion(server.service.ServiceInstanceName(), dns.TypeSRV)
+		resp := sendQuery(t, m)
+		server.Shutdown()
+
+		var srv *dns.SRV
+		var addrs int
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			switch rr := rr.(type) {
+			case *dns.SRV:
+				srv = rr
+			case *dns.A, *dns.AAAA:
+				if rr.Header().Name != target {
+					t.Fatalf("Expected address records of %s, but got %v", target, rr)
+				}
+				addrs++
+			case *dns.NSEC:
+				if rr.Hdr.Name == target && !answerAddrs {
+					t.Fatalf("Expected no NSEC record for %s, but got %v", target, rr)
+				}
+			}
+		}
+		if srv == nil || srv.Target != target {
+			t.Fatalf("Expected an SRV record pointing at %s, but got %v", target, resp.Answer)
+		}
+		if answerAddrs && addrs == 0 {
+			t.Fatalf("Expected address records, but got %v", resp.Extra)
+		}
+		if !answerAddrs && addrs > 0 {
+			t.Fatalf("Expected no address records, but got %v", resp.Extra)
+		}
+	}
+}
+
+func TestWithoutAddressRecords(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithoutAddressRecords(), WithHostname("myhost"))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	m := new(dns.Msg)
+	m.SetQuestion(server.service.ServiceName(), dns.TypePTR)
+	resp := sendQuery(t, m)
+	var srv *dns.SRV
+	for _, rr := range append(resp.Answer, resp.Extra...) {
+		switch rr := rr.(type) {
+		case *dns.SRV:
+			srv = rr
+		case *dns.A, *dns.AAAA:
+			t.Fatalf("Expected no address records, but got %v", rr)
+		}
+	}
+	if srv == nil || srv.Target != "myhost.local." {
+		t.Fatalf("Expected an SRV record pointing at myhost.local., but got %v", resp.Extra)
+	}
+
+	// Queries for the host are left to its owner.
+	q := new(dns.Msg)
+	q.SetQuestion("myhost.local.", dns.TypeA)
+	r := new(dns.Msg)
+	if err := server.handleQuestion(q.Question[0], r, q, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) > 0 || len(r.Extra) > 0 {
+		t.Fatalf("Expected no answer for the host, but got %v", r)
+	}
+}
+
+func TestAddressRecordOptionsOrder(t *testing.T) {
+	for _, tc := range []struct {
+		options []RegisterOption
+		noAddrs bool
+	}{
+		{[]RegisterOption{WithoutAddressRecords(), WithSRVTarget("bigserver.local.", true)}, true},
+		{[]RegisterOption{WithSRVTarget("bigserver.local.", true), WithoutAddressRecords()}, true},
+		{[]RegisterOption{WithSRVTarget("bigserver.local.", true)}, false},
+		{[]RegisterOption{WithSRVTarget("bigserver.local.", false)}, true},
+		{nil, false},
+	} {
+		opts, err := applyRegisterOptions(tc.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.noAddrs != tc.noAddrs {
+			t.Fatalf("Expected address records to be left out: %v, but got %v", tc.noAddrs, opts.noAddrs)
+		}
+	}
+}
+
+func TestSplitResponse(t *testing.T) {
+	resp := new(dns.Msg)
+	for i := 0; i < 100; i++ {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: fmt.Sprintf("instance%d._http._tcp.local.", i), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120},
+			Txt: []string{strings.Repeat("x", 200)},
+		})
+	}
+	resp.Extra = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "host.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+		A:   net.ParseIP("192.0.2.1"),
+	}}
+
+	msgs := splitResponse(resp, maxResponseSize)
+	if len(msgs) < 2 {
+		t.Fatalf("Expected the response to be split, but got %d messages", len(msgs))
+	}
+	var answers int
+	for _, msg := range msgs {
+		if msg.Len() > maxResponseSize {
+			t.Fatalf("Expected at most %d bytes, but got %d", maxResponseSize, msg.Len())
+		}
+		answers += len(msg.Answer)
+	}
+	if answers != len(resp.Answer) {
+		t.Fatalf("Expected %d answers, but got %d", len(resp.Answer), answers)
+	}
+	if len(msgs[len(msgs)-1].Extra) != 1 {
+		t.Fatal("Expected the additional record in the last message")
+	}
+}
+
+func TestTXTMap(t *testing.T) {
+	for _, opt := range []RegisterOption{
+		WithTXTMap(map[string]string{"": "x"}),
+		WithTXTMap(map[string]string{"a=b": "c"}),
+		WithTXTMap(map[string]string{"long": strings.Repeat("x", 255)}),
+		WithTXTFlags("flag="),
+	} {
+		if _, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, opt); err == nil {
+			t.Fatal("Expected register to fail with an invalid TXT attribute")
+		}
+	}
+
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtvers=1"}, nil,
+		WithTXTMap(map[string]string{"model": "X 1", "note": ""}),
+		WithTXTMap(map[string]string{"color": "yes"}),
+		WithTXTFlags("duplex"))
+	if err != nil {
+		t.Fatalf("Expected create server success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	expected := []string{"txtvers=1", "color=yes", "model=X 1", "note=", "duplex"}
+	if !equalText(server.service.Text, expected) {
+		t.Fatalf("Expected text %q, but got %q", expected, server.service.Text)
+	}
+}
+
+func TestShutdownLeaks(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	for i := 0; i < 10; i++ {
+		// Shut down while probing, announcing and repeating announcements.
+		server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithInterfaceWatcher(time.Second))
+		if err != nil {
+			t.Fatalf("Expected create server success, but got %v", err)
+		}
+		if i%2 == 1 {
+			waitPublished(t, server)
+			server.SetText([]string{"txtv=1"})
+			if err := server.AddSubtype("_printer"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := server.AddService(mdnsName+"-2", mdnsService, mdnsDomain, mdnsPort, nil); err != nil {
+			t.Fatal(err)
+		}
+		server.Shutdown()
+	}
+}
+
+func TestClosedUserConn(t *testing.T) {
+	ignore := goleak.IgnoreCurrent()
+	logger := new(syncLogger)
+	conn := new(memNetwork).conn("198.51.100.1")
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil,
+		WithRegisterConnIPv4(conn), WithoutProbing(), WithRegisterLogger(logger))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	// Let the announcements pass, leaving the receiving goroutine only.
+	time.Sleep(2 * time.Second)
+
+	conn.Close()
+	if err := goleak.Find(ignore); err != nil {
+		t.Fatalf("Expected receiving to stop once the connection is closed, but got %v", err)
+	}
+	if lines := logger.String(); !strings.Contains(lines, "failed to receive") {
+		t.Fatalf("Expected the error to be logged, but got %q", lines)
+	}
+}
+
+// syncLogger records the lines logged by concurrent goroutines.
+type syncLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *syncLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *syncLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+func TestRemoveServiceGoodbye(t *testing.T) {
+	var mu sync.Mutex
+	var goodbyes, typeGoodbyes int
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !outbound {
+			return
+		}
+		for _, rr := range msg.Answer {
+			if rr.Header().Ttl != 0 {
+				continue
+			}
+			switch {
+			case rr.Header().Rrtype == dns.TypeSRV:
+				goodbyes++
+			case strings.EqualFold(rr.Header().Name, "_services._dns-sd._udp."+mdnsDomain):
+				typeGoodbyes++
+			}
+		}
+	}
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithIPVersion(IPv4), WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	handle, err := server.AddService("other", mdnsService, mdnsDomain, mdnsPort+1, nil)
+	if err != nil {
+		t.Fatalf("Expected add service success, but got %v", err)
+	}
+	waitPublished(t, server)
+
+	if err := server.RemoveService(handle); err != nil {
+		t.Fatalf("Expected remove service success, but got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if goodbyes < goodbyeRepetitions {
+		t.Fatalf("Expected the goodbye to be sent %d times, but got %d", goodbyeRepetitions, goodbyes)
+	}
+	if typeGoodbyes != 0 {
+		t.Fatal("Expected the service type to remain enumerated while another instance is registered")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	var mu sync.Mutex
+	var goodbyes, announcements int
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		if udp, ok := addr.(*net.UDPAddr); !ok || !udp.IP.IsMulticast() || !outbound || !msg.Response || len(msg.Answer) == 0 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if msg.Answer[0].Header().Ttl == 0 {
+			goodbyes++
+		} else {
+			announcements++
+		}
+	}
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil, WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected create server success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+	instance := server.Instance()
+
+	if err := server.Pause(); err != nil {
+		t.Fatalf("Expected pause success, but got %v", err)
+	}
+	mu.Lock()
+	if goodbyes == 0 {
+		t.Fatal("Expected goodbye packets on pause")
+	}
+	announcements = 0
+	mu.Unlock()
+
+	// A paused server answers no queries.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("Expected listen success, but got %v", err)
+	}
+	defer conn.Close()
+	m := new(dns.Msg)
+	m.SetQuestion(mdnsService+"."+mdnsDomain, dns.TypePTR)
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(buf, defaultGroups.ipv4Addr()); err != nil {
+		t.Fatalf("Expected sending the query to succeed, but got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(make([]byte, 65536)); err == nil {
+		t.Fatal("Expected no response while paused")
+	}
+	server.SetText([]string{"txtv=1"})
+	if err := server.Announce(); err == nil {
+		t.Fatal("Expected announcing to fail while paused")
+	}
+	mu.Lock()
+	if announcements > 0 {
+		t.Fatalf("Expected silence while paused, but got %d announcements", announcements)
+	}
+	mu.Unlock()
+
+	if err := server.Resume(); err != nil {
+		t.Fatalf("Expected resume success, but got %v", err)
+	}
+	resp := sendQuery(t, m)
+	var ptr *dns.PTR
+	for _, rr := range resp.Answer {
+		if p, ok := rr.(*dns.PTR); ok {
+			ptr = p
+		}
+	}
+	if ptr == nil || ptr.Ptr != instance+"."+mdnsService+"."+mdnsDomain {
+		t.Fatalf("Expected the instance %s to be answered again, but got %v", instance, resp.Answer)
+	}
+	if !hasRecord(resp.Extra, ptr.Ptr, dns.TypeTXT) {
+		t.Fatalf("Expected the TXT record along with the PTR record, but got %v", resp.Extra)
+	}
+	for _, rr := range resp.Extra {
+		if txt, ok := rr.(*dns.TXT); ok && !equalText(txt.Txt, []string{"txtv=1"}) {
+			t.Fatalf("Expected the text set while paused, but got %q", txt.Txt)
+		}
+	}
+	mu.Lock()
+	if announcements == 0 {
+		t.Fatal("Expected the services to be announced on resume")
+	}
+	mu.Unlock()
+}
+
+func TestDumpRecords(t *testing.T) {
+	server, err := RegisterProxy(mdnsName, mdnsService+",_printer", mdnsDomain, mdnsPort, "myhost", []string{"192.0.2.1"}, []string{"txtvers=1"}, nil, WithoutProbing())
+	if err != nil {
+		t.Fatalf("Expected create server success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	dump := server.DumpRecords()
+	instance := mdnsName + "." + mdnsService + "." + mdnsDomain
+	for _, expected := range []string{
+		fmt.Sprintf("\tSRV\t0 0 %d myhost.local.", mdnsPort),
+		fmt.Sprintf("%s\t%d\tIN\tTXT\t\"txtvers=1\"", instance, defaultTTL),
+		"\tPTR\t" + instance,
+		"_printer._sub." + mdnsService + "." + mdnsDomain,
+		"myhost.local.\t",
+		"\tA\t192.0.2.1",
+	} {
+		if !strings.Contains(dump, expected) {
+			t.Fatalf("Expected %q in the dump, but got:\n%s", expected, dump)
+		}
+	}
+}
+
+func TestSharedInstanceEnumeration(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtvers=1"}, nil)
+	if err != nil {
+		t.Fatalf("Expected create server success, but got %v", err)
+	}
+	defer server.Shutdown()
+	instances := []string{mdnsName, mdnsName + "-2", mdnsName + "-3"}
+	for _, name := range instances[1:] {
+		if _, err := server.AddService(name, mdnsService, mdnsDomain, mdnsPort, []string{"txtvers=1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitPublished(t, server)
+
+	m := new(dns.Msg)
+	m.SetQuestion(mdnsService+"."+mdnsDomain, dns.TypePTR)
+	resp := sendQuery(t, m)
+	var ptrs int
+	for _, rr := range resp.Answer {
+		if _, ok := rr.(*dns.PTR); ok {
+			ptrs++
+		}
+	}
+	if ptrs != len(instances) {
+		t.Fatalf("Expected %d PTR records, but got %v", len(instances), resp.Answer)
+	}
+	for _, name := range instances {
+		instance := name + "." + mdnsService + "." + mdnsDomain
+		for _, rrtype := range []uint16{dns.TypeSRV, dns.TypeTXT} {
+			if !hasRecord(resp.Extra, instance, rrtype) {
+				t.Fatalf("Expected the %s record of %s as additional record, but got %v", dns.TypeToString[rrtype], instance, resp.Extra)
+			}
+		}
+	}
+}
+
+func TestSplitResponseAdditionals(t *testing.T) {
+	resp := new(dns.Msg)
+	for i := 0; i < 100; i++ {
+		instance := fmt.Sprintf("instance%d._http._tcp.local.", i)
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: "_http._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+			Ptr: instance,
+		})
+		resp.Extra = append(resp.Extra, &dns.SRV{
+			Hdr:    dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+			Target: "host.local.",
+		})
+	}
+	resp.Extra = append(resp.Extra, &dns.A{
+		Hdr: dns.RR_Header{Name: "host.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+
+	msgs := splitResponse(resp, minPacketSize)
+	if len(msgs) < 2 {
+		t.Fatalf("Expected the response to be split, but got %d messages", len(msgs))
+	}
+	for _, msg := range msgs {
+		if msg.Len() > minPacketSize {
+			t.Fatalf("Expected at most %d bytes, but got %d", minPacketSize, msg.Len())
+		}
+		for _, rr := range msg.Answer {
+			if !hasRecord(msg.Extra, rr.(*dns.PTR).Ptr, dns.TypeSRV) {
+				t.Fatalf("Expected the SRV record of %s in the same message", rr.(*dns.PTR).Ptr)
+			}
+		}
+		if !hasRecord(msg.Extra, "host.local.", dns.TypeA) {
+			t.Fatal("Expected the address of the SRV target in every message")
+		}
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	if _, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithRegisterMaxPacketSize(100)); err == nil {
+		t.Fatal("Expected register to fail with a too small packet size")
+	}
+
+	const size = 1500
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithRegisterMaxPacketSize(size))
+	if err != nil {
+		t.Fatalf("Expected create server success, but got %v", err)
+	}
+	defer server.Shutdown()
+	// Enough instances for their PTR records not to fit into one packet.
+	const instances = 40
+	for i := 1; i < instances; i++ {
+		name := fmt.Sprintf("%s %02d", strings.Repeat("x", 60), i)
+		if _, err := server.AddService(name, mdnsService, mdnsDomain, mdnsPort, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitPublished(t, server)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("Expected listen success, but got %v", err)
+	}
+	defer conn.Close()
+	m := new(dns.Msg)
+	m.SetQuestion(mdnsService+"."+mdnsDomain, dns.TypePTR)
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(buf, defaultGroups.ipv4Addr()); err != nil {
+		t.Fatalf("Expected sending the query to succeed, but got %v", err)
+	}
+
+	var packets, ptrs int
+	resp := make([]byte, 65536)
+	for ptrs < instances {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFrom(resp)
+		if err != nil {
+			t.Fatalf("Expected %d PTR records, but got %d in %d packets", instances, ptrs, packets)
+		}
+		if n > size {
+			t.Fatalf("Expected packets of at most %d bytes, but got %d", size, n)
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(resp[:n]); err != nil {
+			t.Fatal(err)
+		}
+		packets++
+		for _, rr := range msg.Answer {
+			ptr, ok := rr.(*dns.PTR)
+			if !ok {
+				continue
+			}
+			ptrs++
+			if !hasRecord(msg.Extra, ptr.Ptr, dns.TypeSRV) {
+				t.Fatalf("Expected the SRV record of %s along with its PTR record", ptr.Ptr)
+			}
+		}
+	}
+	if packets < 2 {
+		t.Fatalf("Expected the response to be split, but got %d packet", packets)
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	if _, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithResponseDelay(time.Second, 0)); err == nil {
+		t.Fatal("Expected register to fail with an invalid delay range")
+	}
+
+	var mu sync.Mutex
+	var queried, answered time.Time
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !outbound && !msg.Response && len(msg.Question) > 0 && msg.Question[0].Qtype == dns.TypePTR && queried.IsZero() {
+			queried = time.Now()
+		}
+		if outbound && hasSharedRecord(msg.Answer) && !queried.IsZero() && answered.IsZero() {
+			answered = time.Now()
+		}
+	}
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil,
+		WithResponseDelay(200*time.Millisecond, 300*time.Millisecond), WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+	// Wait for the rate limit of the announcements to pass.
+	time.Sleep(multicastRateLimit)
+
+	// Queries from other ports than the mDNS port are answered by unicast
+	// right away, see TestLegacyUnicast.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: mdnsWildcardIPv4, Port: defaultGroups.port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := new(dns.Msg)
+	m.SetQuestion(server.service.ServiceName(), dns.TypePTR)
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(buf, defaultGroups.ipv4Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+	mu.Lock()
+	defer mu.Unlock()
+	if queried.IsZero() || answered.IsZero() {
+		t.Fatal("Expected the query to be answered")
+	}
+	if d := answered.Sub(queried); d < 200*time.Millisecond {
+		t.Fatalf("Expected the response to be delayed by at least 200ms, but got %s", d)
+	}
+}
+
+func TestWithSubtypes(t *testing.T) {
+	var mu sync.Mutex
+	goodbyes := make(map[string]bool)
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rr := range msg.Answer {
+			if ptr, ok := rr.(*dns.PTR); ok && outbound && ptr.Hdr.Ttl == 0 {
+				goodbyes[ptr.Hdr.Name] = true
+			}
+		}
+	}
+	server, err := Register(mdnsName, mdnsService+",_a", mdnsDomain, mdnsPort, nil, nil, WithSubtypes("_b", "_a"), WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	waitPublished(t, server)
+
+	subtypes := server.service.Subtypes
+	if len(subtypes) != 2 {
+		t.Fatalf("Expected two subtypes, but got %v", subtypes)
+	}
+	for _, subtype := range subtypes {
+		msg := queryUnicast(t, subtype, dns.TypePTR)
+		if len(msg.Answer) != 1 || msg.Answer[0].Header().Name != subtype {
+			t.Fatalf("Expected a PTR record for %s, but got %v", subtype, msg.Answer)
+		}
+	}
+
+	server.Shutdown()
+	mu.Lock()
+	defer mu.Unlock()
+	for _, subtype := range subtypes {
+		if !goodbyes[subtype] {
+			t.Fatalf("Expected a goodbye for %s", subtype)
+		}
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	var mu sync.Mutex
+	var announcements int
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if outbound && msg.Response && hasSharedRecord(msg.Answer) {
+			announcements++
+		}
+	}
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+	// Wait for the initial announcements to pass.
+	time.Sleep(1500 * time.Millisecond)
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return announcements
+	}
+	before := count()
+	if err := server.Announce(); err != nil {
+		t.Fatalf("Expected announce success, but got %v", err)
+	}
+	after := count()
+	if after == before {
+		t.Fatal("Expected an announcement")
+	}
+	if err := server.Announce(); err != nil {
+		t.Fatalf("Expected announce success, but got %v", err)
+	}
+	if count() != after {
+		t.Fatal("Expected the second announcement to be rate limited")
+	}
+}
+
+func TestAnnounceCount(t *testing.T) {
+	for _, n := range []int{1, 9} {
+		if _, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithAnnounceCount(n)); err == nil {
+			t.Fatalf("Expected register to fail with %d announcements", n)
+		}
+	}
+
+	var mu sync.Mutex
+	var sent []time.Time
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if outbound && msg.Response && hasSharedRecord(msg.Answer) {
+			sent = append(sent, time.Now())
+		}
+	}
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil,
+		WithAnnounceCount(3), WithAnnounceInterval(100*time.Millisecond), WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+	time.Sleep(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The packets sent on all interfaces at once make up one announcement.
+	var announcements int
+	for i, ts := range sent {
+		if i == 0 || ts.Sub(sent[i-1]) > 50*time.Millisecond {
+			announcements++
+		}
+	}
+	if announcements != 3 {
+		t.Fatalf("Expected 3 announcements, but got %d", announcements)
+	}
+}
+
+func TestWithHostname(t *testing.T) {
+	for _, hostname := range []string{"zeroconf-printer", "zeroconf-printer.local."} {
+		server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithHostname(hostname))
+		if err != nil {
+			t.Fatalf("Expected register success, but got %v", err)
+		}
+		waitPublished(t, server)
+		if server.service.HostName != "zeroconf-printer.local." {
+			t.Fatalf("Expected host name zeroconf-printer.local., but got %s", server.service.HostName)
+		}
+		msg := queryUnicast(t, "zeroconf-printer.local.", dns.TypeA)
+		if len(msg.Answer) == 0 {
+			t.Fatal("Expected A records of the host")
+		}
+		server.Shutdown()
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	waitPublished(t, server)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := server.ShutdownContext(ctx); err != context.Canceled {
+		t.Fatalf("Expected the goodbyes to be canceled, but got %v", err)
+	}
+	if err := server.ShutdownContext(context.Background()); err == nil {
+		t.Fatal("Expected a second shutdown to fail")
+	}
+
+	var mu sync.Mutex
+	var goodbyes int
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if outbound && len(msg.Answer) > 0 && msg.Answer[0].Header().Ttl == 0 {
+			goodbyes++
+		}
+	}
+	server, err = Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	waitPublished(t, server)
+	if err := server.ShutdownContext(context.Background()); err != nil {
+		t.Fatalf("Expected shutdown success, but got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if goodbyes == 0 {
+		t.Fatal("Expected the goodbyes to be sent before returning")
+	}
+}
+
+func TestQueryRateLimit(t *testing.T) {
+	s := &Server{opts: serverOpts{queryRate: 1, queryBurst: 2}}
+	from := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 5353}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if !s.allowQuery(from, now) {
+			t.Fatalf("Expected query %d to be allowed", i)
+		}
+	}
+	if s.allowQuery(from, now) {
+		t.Fatal("Expected the query beyond the burst to be dropped")
+	}
+	if !s.allowQuery(other, now) {
+		t.Fatal("Expected a query from another address to be allowed")
+	}
+	if !s.allowQuery(from, now.Add(time.Second)) {
+		t.Fatal("Expected a query to be allowed after the bucket refilled")
+	}
+}
+
+func TestLegacyUnicast(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	// A plain query from an ephemeral port is answered by unicast.
+	m := new(dns.Msg)
+	m.SetQuestion(server.service.ServiceInstanceName(), dns.TypeSRV)
+	resp := sendQuery(t, m)
+	if resp.Id != m.Id {
+		t.Fatalf("Expected the query ID %d, but got %d", m.Id, resp.Id)
+	}
+	if len(resp.Question) != 1 || resp.Question[0] != m.Question[0] {
+		t.Fatalf("Expected the question to be repeated, but got %v", resp.Question)
+	}
+	if len(resp.Answer) == 0 {
+		t.Fatal("Expected an answer")
+	}
+	for _, rr := range append(resp.Answer, resp.Extra...) {
+		if rr.Header().Class&qClassCacheFlush != 0 {
+			t.Fatalf("Expected no cache-flush bit, but got %v", rr)
+		}
+		if rr.Header().Ttl > legacyTTL {
+			t.Fatalf("Expected a TTL of at most %d, but got %v", legacyTTL, rr)
+		}
+	}
+}
+
+func TestNoMulticastLoopback(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithIPVersion(IPv4), WithNoMulticastLoopback())
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	loop, err := server.ipv4conn.(*ipv4.PacketConn).MulticastLoopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loop {
+		t.Fatal("Expected multicast loopback to be disabled")
+	}
+}
+
+func TestMulticastHopLimit(t *testing.T) {
+	if _, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithRegisterMulticastHopLimit(256)); err == nil {
+		t.Fatal("Expected register to fail with an invalid hop limit")
+	}
+	for _, limit := range []int{0, 1} {
+		opts := []RegisterOption{WithIPVersion(IPv4)}
+		expected := defaultHopLimit
+		if limit > 0 {
+			opts = append(opts, WithRegisterMulticastHopLimit(limit))
+			expected = limit
+		}
+		server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, opts...)
+		if err != nil {
+			t.Fatalf("Expected register success, but got %v", err)
+		}
+		ttl, err := server.ipv4conn.(*ipv4.PacketConn).MulticastTTL()
+		server.Shutdown()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl != expected {
+			t.Fatalf("Expected a multicast TTL of %d, but got %d", expected, ttl)
+		}
+	}
+}
+
+func TestRequireLinkLocalTTL(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithIPVersion(IPv4), WithRegisterRequireLinkLocalTTL(true))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("Expected listen success, but got %v", err)
+	}
+	defer conn.Close()
+	m := new(dns.Msg)
+	m.SetQuestion(server.service.ServiceInstanceName(), dns.TypeSRV)
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 65536)
+	for _, ttl := range []int{1, 255} {
+		if err := ipv4.NewPacketConn(conn).SetMulticastTTL(ttl); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteTo(buf, defaultGroups.ipv4Addr()); err != nil {
+			t.Fatalf("Expected sending the query to succeed, but got %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, _, err := conn.ReadFrom(resp)
+		if ttl == 1 {
+			if err == nil {
+				t.Fatal("Expected a query with a TTL of 1 to be dropped")
+			}
+			if dropped := server.Stats().DroppedPackets; dropped == 0 {
+				t.Fatal("Expected the dropped query to be counted")
+			}
+		} else if err != nil {
+			t.Fatalf("Expected a response to a query with a TTL of 255, but got %v", err)
+		}
+	}
+}
+
+func TestWithExtraRecords(t *testing.T) {
+	name := "_fancy._sub." + mdnsService + ".local."
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120},
+		Txt: []string{"fancy=1"},
+	}
+	if _, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithExtraRecords([]dns.RR{nil})); err == nil {
+		t.Fatal("Expected register to fail with a nil record")
+	}
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithExtraRecords([]dns.RR{txt}))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+
+	msg := queryUnicast(t, name, dns.TypeTXT)
+	if len(msg.Answer) != 1 {
+		t.Fatalf("Expected the extra record, but got %v", msg.Answer)
+	}
+	if answer, ok := msg.Answer[0].(*dns.TXT); !ok || answer.Txt[0] != "fancy=1" {
+		t.Fatalf("Expected the extra TXT record, but got %v", msg.Answer[0])
+	}
+}
+
+func TestAddRemoveSubtype(t *testing.T) {
+	var mu sync.Mutex
+	ttls := make(map[string]uint32)
+	hook := func(msg *dns.Msg, addr net.Addr, outbound bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !outbound || len(msg.Answer) != 1 {
+			return
+		}
+		if ptr, ok := msg.Answer[0].(*dns.PTR); ok {
+			ttls[ptr.Hdr.Name] = ptr.Hdr.Ttl
+		}
+	}
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil, WithSubtypes("_duplex"), WithRegisterPacketHook(hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	waitPublished(t, server)
+	duplex := server.service.Subtypes[0]
+
+	if err := server.RemoveSubtype("_color"); err == nil {
+		t.Fatal("Expected removing an unknown subtype to fail")
+	}
+	if err := server.RemoveSubtype("_duplex"); err != nil {
+		t.Fatalf("Expected removing the subtype to succeed, but got %v", err)
+	}
+	if err := server.AddSubtype("_color"); err != nil {
+		t.Fatalf("Expected adding a subtype to succeed, but got %v", err)
+	}
+	color := server.service.Subtypes[0]
+	if len(server.service.Subtypes) != 1 || !strings.HasPrefix(color, "_color._sub.") {
+		t.Fatalf("Expected the _color subtype only, but got %v", server.service.Subtypes)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if ttl, ok := ttls[duplex]; !ok || ttl != 0 {
+		t.Fatalf("Expected a goodbye for %s", duplex)
+	}
+	if ttl := ttls[color]; ttl == 0 {
+		t.Fatalf("Expected an announcement of %s", color)
+	}
+}
+
+func TestAddressReuse(t *testing.T) {
+	first, err := listenMulticast("udp4", &net.UDPAddr{IP: mdnsWildcardIPv4}, true)
+	if err != nil {
+		t.Fatalf("Expected listen success, but got %v", err)
+	}
+	defer first.Close()
+	addr := &net.UDPAddr{IP: mdnsWildcardIPv4, Port: first.LocalAddr().(*net.UDPAddr).Port}
+
+	// Another responder, like the system's mDNS daemon, may share the port.
+	second, err := listenMulticast("udp4", addr, true)
+	if err != nil {
+		t.Fatalf("Expected the port to be shared, but got %v", err)
+	}
+	second.Close()
+
+	if conn, err := listenMulticast("udp4", addr, false); err == nil {
+		conn.Close()
+		t.Fatal("Expected exclusive binding of a port in use to fail")
+	}
+}
+
+func TestPacketReader(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := ipv4.NewPacketConn(conn)
+	defer pc.Close()
+	if err := pc.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		t.Skipf("control messages unsupported: %v", err)
+	}
+
+	sender, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	const count = readBatchSize + 2
+	for i := 0; i < count; i++ {
+		if _, err := sender.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read, release := newPacketReader(pc)
+	defer release()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var received int
+	for received < count {
+		packets, err := read()
+		if err != nil {
+			t.Fatalf("Expected %d packets, but got %d: %v", count, received, err)
+		}
+		for _, p := range packets {
+			if len(p.data) != 1 || int(p.data[0]) != received {
+				t.Fatalf("Expected packet %d, but got %v", received, p.data)
+			}
+			if p.ifIndex == 0 || p.src.String() != sender.LocalAddr().String() {
+				t.Fatalf("Expected the interface and source of the packet, but got %d and %v", p.ifIndex, p.src)
+			}
+			received++
+		}
+	}
+}
+
+func TestSourceAddr(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo *net.Interface
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 {
+			lo = &ifaces[i]
+		}
+	}
+	if lo == nil {
+		t.Skip("no loopback interface available")
+	}
+	if src := sourceAddr(lo.Index, net.ParseIP("127.0.0.2")); !src.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("Expected to respond from 127.0.0.1, but got %v", src)
+	}
+	if src := sourceAddr(lo.Index, net.ParseIP("198.51.100.1")); src != nil {
+		t.Fatalf("Expected no source address for a querier on another link, but got %v", src)
+	}
+}
@@ -3,6 +3,8 @@ package zeroconf
 import (
 	"fmt"
 	"net"
+	"net/netip"
+	"strings"
 	"sync"
 )
 
@@ -10,7 +12,7 @@ import (
 type ServiceRecord struct {
 	Instance string   `json:"name"`     // Instance name (e.g. "My web page")
 	Service  string   `json:"type"`     // Service name (e.g. _http._tcp.)
-	Subtypes []string `json:"subtypes"` // Service subtypes
+	Subtypes []string `json:"subtypes"` // Service subtypes (e.g. _printer._sub._http._tcp.local.)
 	Domain   string   `json:"domain"`   // If blank, assumes "local"
 
 	// private variable populated on ServiceRecord creation
@@ -46,9 +48,7 @@ func NewServiceRecord(instance, service string, domain string) *ServiceRecord {
 		serviceName: fmt.Sprintf("%s.%s.", trimDot(service), trimDot(domain)),
 	}
 
-	for _, subtype := range subtypes {
-		s.Subtypes = append(s.Subtypes, fmt.Sprintf("%s._sub.%s", trimDot(subtype), s.serviceName))
-	}
+	s.addSubtypes(subtypes)
 
 	// Cache service instance name
 	if instance != "" {
@@ -65,14 +65,34 @@ func NewServiceRecord(instance, service string, domain string) *ServiceRecord {
 	return s
 }
 
+// addSubtypes adds the given subtypes, e.g. _printer, to the record unless it
+// contains them already.
+func (s *ServiceRecord) addSubtypes(subtypes []string) {
+outer:
+	for _, subtype := range subtypes {
+		name := fmt.Sprintf("%s._sub.%s", trimDot(subtype), s.serviceName)
+		for _, existing := range s.Subtypes {
+			if existing == name {
+				continue outer
+			}
+		}
+		s.Subtypes = append(s.Subtypes, name)
+	}
+}
+
 // lookupParams contains configurable properties to create a service discovery request
 type lookupParams struct {
 	ServiceRecord
 	Entries chan<- *ServiceEntry // Entries Channel
 
+	others      []*ServiceRecord // further services browsed for, see BrowseMany
 	isBrowsing  bool
+	watch       bool // deliver changes of host, port and addresses, see Watch
+	needAddrs   bool // only deliver entries with at least one address
 	stopProbing chan struct{}
 	once        sync.Once
+	resetQuery  chan struct{} // restarts the query interval
+	known       knownAnswers  // PTR records received while browsing
 }
 
 // newLookupParams constructs a lookupParams.
@@ -81,6 +101,7 @@ func newLookupParams(instance, service, domain string, isBrowsing bool, entries
 		ServiceRecord: *NewServiceRecord(instance, service, domain),
 		Entries:       entries,
 		isBrowsing:    isBrowsing,
+		resetQuery:    make(chan struct{}, 1),
 	}
 	if !isBrowsing {
 		p.stopProbing = make(chan struct{})
@@ -88,12 +109,62 @@ func newLookupParams(instance, service, domain string, isBrowsing bool, entries
 	return p
 }
 
+// records returns the records of all services looked up.
+func (l *lookupParams) records() []*ServiceRecord {
+	return append([]*ServiceRecord{&l.ServiceRecord}, l.others...)
+}
+
+// recordByServiceName returns the record of the service looked up with the
+// given service name, if any.
+func (l *lookupParams) recordByServiceName(name string) *ServiceRecord {
+	for _, rec := range l.records() {
+		if rec.ServiceName() == name {
+			return rec
+		}
+	}
+	return nil
+}
+
+// recordBySubtypeName returns the record of the service looked up which the
+// given subtype name, e.g. _printer._sub._http._tcp.local., belongs to, if any.
+func (l *lookupParams) recordBySubtypeName(name string) *ServiceRecord {
+	for _, rec := range l.records() {
+		if strings.HasSuffix(name, "._sub."+rec.ServiceName()) {
+			return rec
+		}
+	}
+	return nil
+}
+
+// recordByInstanceName returns the record of the service looked up which the
+// given service instance name belongs to, if any.
+func (l *lookupParams) recordByInstanceName(name string) *ServiceRecord {
+	for _, rec := range l.records() {
+		if rec.ServiceInstanceName() != "" {
+			if rec.ServiceInstanceName() == name {
+				return rec
+			}
+		} else if strings.HasSuffix(name, "."+rec.ServiceName()) {
+			return rec
+		}
+	}
+	return nil
+}
+
 // Notify subscriber that no more entries will arrive. Mostly caused
 // by an expired context.
 func (l *lookupParams) done() {
 	close(l.Entries)
 }
 
+// resetQueryInterval asks for querying at the initial interval again.
+func (l *lookupParams) resetQueryInterval() {
+	select {
+	case l.resetQuery <- struct{}{}:
+	default:
+	}
+}
+
 func (l *lookupParams) disableProbing() {
 	l.once.Do(func() { close(l.stopProbing) })
 }
@@ -105,10 +176,169 @@ type ServiceEntry struct {
 	ServiceRecord
 	HostName string   `json:"hostname"` // Host machine DNS name
 	Port     int      `json:"port"`     // Service Port
+	Priority uint16   `json:"priority"` // Priority of the SRV record
+	Weight   uint16   `json:"weight"`   // Weight of the SRV record
 	Text     []string `json:"text"`     // Service info served as a TXT record
-	TTL      uint32   `json:"ttl"`      // TTL of the service record
+	TTL      uint32   `json:"ttl"`      // Minimum TTL of the records of the entry, 0 if removed
 	AddrIPv4 []net.IP `json:"-"`        // Host machine IPv4 address
 	AddrIPv6 []net.IP `json:"-"`        // Host machine IPv6 address
+	IfIndex  int      `json:"ifindex"`  // Index of the interface the entry was received on
+	// Zone of each address in AddrIPv6, i.e. the name of the receiving
+	// interface for link-local addresses and empty otherwise.
+	AddrIPv6Zone []string `json:"-"`
+	// Addrs holds the addresses of AddrIPv4 and AddrIPv6, the latter with
+	// their zone.
+	Addrs []netip.Addr `json:"-"`
+	// FromCache is set if the entry was sent from records received
+	// earlier, e.g. when they expired or when the grace period for its
+	// addresses passed, rather than in response to a received packet.
+	FromCache bool `json:"fromcache"`
+	// Changed tells what changed since the entry was delivered the last
+	// time. It is zero for entries delivered for the first time.
+	Changed EntryChange `json:"changed"`
+}
+
+// EntryChange is a set of flags telling which parts of an entry changed.
+type EntryChange uint8
+
+const (
+	// TextChanged is set if the TXT record changed.
+	TextChanged EntryChange = 1 << iota
+	// AddrsChanged is set if the addresses changed.
+	AddrsChanged
+	// SRVChanged is set if the host name, port, priority or weight of the
+	// SRV record changed.
+	SRVChanged
+	// SubtypesChanged is set if the entry was found under further subtypes.
+	SubtypesChanged
+)
+
+// entryChanges returns the changes of entry e compared to prev.
+func entryChanges(prev, e *ServiceEntry) EntryChange {
+	var changes EntryChange
+	if !sameText(prev.Text, e.Text) {
+		changes |= TextChanged
+	}
+	if !sameAddrs(prev.AddrIPv4, e.AddrIPv4) || !sameAddrs(prev.AddrIPv6, e.AddrIPv6) {
+		changes |= AddrsChanged
+	}
+	if prev.HostName != e.HostName || prev.Port != e.Port || prev.Priority != e.Priority || prev.Weight != e.Weight {
+		changes |= SRVChanged
+	}
+	if len(prev.Subtypes) != len(e.Subtypes) {
+		changes |= SubtypesChanged
+	}
+	return changes
+}
+
+// sameText reports whether a and b hold the same strings.
+func sameText(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// clone returns a copy of the entry which shares no slices with it.
+func (s *ServiceEntry) clone() *ServiceEntry {
+	cp := *s
+	cp.Subtypes = append([]string(nil), s.Subtypes...)
+	cp.Text = append([]string(nil), s.Text...)
+	cp.AddrIPv4 = cloneIPs(s.AddrIPv4)
+	cp.AddrIPv6 = cloneIPs(s.AddrIPv6)
+	cp.AddrIPv6Zone = append([]string(nil), s.AddrIPv6Zone...)
+	cp.Addrs = append([]netip.Addr(nil), s.Addrs...)
+	return &cp
+}
+
+// TextMap returns the attributes of the TXT record by key, see RFC6763
+// section 6. For a key listed several times, only the first value counts,
+// regardless of case. A boolean attribute, given as a key without '=', maps to
+// the empty string just like a key with an empty value, see TextFlags to tell
+// them apart.
+func (s *ServiceEntry) TextMap() map[string]string {
+	attrs := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, t := range s.Text {
+		key, value, _ := strings.Cut(t, "=")
+		if key == "" || seen[strings.ToLower(key)] {
+			// Strings without a key are ignored, RFC6763 section 6.4.
+			continue
+		}
+		seen[strings.ToLower(key)] = true
+		attrs[key] = value
+	}
+	return attrs
+}
+
+// TextFlags returns the boolean attributes of the TXT record, i.e. the keys
+// listed without '=', in the order of the record.
+func (s *ServiceEntry) TextFlags() []string {
+	var flags []string
+	seen := make(map[string]bool)
+	for _, t := range s.Text {
+		key, _, hasValue := strings.Cut(t, "=")
+		if key == "" || seen[strings.ToLower(key)] {
+			continue
+		}
+		seen[strings.ToLower(key)] = true
+		if !hasValue {
+			flags = append(flags, key)
+		}
+	}
+	return flags
+}
+
+// AddrPreference selects the IP version listed first by ServiceEntry.AddrPorts.
+type AddrPreference int
+
+const (
+	// PreferIPv4 lists the IPv4 addresses first.
+	PreferIPv4 AddrPreference = iota
+	// PreferIPv6 lists the IPv6 addresses first.
+	PreferIPv6
+)
+
+// AddrPorts returns the addresses of the entry combined with its port, those
+// of the IP version preferred first, e.g. to try connecting to them in order.
+// Link-local IPv6 addresses carry their zone. The addresses of each IP version
+// keep their order.
+func (s *ServiceEntry) AddrPorts(pref AddrPreference) []netip.AddrPort {
+	addrs := s.Addrs
+	if len(addrs) == 0 {
+		addrs = netipAddrs(s.AddrIPv4, s.AddrIPv6, s.AddrIPv6Zone)
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	preferred := make([]netip.AddrPort, 0, len(addrs))
+	var others []netip.AddrPort
+	for _, addr := range addrs {
+		ap := netip.AddrPortFrom(addr, uint16(s.Port))
+		if addr.Is6() == (pref == PreferIPv6) {
+			preferred = append(preferred, ap)
+		} else {
+			others = append(others, ap)
+		}
+	}
+	return append(preferred, others...)
+}
+
+// cloneIPs returns a deep copy of ips.
+func cloneIPs(ips []net.IP) []net.IP {
+	if ips == nil {
+		return nil
+	}
+	cp := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		cp[i] = append(net.IP(nil), ip...)
+	}
+	return cp
 }
 
 // NewServiceEntry constructs a ServiceEntry.
@@ -2,10 +2,16 @@ package zeroconf
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 )
 
@@ -17,28 +23,28 @@ var (
 	mdnsPort    = 8888
 )
 
+// startMDNS registers a service, which is shut down when ctx expires. It
+// returns once the service has been announced.
 func startMDNS(ctx context.Context, port int, name, service, domain string) {
 	// 5353 is default mdns port
-	server, err := Register(name, service, domain, port, []string{"txtv=0", "lo=1", "la=2"}, nil)
+	server, err := RegisterContext(ctx, name, service, domain, port, []string{"txtv=0", "lo=1", "la=2"}, nil)
 	if err != nil {
 		panic(errors.Wrap(err, "while registering mdns service"))
 	}
-	defer server.Shutdown()
 	log.Printf("Published service: %s, type: %s, domain: %s", name, service, domain)
 
-	<-ctx.Done()
-
-	log.Printf("Shutting down.")
-
+	go func() {
+		<-ctx.Done()
+		log.Printf("Shutting down.")
+		server.Shutdown()
+	}()
 }
 
 func TestBasic(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	go startMDNS(ctx, mdnsPort, mdnsName, mdnsService, mdnsDomain)
-
-	time.Sleep(time.Second)
+	startMDNS(ctx, mdnsPort, mdnsName, mdnsService, mdnsDomain)
 
 	resolver, err := NewResolver(nil)
 	if err != nil {
@@ -96,9 +102,7 @@ func TestSubtype(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		go startMDNS(ctx, mdnsPort, mdnsName, mdnsSubtype, mdnsDomain)
-
-		time.Sleep(time.Second)
+		startMDNS(ctx, mdnsPort, mdnsName, mdnsSubtype, mdnsDomain)
 
 		resolver, err := NewResolver(nil)
 		if err != nil {
@@ -126,15 +130,17 @@ func TestSubtype(t *testing.T) {
 		if result.Port != mdnsPort {
 			t.Fatalf("Expected port is %d, but got %d", mdnsPort, result.Port)
 		}
+		subtypes := NewServiceRecord("", mdnsSubtype, mdnsDomain).Subtypes
+		if len(result.Subtypes) != 1 || result.Subtypes[0] != subtypes[0] {
+			t.Fatalf("Expected subtypes %v, but got %v", subtypes, result.Subtypes)
+		}
 	})
 
 	t.Run("browse without subtype", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		go startMDNS(ctx, mdnsPort, mdnsName, mdnsSubtype, mdnsDomain)
-
-		time.Sleep(time.Second)
+		startMDNS(ctx, mdnsPort, mdnsName, mdnsSubtype, mdnsDomain)
 
 		resolver, err := NewResolver(nil)
 		if err != nil {
@@ -162,5 +168,751 @@ func TestSubtype(t *testing.T) {
 		if result.Port != mdnsPort {
 			t.Fatalf("Expected port is %d, but got %d", mdnsPort, result.Port)
 		}
+		subtypes := NewServiceRecord("", mdnsSubtype, mdnsDomain).Subtypes
+		if len(result.Subtypes) != 1 || result.Subtypes[0] != subtypes[0] {
+			t.Fatalf("Expected subtypes %v, but got %v", subtypes, result.Subtypes)
+		}
 	})
 }
+
+func TestRemovals(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+
+	resolver, err := NewResolver(WithRemovals())
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	entries := make(chan *ServiceEntry, 100)
+	if err := resolver.Browse(ctx, mdnsService, mdnsDomain, entries); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+
+	select {
+	case result := <-entries:
+		if result.Instance != mdnsName || result.TTL == 0 {
+			t.Fatalf("Expected entry for %s, but got %v", mdnsName, result)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected service entry before timeout")
+	}
+
+	server.Shutdown()
+
+	select {
+	case result := <-entries:
+		if result.Instance != mdnsName {
+			t.Fatalf("Expected instance is %s, but got %s", mdnsName, result.Instance)
+		}
+		if result.TTL != 0 {
+			t.Fatalf("Expected removal with TTL 0, but got %d", result.TTL)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected removal before timeout")
+	}
+}
+
+func TestAddService(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	const otherService = "_other--xxxx._tcp"
+	handle, err := server.AddService(mdnsName, otherService, mdnsDomain, mdnsPort+1, nil)
+	if err != nil {
+		t.Fatalf("Expected add service success, but got %v", err)
+	}
+	if _, err := server.AddService(mdnsName, otherService, mdnsDomain, mdnsPort+1, nil); err == nil {
+		t.Fatal("Expected adding a duplicate service to fail")
+	}
+
+	resolver, err := NewResolver(WithRemovals())
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	entries := make(chan *ServiceEntry, 100)
+	if err := resolver.Browse(ctx, otherService, mdnsDomain, entries); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+
+	select {
+	case result := <-entries:
+		if result.Service != otherService {
+			t.Fatalf("Expected service is %s, but got %s", otherService, result.Service)
+		}
+		if result.Port != mdnsPort+1 {
+			t.Fatalf("Expected port is %d, but got %d", mdnsPort+1, result.Port)
+		}
+		if len(result.AddrIPv4) == 0 && len(result.AddrIPv6) == 0 {
+			t.Fatal("Expected the shared host addresses")
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected service entry before timeout")
+	}
+
+	if err := server.RemoveService(handle); err != nil {
+		t.Fatalf("Expected remove service success, but got %v", err)
+	}
+	if err := server.RemoveService(handle); err == nil {
+		t.Fatal("Expected removing a service twice to fail")
+	}
+
+	select {
+	case result := <-entries:
+		if result.TTL != 0 {
+			t.Fatalf("Expected removal with TTL 0, but got %d", result.TTL)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected removal before timeout")
+	}
+}
+
+func TestLookupOnce(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+	if result.Instance != mdnsName {
+		t.Fatalf("Expected instance is %s, but got %s", mdnsName, result.Instance)
+	}
+	if result.Port != mdnsPort {
+		t.Fatalf("Expected port is %d, but got %d", mdnsPort, result.Port)
+	}
+	if len(result.AddrIPv4) == 0 && len(result.AddrIPv6) == 0 {
+		t.Fatal("Expected at least one address")
+	}
+	// Control messages are not supported on all platforms.
+	if runtime.GOOS == "linux" && result.IfIndex == 0 {
+		t.Fatal("Expected the index of the receiving interface")
+	}
+
+	resolver, err = NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := resolver.LookupOnce(ctx, "unknown", mdnsService, mdnsDomain); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, but got %v", err)
+	}
+}
+
+func TestBrowseTypes(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	types := make(chan string)
+	if err := resolver.BrowseTypes(ctx, mdnsDomain, types); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+	expected := mdnsService + ".local"
+	for typ := range types {
+		if typ == expected {
+			return
+		}
+	}
+	t.Fatalf("Expected service type %s to be found", expected)
+}
+
+func TestSetText(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"state=idle"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	// Change the text concurrently to answering queries.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			server.SetText([]string{fmt.Sprintf("state=%d", i)})
+		}
+		server.SetText([]string{"state=printing"})
+	}()
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain); err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+	<-done
+
+	resolver, err = NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	result, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+	if len(result.Text) != 1 || result.Text[0] != "state=printing" {
+		t.Fatalf("Expected updated text, but got %v", result.Text)
+	}
+}
+
+func TestSRVPriorityWeight(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil, WithSRVPriorityWeight(10, 20))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+	if result.Priority != 10 || result.Weight != 20 {
+		t.Fatalf("Expected priority 10 and weight 20, but got %d and %d", result.Priority, result.Weight)
+	}
+}
+
+func TestIsolatedPort(t *testing.T) {
+	const port = 5454
+	groupIPv4, groupIPv6 := net.IPv4(224, 0, 0, 252), net.ParseIP("ff02::fc")
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil,
+		WithRegisterPort(port), WithRegisterMulticastGroups(groupIPv4, groupIPv6))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(WithPort(port), WithMulticastGroups(groupIPv4, groupIPv6))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain); err != nil {
+		t.Fatalf("Expected lookup on the isolated port to succeed, but got %v", err)
+	}
+
+	resolver, err = NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain); err != context.DeadlineExceeded {
+		t.Fatalf("Expected service to be invisible on the mDNS port, but got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	server, err := Register(mdnsName+"-b", mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	if _, err := server.AddService(mdnsName+"-a", mdnsService, mdnsDomain, mdnsPort+1, nil); err != nil {
+		t.Fatalf("Expected add service success, but got %v", err)
+	}
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	list, err := resolver.List(ctx, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected list success, but got %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected two entries, but got %d", len(list))
+	}
+	if list[0].Instance != mdnsName+"-a" || list[1].Instance != mdnsName+"-b" {
+		t.Fatalf("Expected entries sorted by instance name, but got %s and %s", list[0].Instance, list[1].Instance)
+	}
+}
+
+func TestBrowseMany(t *testing.T) {
+	const otherService = "_other--xxxx._tcp"
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	if _, err := server.AddService(mdnsName, otherService, mdnsDomain, mdnsPort+1, nil); err != nil {
+		t.Fatalf("Expected add service success, but got %v", err)
+	}
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries := make(chan *ServiceEntry, 100)
+	if err := resolver.BrowseMany(ctx, []string{mdnsService, otherService}, mdnsDomain, entries); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+
+	found := make(map[string]bool)
+	for len(found) < 2 {
+		select {
+		case result := <-entries:
+			found[result.Service] = true
+		case <-ctx.Done():
+			t.Fatalf("Expected entries of both services, but got %v", found)
+		}
+	}
+	if !found[mdnsService] || !found[otherService] {
+		t.Fatalf("Expected entries of both services, but got %v", found)
+	}
+}
+
+// packetCounter counts the packets passed to its hook.
+type packetCounter struct {
+	mu                      sync.Mutex
+	inbound, outbound       int
+	inResponse, outResponse bool
+}
+
+func (c *packetCounter) hook(msg *dns.Msg, addr net.Addr, outbound bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if outbound {
+		c.outbound++
+		c.outResponse = c.outResponse || msg.Response
+	} else {
+		c.inbound++
+		c.inResponse = c.inResponse || msg.Response
+	}
+}
+
+func TestPacketHook(t *testing.T) {
+	var serverPackets, clientPackets packetCounter
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil, WithRegisterPacketHook(serverPackets.hook))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(WithPacketHook(clientPackets.hook))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain); err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+
+	serverPackets.mu.Lock()
+	defer serverPackets.mu.Unlock()
+	if serverPackets.inbound == 0 || !serverPackets.outResponse {
+		t.Fatalf("Expected the server to see queries and send responses, but got %d inbound packets", serverPackets.inbound)
+	}
+	clientPackets.mu.Lock()
+	defer clientPackets.mu.Unlock()
+	if clientPackets.outbound == 0 || !clientPackets.inResponse {
+		t.Fatalf("Expected the client to send queries and see responses, but got %d outbound packets", clientPackets.outbound)
+	}
+}
+
+func TestLongText(t *testing.T) {
+	var text []string
+	for i := 0; i < 40; i++ {
+		text = append(text, fmt.Sprintf("key%02d=value", i))
+	}
+	long := strings.Repeat("x", 300)
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, append(text, long), nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+	expected := append(text, long[:255], long[255:])
+	if len(result.Text) != len(expected) {
+		t.Fatalf("Expected %d TXT strings, but got %d", len(expected), len(result.Text))
+	}
+	for i := range expected {
+		if result.Text[i] != expected[i] {
+			t.Fatalf("Expected TXT string %q, but got %q", expected[i], result.Text[i])
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := resolver.LookupOnce(ctx, mdnsName, mdnsService, mdnsDomain); err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+	waitPublished(t, server)
+	queryUnicast(t, server.service.ServiceName(), dns.TypePTR)
+
+	stats := server.Stats()
+	if stats.PacketsSent == 0 || stats.PacketsReceived == 0 || stats.QueriesAnswered == 0 {
+		t.Fatalf("Expected the server to count packets and answers, but got %+v", stats)
+	}
+	stats = resolver.Stats()
+	if stats.PacketsSent == 0 || stats.PacketsReceived == 0 {
+		t.Fatalf("Expected the resolver to count packets, but got %+v", stats)
+	}
+}
+
+func TestBrowseClosesEntries(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"txtv=0"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	entries := make(chan *ServiceEntry)
+	if err := resolver.Browse(ctx, mdnsService, mdnsDomain, entries); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+	// Don't read the entry found, so that the resolver blocks on sending it.
+	time.Sleep(1500 * time.Millisecond)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for range entries {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected entries channel to be closed after cancelling")
+	}
+}
+
+func TestLookupTXT(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, []string{"status=idle"}, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	text, err := resolver.LookupTXT(ctx, mdnsName, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+	if len(text) != 1 || text[0] != "status=idle" {
+		t.Fatalf("Expected text [status=idle], but got %v", text)
+	}
+}
+
+func TestLookupAddr(t *testing.T) {
+	ip := net.ParseIP("192.0.2.55")
+	server, err := RegisterProxyAddrs(mdnsName, mdnsService, mdnsDomain, mdnsPort, "proxied-host", []net.IP{ip}, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hosts, err := resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+	if len(hosts) != 1 || hosts[0] != "proxied-host.local." {
+		t.Fatalf("Expected host proxied-host.local., but got %v", hosts)
+	}
+}
+
+func TestExcludeSelf(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(WithExcludeSelf(true))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	list, err := resolver.List(ctx, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected list success, but got %v", err)
+	}
+	if len(list) != 0 {
+		t.Fatalf("Expected the own service to be excluded, but got %d entries", len(list))
+	}
+}
+
+func TestAcceptFrom(t *testing.T) {
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	_, documentation, _ := net.ParseCIDR("198.51.100.0/24")
+	resolver, err := NewResolver(WithAcceptFrom([]*net.IPNet{documentation}))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	list, err := resolver.List(ctx, mdnsService, mdnsDomain)
+	if err != nil {
+		t.Fatalf("Expected list success, but got %v", err)
+	}
+	if len(list) != 0 {
+		t.Fatalf("Expected the responses to be dropped, but got %d entries", len(list))
+	}
+	if resolver.Stats().DroppedPackets == 0 {
+		t.Fatal("Expected dropped packets to be counted")
+	}
+}
+
+// memNetwork is an in-memory network segment. Packets sent to the address of
+// a connection are delivered to it, all others to every other connection.
+type memNetwork struct {
+	mu    sync.Mutex
+	conns []*memConn
+}
+
+type memPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// memConn is a connection to a memNetwork.
+type memConn struct {
+	network   *memNetwork
+	addr      *net.UDPAddr
+	in        chan memPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// conn attaches a connection with the given address to the network.
+func (n *memNetwork) conn(ip string) *memConn {
+	c := &memConn{
+		network: n,
+		addr:    &net.UDPAddr{IP: net.ParseIP(ip), Port: defaultGroups.port},
+		in:      make(chan memPacket, 64),
+		closed:  make(chan struct{}),
+	}
+	n.mu.Lock()
+	n.conns = append(n.conns, c)
+	n.mu.Unlock()
+	return c
+}
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p.data), p.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.network.mu.Lock()
+	defer c.network.mu.Unlock()
+	for _, other := range c.network.conns {
+		if other == c || (addr.String() != other.addr.String() && !addr.(*net.UDPAddr).IP.IsMulticast()) {
+			continue
+		}
+		select {
+		case other.in <- memPacket{data: append([]byte(nil), b...), from: c.addr}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return c.addr }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestWithConn(t *testing.T) {
+	network := new(memNetwork)
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil,
+		WithRegisterConnIPv4(network.conn("198.51.100.1")))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+	if server.ipv6conn != nil {
+		t.Fatal("Expected no IPv6 connection")
+	}
+
+	resolver, err := NewResolver(WithConnIPv4(network.conn("198.51.100.2")))
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	entries := make(chan *ServiceEntry)
+	if err := resolver.Lookup(ctx, mdnsName, mdnsService, mdnsDomain, entries); err != nil {
+		t.Fatalf("Expected lookup success, but got %v", err)
+	}
+	select {
+	case e := <-entries:
+		if e.Port != mdnsPort || len(e.AddrIPv4) == 0 {
+			t.Fatalf("Unexpected entry %v", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected to find the service over the in-memory network")
+	}
+}
+
+func TestShortTTLBrowse(t *testing.T) {
+	network := new(memNetwork)
+	server, err := Register(mdnsName, mdnsService, mdnsDomain, mdnsPort, nil, nil,
+		WithRegisterConnIPv4(network.conn("198.51.100.1")), WithTTL(2, 10))
+	if err != nil {
+		t.Fatalf("Expected register success, but got %v", err)
+	}
+	defer server.Shutdown()
+
+	resolver, err := NewResolver(WithConnIPv4(network.conn("198.51.100.2")), WithRemovals())
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	// Browse well past the TTL of the host records, which are only kept by
+	// refreshing them.
+	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
+	defer cancel()
+	entries := make(chan *ServiceEntry, 16)
+	if err := resolver.Browse(ctx, mdnsService, mdnsDomain, entries); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+	start := time.Now()
+	var added int
+	for e := range entries {
+		if e.TTL == 0 {
+			t.Fatalf("Expected the service to stay, but it was removed after %v", time.Since(start))
+		}
+		added++
+	}
+	if added == 0 {
+		t.Fatal("Expected the service to be found")
+	}
+}
+
+func TestBrowseSnapshots(t *testing.T) {
+	network := new(memNetwork)
+	resolver, err := NewResolver(WithConnIPv4(network.conn("198.51.100.1")), WithRemovals())
+	if err != nil {
+		t.Fatalf("Expected create resolver success, but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	entries := make(chan *ServiceEntry)
+	if err := resolver.Browse(ctx, mdnsService, mdnsDomain, entries); err != nil {
+		t.Fatalf("Expected browse success, but got %v", err)
+	}
+
+	// Announce the instances over and over with changing addresses, while
+	// the entries are inspected.
+	announcer := network.conn("198.51.100.2")
+	go func() {
+		for i := 0; ctx.Err() == nil; i++ {
+			msg := testResponse(fmt.Sprintf("instance%d", i%10), fmt.Sprintf("host%d.local.", i%10), net.IPv4(192, 0, 2, byte(i)))
+			buf, err := msg.Pack()
+			if err != nil {
+				panic(err)
+			}
+			announcer.WriteTo(buf, defaultGroups.ipv4Addr())
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	var received int
+	for e := range entries {
+		received++
+		for _, ip := range e.AddrIPv4 {
+			_ = ip.String()
+		}
+		_ = fmt.Sprint(e.Text, e.Subtypes, e.Addrs)
+		// The entry belongs to the subscriber now.
+		e.AddrIPv4 = append(e.AddrIPv4[:0], net.IPv4zero)
+	}
+	if received < 10 {
+		t.Fatalf("Expected entries of all instances, but got %d", received)
+	}
+}
@@ -0,0 +1,82 @@
+package zeroconf
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats holds the counters of a server or resolver. All counters only ever
+// increase.
+type Stats struct {
+	PacketsSent      uint64
+	PacketsReceived  uint64
+	MalformedPackets uint64 // received packets that could not be parsed
+	DroppedPackets   uint64 // received packets dropped, see WithAcceptFrom and WithRequireLinkLocalTTL
+	// Questions answered and questions left unanswered because the querier
+	// knew all answers already. Resolvers don't answer questions, but count
+	// the queries they didn't send because of WithDuplicateQuestionSuppression
+	// as suppressed.
+	QueriesAnswered   uint64
+	QueriesSuppressed uint64
+	// Queries a server dropped, see WithQueryRateLimit.
+	QueriesRateLimited uint64
+	// Addresses and entries a resolver dropped because of its limits, see
+	// WithMaxAddresses, WithMaxEntries and WithEntryBuffer.
+	DroppedAddresses uint64
+	DroppedEntries   uint64
+	// Failed sends by interface index.
+	SendErrors map[int]uint64
+}
+
+// stats collects the counters of Stats. The 64-bit counters come first, so
+// that they are aligned for atomic access on 32-bit platforms.
+type stats struct {
+	packetsSent        uint64
+	packetsReceived    uint64
+	malformedPackets   uint64
+	droppedPackets     uint64
+	queriesAnswered    uint64
+	queriesSuppressed  uint64
+	queriesRateLimited uint64
+	droppedAddrs       uint64
+	droppedEntries     uint64
+
+	sendErrors     map[int]uint64
+	sendErrorsLock sync.Mutex
+}
+
+// written counts a packet sent on the given interface, or the failure to do so.
+func (s *stats) written(ifIndex int, err error) {
+	if err == nil {
+		atomic.AddUint64(&s.packetsSent, 1)
+		return
+	}
+	s.sendErrorsLock.Lock()
+	defer s.sendErrorsLock.Unlock()
+	if s.sendErrors == nil {
+		s.sendErrors = make(map[int]uint64)
+	}
+	s.sendErrors[ifIndex]++
+}
+
+// snapshot returns the current counters.
+func (s *stats) snapshot() Stats {
+	st := Stats{
+		PacketsSent:        atomic.LoadUint64(&s.packetsSent),
+		PacketsReceived:    atomic.LoadUint64(&s.packetsReceived),
+		MalformedPackets:   atomic.LoadUint64(&s.malformedPackets),
+		DroppedPackets:     atomic.LoadUint64(&s.droppedPackets),
+		QueriesAnswered:    atomic.LoadUint64(&s.queriesAnswered),
+		QueriesSuppressed:  atomic.LoadUint64(&s.queriesSuppressed),
+		QueriesRateLimited: atomic.LoadUint64(&s.queriesRateLimited),
+		DroppedAddresses:   atomic.LoadUint64(&s.droppedAddrs),
+		DroppedEntries:     atomic.LoadUint64(&s.droppedEntries),
+		SendErrors:         make(map[int]uint64),
+	}
+	s.sendErrorsLock.Lock()
+	defer s.sendErrorsLock.Unlock()
+	for ifIndex, n := range s.sendErrors {
+		st.SendErrors[ifIndex] = n
+	}
+	return st
+}
@@ -0,0 +1,254 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// From RFC6763
+//    This document [...] also specifies how DNS-SD can be used with
+//    conventional unicast DNS, in domains other than "local.", see section 11.
+//
+// Services in such domains are registered by DNS updates (RFC2136) sent to the
+// authoritative server of the domain, and browsed by regular unicast queries.
+
+// isLocalDomain reports whether domain is the mDNS domain "local.".
+func isLocalDomain(domain string) bool {
+	d := strings.ToLower(trimDot(domain))
+	return d == "" || d == "local"
+}
+
+// isUnicast reports whether services in domain are queried by unicast DNS.
+func (c *client) isUnicast(domain string) bool {
+	return c.opts.unicastResolver != "" && !isLocalDomain(domain)
+}
+
+// withDefaultPort appends the DNS port to addr unless it has a port already.
+func withDefaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, "53")
+}
+
+// registerUnicast registers a service in a unicast DNS domain by a DNS update
+// instead of announcing it by multicast.
+func registerUnicast(entry *ServiceEntry, opts serverOpts) (*Server, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		opts:           opts,
+		probing:        make(map[*ServiceEntry]chan struct{}),
+		ttl:            opts.ttl,
+		ctx:            ctx,
+		cancel:         cancel,
+		shouldShutdown: ctx.Done(),
+		lastMulticast:  make(map[string]time.Time),
+		truncated:      make(map[string]*dns.Msg),
+		unicast:        true,
+	}
+	s.service = entry
+	s.services = []*ServiceEntry{entry}
+	if err := s.updateUnicast(context.Background(), entry, false); err != nil {
+		cancel()
+		return nil, err
+	}
+	return s, nil
+}
+
+// updateUnicast adds the records of entry to its domain, or removes them.
+func (s *Server) updateUnicast(ctx context.Context, entry *ServiceEntry, remove bool) error {
+	resp := new(dns.Msg)
+	s.mu.RLock()
+	s.composeLookupAnswers(resp, entry, s.ttl, 0)
+	s.mu.RUnlock()
+	for _, rr := range s.opts.extraRecords {
+		resp.Answer = append(resp.Answer, dns.Copy(rr))
+	}
+	for _, rr := range resp.Answer {
+		// The cache-flush bit only exists in mDNS.
+		rr.Header().Class = dns.ClassINET
+	}
+
+	return s.exchangeUpdate(ctx, entry.Domain, resp.Answer, remove)
+}
+
+// exchangeUpdate adds the records to the given domain, or removes them.
+func (s *Server) exchangeUpdate(ctx context.Context, domain string, rrs []dns.RR, remove bool) error {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(domain))
+	if remove {
+		m.Remove(rrs)
+	} else {
+		m.Insert(rrs)
+	}
+	r, _, err := new(dns.Client).ExchangeContext(ctx, m, withDefaultPort(s.opts.unicastDNS))
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS update failed: %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+// unicastLoop browses or looks up services in a unicast DNS domain until ctx
+// expires, repeating the queries at increasing intervals.
+func (c *client) unicastLoop(ctx context.Context, params *lookupParams) {
+	defer params.done()
+
+	sent := make(map[string]*ServiceEntry)
+	bo := c.newQueryBackOff()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		entries, err := c.resolveUnicast(ctx, params)
+		if err != nil && ctx.Err() == nil {
+			c.reportError(err)
+		}
+		for _, e := range entries {
+			if params.needAddrs && len(e.AddrIPv4) == 0 && len(e.AddrIPv6) == 0 {
+				continue
+			}
+			if prev, ok := sent[e.ServiceInstanceName()]; ok {
+				e.Changed = entryChanges(prev, e)
+				if !params.watch {
+					// Only watching reports the host moving.
+					e.Changed &= TextChanged
+				}
+				if e.Changed == 0 {
+					continue
+				}
+			}
+			sent[e.ServiceInstanceName()] = e
+			if e = c.applyEntryHooks(e.clone()); e == nil {
+				continue
+			}
+			select {
+			case params.Entries <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		timer.Reset(bo.NextBackOff())
+	}
+}
+
+// resolveUnicast queries the unicast resolver for the services looked up.
+func (c *client) resolveUnicast(ctx context.Context, params *lookupParams) ([]*ServiceEntry, error) {
+	var entries []*ServiceEntry
+	for _, rec := range params.records() {
+		var instances []string
+		if rec.ServiceInstanceName() != "" {
+			instances = []string{rec.ServiceInstanceName()}
+		} else {
+			name := rec.ServiceName()
+			if len(rec.Subtypes) > 0 {
+				name = rec.Subtypes[0]
+			}
+			rrs, err := c.exchangeUnicast(ctx, name, dns.TypePTR)
+			if err != nil {
+				return entries, err
+			}
+			for _, rr := range rrs {
+				if ptr, ok := rr.(*dns.PTR); ok {
+					instances = append(instances, ptr.Ptr)
+				}
+			}
+		}
+
+		for _, instance := range instances {
+			if !c.matchesInstance(trimDot(strings.TrimSuffix(instance, rec.ServiceName()))) {
+				continue
+			}
+			e, err := c.resolveUnicastInstance(ctx, rec, instance)
+			if err != nil {
+				return entries, err
+			}
+			if e != nil {
+				if rec.ServiceInstanceName() == "" && len(rec.Subtypes) > 0 {
+					e.Subtypes = rec.Subtypes[:1]
+				}
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// resolveUnicastInstance queries the records of a service instance. It returns
+// nil if the instance has no SRV record.
+func (c *client) resolveUnicastInstance(ctx context.Context, rec *ServiceRecord, instance string) (*ServiceEntry, error) {
+	e := NewServiceEntry(
+		trimDot(strings.TrimSuffix(instance, rec.ServiceName())),
+		rec.Service,
+		rec.Domain)
+	rrs, err := c.exchangeUnicast(ctx, instance, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range rrs {
+		if srv, ok := rr.(*dns.SRV); ok {
+			e.HostName = srv.Target
+			e.Port = int(srv.Port)
+			e.Priority = srv.Priority
+			e.Weight = srv.Weight
+			e.TTL = srv.Hdr.Ttl
+		}
+	}
+	if e.HostName == "" {
+		return nil, nil
+	}
+
+	rrs, err = c.exchangeUnicast(ctx, instance, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			e.Text = txt.Txt
+		}
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		rrs, err = c.exchangeUnicast(ctx, e.HostName, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.A:
+				e.AddrIPv4 = appendAddr(e.AddrIPv4, rr.A)
+				e.TTL = minTTL(e.TTL, rr.Hdr.Ttl)
+			case *dns.AAAA:
+				e.AddrIPv6 = appendAddr(e.AddrIPv6, rr.AAAA)
+				e.TTL = minTTL(e.TTL, rr.Hdr.Ttl)
+			}
+		}
+	}
+	e.Addrs = netipAddrs(e.AddrIPv4, e.AddrIPv6, nil)
+	return e, nil
+}
+
+// exchangeUnicast queries the unicast resolver and returns the answers.
+func (c *client) exchangeUnicast(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	r, _, err := new(dns.Client).ExchangeContext(ctx, m, withDefaultPort(c.opts.unicastResolver))
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("query for %s failed: %s", name, dns.RcodeToString[r.Rcode])
+	}
+	c.capTTLs(r.Answer)
+	return r.Answer, nil
+}
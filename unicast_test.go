@@ -0,0 +1,143 @@
+package zeroconf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testAuthority is a minimal DNS server accepting updates and answering
+// queries from the records stored.
+type testAuthority struct {
+	mu      sync.Mutex
+	records []dns.RR
+}
+
+func (a *testAuthority) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	a.mu.Lock()
+	if req.Opcode == dns.OpcodeUpdate {
+		for _, rr := range req.Ns {
+			if rr.Header().Class == dns.ClassNONE {
+				a.remove(rr)
+			} else {
+				a.records = append(a.records, rr)
+			}
+		}
+	} else {
+		q := req.Question[0]
+		for _, rr := range a.records {
+			if strings.EqualFold(rr.Header().Name, q.Name) && rr.Header().Rrtype == q.Qtype {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	w.WriteMsg(resp)
+}
+
+func (a *testAuthority) remove(rr dns.RR) {
+	for i, r := range a.records {
+		// Compare a copy, the records kept must keep their class and TTL.
+		c := dns.Copy(r)
+		c.Header().Class, c.Header().Ttl = rr.Header().Class, rr.Header().Ttl
+		if c.String() == rr.String() {
+			a.records = append(a.records[:i], a.records[i+1:]...)
+			return
+		}
+	}
+}
+
+func (a *testAuthority) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.records)
+}
+
+func startTestAuthority(t *testing.T) (*testAuthority, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &testAuthority{}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler:    a,
+		// The default rejects updates.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return a, pc.LocalAddr().String()
+}
+
+func TestUnicastDomain(t *testing.T) {
+	authority, addr := startTestAuthority(t)
+
+	server, err := RegisterProxy(mdnsName, mdnsService, "example.com", mdnsPort, "host.example.com.", []string{"192.0.2.1"}, []string{"txtv=0"}, nil, WithUnicastDNS(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authority.len() == 0 {
+		t.Fatal("no records registered")
+	}
+
+	resolver, err := NewResolver(WithUnicastResolver(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	entries, err := resolver.List(ctx, mdnsService, "example.com")
+	if err != nil && err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected one entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Instance != mdnsName || e.Port != mdnsPort || e.HostName != "host.example.com." {
+		t.Fatalf("Unexpected entry: %s %d %s", e.Instance, e.Port, e.HostName)
+	}
+	if len(e.AddrIPv4) != 1 || !e.AddrIPv4[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Unexpected addresses: %v", e.AddrIPv4)
+	}
+	if len(e.Text) != 1 || e.Text[0] != "txtv=0" {
+		t.Fatalf("Unexpected text: %v", e.Text)
+	}
+
+	// Removing a service leaves the records of others intact.
+	other, err := RegisterProxy("other", mdnsService, "example.com", mdnsPort, "other.example.com.", []string{"192.0.2.3"}, nil, nil, WithUnicastDNS(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := authority.len() / 2
+	server.Shutdown()
+	third, err := RegisterProxy("third", mdnsService, "example.com", mdnsPort, "third.example.com.", []string{"192.0.2.3"}, nil, nil, WithUnicastDNS(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Shutdown()
+	authority.mu.Lock()
+	for _, rr := range authority.records {
+		if rr.Header().Ttl == 0 || rr.Header().Class != dns.ClassINET {
+			t.Errorf("Expected %s to be kept unchanged", rr)
+		}
+	}
+	authority.mu.Unlock()
+	if n := authority.len(); n != kept {
+		t.Fatalf("Expected %d records to be kept, but got %d", kept, n)
+	}
+	other.Shutdown()
+	if n := authority.len(); n != 0 {
+		t.Fatalf("Expected the records to be removed, %d left", n)
+	}
+}
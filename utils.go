@@ -1,6 +1,10 @@
 package zeroconf
 
-import "strings"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 func parseSubtypes(service string) (string, []string) {
 	subtypes := strings.Split(service, ",")
@@ -11,3 +15,58 @@ func parseSubtypes(service string) (string, []string) {
 func trimDot(s string) string {
 	return strings.Trim(s, ".")
 }
+
+// maxTextLength is the maximum length of a character-string in a TXT record.
+const maxTextLength = 255
+
+// splitText splits the TXT strings exceeding the maximum length of a
+// character-string into several ones, see RFC6763 section 6.1. It returns a
+// copy of text.
+func splitText(text []string) []string {
+	if text == nil {
+		return nil
+	}
+	split := make([]string, 0, len(text))
+	for _, t := range text {
+		for len(t) > maxTextLength {
+			split = append(split, t[:maxTextLength])
+			t = t[maxTextLength:]
+		}
+		split = append(split, t)
+	}
+	return split
+}
+
+// encodeText encodes attrs as "key=value" strings sorted by key, followed by
+// flags as bare keys, see RFC6763 section 6.4.
+func encodeText(attrs map[string]string, flags []string) ([]string, error) {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var text []string
+	add := func(key, t string) error {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid TXT key %q", key)
+		}
+		// Longer strings would be split, cutting off the value.
+		if len(t) > maxTextLength {
+			return fmt.Errorf("TXT attribute %q exceeds %d bytes", key, maxTextLength)
+		}
+		text = append(text, t)
+		return nil
+	}
+	for _, k := range keys {
+		if err := add(k, k+"="+attrs[k]); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range flags {
+		if err := add(k, k); err != nil {
+			return nil, err
+		}
+	}
+	return text, nil
+}